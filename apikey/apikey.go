@@ -0,0 +1,354 @@
+/*
+Package apikey authenticates the requests with API keys checked against a store of hashed keys, giving
+the later middlewares access to the roles and metadata of the key owner as if they were JWT claims.
+
+The keys and where to read them from are declared at service level, inline or in a JSON file with the
+same format ({"keys": [...]}):
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/apikey": {
+			"header": "X-Api-Key",
+			"query": "api_key",
+			"keys_file": "./apikeys.json",
+			"keys": [
+				{
+					"id": "partner-a",
+					"hash": "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+					"roles": [ "orders:read" ],
+					"metadata": { "tier": "gold" }
+				},
+				{
+					"id": "partner-b",
+					"hash": "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+					"prefix": "pb_"
+				}
+			],
+			"admin_path": "/__apikeys",
+			"admin_token": "s3cr3t"
+		}
+	}
+
+The keys are read from the header (X-Api-Key by default) or, if declared and the header is missing,
+from the query string parameter, which is removed from the request. The hashes are either the hex
+encoded SHA-256 of the key, prefixed with "sha256:", or bcrypt hashes. The bcrypt keys must declare
+their prefix, and no prefix can start with another one, so every request is compared with one bcrypt
+hash at most; the keys already verified are cached in memory.
+
+The keys can be checked against a custom Store as well, set with SetStore. It replaces the keys of the
+service config, which must still declare the namespace (with the header, query... to use).
+
+The endpoints declare the namespace to require a valid key, and optionally the roles accepted (any of
+them):
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/apikey": {
+			"roles": [ "orders:read", "orders:admin" ]
+		}
+	}
+
+The requests without a valid key are rejected with a 401 and the ones without any of the roles with a
+403. The authenticated requests get the claims of the key ({"sub": id, "roles": roles} and the
+metadata) as gateway claims, in the X-Gateway-Claims header, so the middlewares reading the JWT claims
+(quota, redact, fieldauth, cel...) can use them. The proxy layer only sees it if the header is declared
+in the headers_to_pass list, which also forwards it to the backends. The key itself is removed from the
+header and the query string of the authenticated requests, so it never reaches the backends.
+
+The admin endpoint lists the keys (without their hashes) with GET {admin_path} and revokes a key with
+DELETE {admin_path}/{id}, both requiring the admin_token as bearer token (Authorization: Bearer
+s3cr3t). The revocations are kept in memory, so the keys must be removed (or declared
+with "revoked": true) from the config to be revoked permanently.
+*/
+package apikey
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/devopsfaith/krakend-ce/internal/admin"
+	"github.com/luraproject/lura/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/apikey"
+
+const (
+	defaultHeader = "X-Api-Key"
+	sha256Prefix  = "sha256:"
+)
+
+var (
+	// ErrNoConfig is returned when there is no apikey config
+	ErrNoConfig = errors.New("apikey: no config")
+	// ErrInvalidKey is returned when the key is unknown or revoked
+	ErrInvalidKey = errors.New("apikey: invalid key")
+	// ErrUnknownID is returned when revoking an unknown key
+	ErrUnknownID = errors.New("apikey: unknown key id")
+)
+
+// ServiceConfig is the custom config struct of the API key store
+type ServiceConfig struct {
+	Header     string `json:"header"`
+	Query      string `json:"query"`
+	Keys       []Key  `json:"keys"`
+	KeysFile   string `json:"keys_file"`
+	AdminPath  string `json:"admin_path"`
+	AdminToken string `json:"admin_token"`
+}
+
+// Config is the custom config struct of the endpoints requiring an API key
+type Config struct {
+	Roles []string `json:"roles"`
+}
+
+// Key is a hashed API key and the identity of its owner
+type Key struct {
+	ID       string                 `json:"id"`
+	Hash     string                 `json:"hash,omitempty"`
+	Prefix   string                 `json:"prefix,omitempty"`
+	Roles    []string               `json:"roles"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+	Revoked  bool                   `json:"revoked"`
+}
+
+// Claims returns the claims of the key owner
+func (k Key) Claims() map[string]interface{} {
+	c := make(map[string]interface{}, len(k.Metadata)+2)
+	for name, v := range k.Metadata {
+		c[name] = v
+	}
+	roles := make([]interface{}, len(k.Roles))
+	for i, r := range k.Roles {
+		roles[i] = r
+	}
+	c["sub"] = k.ID
+	c["roles"] = roles
+	return c
+}
+
+// HasAnyRole tells if the key has any of the roles. An empty list accepts every key.
+func (k Key) HasAnyRole(roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, r := range roles {
+		for _, kr := range k.Roles {
+			if r == kr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the API key store config of the service, loading the keys file if any
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Header == "" {
+		cfg.Header = defaultHeader
+	}
+	if cfg.KeysFile != "" {
+		b, err := ioutil.ReadFile(cfg.KeysFile)
+		if err != nil {
+			return cfg, fmt.Errorf("apikey: %s", err.Error())
+		}
+		file := ServiceConfig{}
+		if err := json.Unmarshal(b, &file); err != nil {
+			return cfg, fmt.Errorf("apikey: %s: %s", cfg.KeysFile, err.Error())
+		}
+		cfg.Keys = append(cfg.Keys, file.Keys...)
+	}
+	if cfg.AdminPath != "" && cfg.AdminToken == "" {
+		return cfg, fmt.Errorf("apikey: %s", admin.ErrNoToken.Error())
+	}
+	return cfg, nil
+}
+
+// ConfigGetter parses the apikey config of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	err := parse(e, &cfg)
+	return cfg, err
+}
+
+// Validate checks the keys of the service and the config of every endpoint
+func Validate(cfg config.ServiceConfig) error {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	hasService := err == nil
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	if hasService {
+		if _, err := NewHashStore(service.Keys); err != nil {
+			return err
+		}
+	}
+	for _, e := range cfg.Endpoints {
+		_, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil && !hasService {
+			err = errors.New("apikey: no keys declared at service level")
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// Store checks the API keys and revokes them
+type Store interface {
+	// Authenticate returns the key matching the received one, or ErrInvalidKey
+	Authenticate(ctx context.Context, key string) (Key, error)
+	// Revoke invalidates the key with the received id
+	Revoke(ctx context.Context, id string) error
+}
+
+// HashStore is a Store with the keys hashed with SHA-256 or bcrypt
+type HashStore struct {
+	mu       sync.RWMutex
+	byID     map[string]*Key
+	bySHA256 map[string]*Key
+	bcrypt   []*Key
+	verified map[string]*Key
+}
+
+// NewHashStore returns a HashStore with the received keys
+func NewHashStore(keys []Key) (*HashStore, error) {
+	s := &HashStore{
+		byID:     map[string]*Key{},
+		bySHA256: map[string]*Key{},
+		verified: map[string]*Key{},
+	}
+	for i := range keys {
+		k := keys[i]
+		if k.ID == "" {
+			return nil, fmt.Errorf("apikey: key #%d has no id", i)
+		}
+		if _, ok := s.byID[k.ID]; ok {
+			return nil, fmt.Errorf("apikey: duplicated key id %q", k.ID)
+		}
+		switch {
+		case strings.HasPrefix(k.Hash, sha256Prefix):
+			h := strings.ToLower(strings.TrimPrefix(k.Hash, sha256Prefix))
+			if b, err := hex.DecodeString(h); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("apikey: key %q has an invalid sha256 hash", k.ID)
+			}
+			s.bySHA256[h] = &k
+		case strings.HasPrefix(k.Hash, "$2"):
+			if _, err := bcrypt.Cost([]byte(k.Hash)); err != nil {
+				return nil, fmt.Errorf("apikey: key %q has an invalid bcrypt hash: %s", k.ID, err.Error())
+			}
+			if k.Prefix == "" {
+				return nil, fmt.Errorf("apikey: bcrypt key %q has no prefix", k.ID)
+			}
+			for _, other := range s.bcrypt {
+				if strings.HasPrefix(k.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, k.Prefix) {
+					return nil, fmt.Errorf("apikey: bcrypt keys %q and %q have overlapping prefixes", other.ID, k.ID)
+				}
+			}
+			s.bcrypt = append(s.bcrypt, &k)
+		default:
+			return nil, fmt.Errorf("apikey: key %q has an unsupported hash", k.ID)
+		}
+		s.byID[k.ID] = &k
+	}
+	return s, nil
+}
+
+// Authenticate implements the Store interface
+func (s *HashStore) Authenticate(_ context.Context, key string) (Key, error) {
+	if key == "" {
+		return Key{}, ErrInvalidKey
+	}
+	sum := sha256.Sum256([]byte(key))
+	digest := hex.EncodeToString(sum[:])
+
+	s.mu.RLock()
+	k, ok := s.bySHA256[digest]
+	if !ok {
+		k, ok = s.verified[digest]
+	}
+	var res Key
+	if ok {
+		res = *k
+	}
+	s.mu.RUnlock()
+	if ok {
+		return valid(res)
+	}
+
+	for _, k := range s.bcrypt {
+		if !strings.HasPrefix(key, k.Prefix) {
+			continue
+		}
+		// the prefixes do not overlap, so no other key can match
+		if bcrypt.CompareHashAndPassword([]byte(k.Hash), []byte(key)) != nil {
+			return Key{}, ErrInvalidKey
+		}
+		s.mu.Lock()
+		s.verified[digest] = k
+		res = *k
+		s.mu.Unlock()
+		return valid(res)
+	}
+	return Key{}, ErrInvalidKey
+}
+
+func valid(k Key) (Key, error) {
+	if k.Revoked {
+		return Key{}, ErrInvalidKey
+	}
+	return k, nil
+}
+
+// Revoke implements the Store interface
+func (s *HashStore) Revoke(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byID[id]
+	if !ok {
+		return ErrUnknownID
+	}
+	k.Revoked = true
+	return nil
+}
+
+// Keys returns the keys of the store, sorted by id and without their hashes
+func (s *HashStore) Keys() []Key {
+	s.mu.RLock()
+	keys := make([]Key, 0, len(s.byID))
+	for _, k := range s.byID {
+		c := *k
+		c.Hash = ""
+		keys = append(keys, c)
+	}
+	s.mu.RUnlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
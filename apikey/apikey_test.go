@@ -0,0 +1,206 @@
+package apikey
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func sha256Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return sha256Prefix + hex.EncodeToString(sum[:])
+}
+
+func newTestStore(t *testing.T) *HashStore {
+	h, err := bcrypt.GenerateFromPassword([]byte("pb_secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewHashStore([]Key{
+		{ID: "a", Hash: sha256Hash("secret-a"), Roles: []string{"orders:read"}, Metadata: map[string]interface{}{"tier": "gold"}},
+		{ID: "b", Hash: string(h), Prefix: "pb_", Roles: []string{"orders:admin"}},
+		{ID: "c", Hash: sha256Hash("secret-c"), Revoked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestHashStore(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+
+	for key, id := range map[string]string{"secret-a": "a", "pb_secret": "b", "secret-c": "", "pb_other": "", "": ""} {
+		for i := 0; i < 2; i++ {
+			k, err := s.Authenticate(ctx, key)
+			if id == "" {
+				if err != ErrInvalidKey {
+					t.Errorf("%q: unexpected error %v", key, err)
+				}
+				continue
+			}
+			if err != nil || k.ID != id {
+				t.Errorf("%q: unexpected result %+v %v", key, k, err)
+			}
+		}
+	}
+
+	if err := s.Revoke(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate(ctx, "pb_secret"); err != ErrInvalidKey {
+		t.Errorf("revoked key accepted: %v", err)
+	}
+	if err := s.Revoke(ctx, "x"); err != ErrUnknownID {
+		t.Errorf("unexpected error revoking an unknown key: %v", err)
+	}
+	for _, k := range s.Keys() {
+		if k.Hash != "" {
+			t.Errorf("hash of the key %s exposed", k.ID)
+		}
+	}
+
+	if _, err := NewHashStore([]Key{{ID: "x", Hash: "md5:abc"}}); err == nil {
+		t.Error("unsupported hash accepted")
+	}
+	h, _ := bcrypt.GenerateFromPassword([]byte("x"), bcrypt.MinCost)
+	if _, err := NewHashStore([]Key{{ID: "x", Hash: string(h)}}); err == nil {
+		t.Error("bcrypt key accepted without prefix")
+	}
+	if _, err := NewHashStore([]Key{{ID: "x", Hash: string(h), Prefix: "p"}, {ID: "y", Hash: string(h), Prefix: "pb_"}}); err == nil {
+		t.Error("overlapping prefixes accepted")
+	}
+}
+
+type testStore struct{ Store }
+
+func TestRegister(t *testing.T) {
+	custom := testStore{newTestStore(t)}
+	SetStore(custom)
+	defer SetStore(nil)
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	Register(config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"keys":        []interface{}{map[string]interface{}{"id": "z", "hash": sha256Hash("z")}},
+		"admin_path":  "/__apikeys",
+		"admin_token": "s3cr3t",
+	}}}, logging.NoOp, engine)
+	if activeStore() != Store(custom) {
+		t.Error("custom store replaced by the service keys")
+	}
+
+	for i, tc := range []struct {
+		token  string
+		status int
+	}{
+		{status: http.StatusUnauthorized},
+		{token: "wrong", status: http.StatusUnauthorized},
+		{token: "s3cr3t", status: http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("DELETE", "/__apikeys/a", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code %d", i, w.Code)
+		}
+	}
+	if _, err := custom.Authenticate(context.Background(), "secret-a"); err != ErrInvalidKey {
+		t.Error("key not revoked in the custom store")
+	}
+}
+
+func TestNewMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	mw := NewMiddleware(newTestStore(t), Config{Roles: []string{"orders:read"}}, defaultHeader, "api_key")
+
+	var got map[string]interface{}
+	var query, header string
+	engine := gin.New()
+	engine.GET("/orders", mw(func(c *gin.Context) {
+		got = claims.FromHTTPRequest(c.Request)
+		query = c.Request.URL.RawQuery
+		header = c.Request.Header.Get(defaultHeader)
+		c.Status(http.StatusOK)
+	}))
+
+	for i, tc := range []struct {
+		url    string
+		key    string
+		status int
+	}{
+		{url: "/orders", key: "secret-a", status: http.StatusOK},
+		{url: "/orders?api_key=secret-a&page=2", status: http.StatusOK},
+		{url: "/orders?api_key=other&page=2", key: "secret-a", status: http.StatusOK},
+		{url: "/orders", key: "pb_secret", status: http.StatusForbidden},
+		{url: "/orders", key: "secret-c", status: http.StatusUnauthorized},
+		{url: "/orders", status: http.StatusUnauthorized},
+	} {
+		got, query, header = nil, "", ""
+		req := httptest.NewRequest("GET", tc.url, nil)
+		req.Header.Set(claims.GatewayHeader, claims.Encode(map[string]interface{}{"sub": "forged"}))
+		if tc.key != "" {
+			req.Header.Set(defaultHeader, tc.key)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code %d", i, w.Code)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if got["sub"] != "a" || got["tier"] != "gold" || !claims.Contains(got, "roles", "orders:read") {
+			t.Errorf("#%d: unexpected claims %v", i, got)
+		}
+		if query != "" && query != "page=2" {
+			t.Errorf("#%d: key kept in the query string %q", i, query)
+		}
+		if header != "" {
+			t.Errorf("#%d: key kept in the header %q", i, header)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{{
+			Method:      "GET",
+			Endpoint:    "/a",
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{}},
+		}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("endpoint accepted without keys")
+	}
+	cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{
+		"keys": []interface{}{map[string]interface{}{"id": "a", "hash": "sha256:abc"}},
+	}}
+	if err := Validate(cfg); err == nil {
+		t.Error("invalid hash accepted")
+	}
+	cfg.ExtraConfig[Namespace].(map[string]interface{})["keys"] = []interface{}{
+		map[string]interface{}{"id": "a", "hash": sha256Hash("a")},
+	}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.ExtraConfig[Namespace].(map[string]interface{})["admin_path"] = "/__apikeys"
+	if err := Validate(cfg); err == nil {
+		t.Error("admin path accepted without admin token")
+	}
+}
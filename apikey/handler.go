@@ -0,0 +1,149 @@
+package apikey
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/devopsfaith/krakend-ce/internal/admin"
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+var current = struct {
+	mu     sync.RWMutex
+	store  Store
+	custom Store
+	header string
+	query  string
+}{}
+
+// SetStore sets a custom store, used by the handlers created from then on instead of the one with the
+// keys of the service config, whether it is called before or after Register
+func SetStore(s Store) {
+	current.mu.Lock()
+	current.custom = s
+	current.mu.Unlock()
+}
+
+// activeStore returns the custom store, if any, or the one with the keys of the service config
+func activeStore() Store {
+	current.mu.RLock()
+	defer current.mu.RUnlock()
+	if current.custom != nil {
+		return current.custom
+	}
+	return current.store
+}
+
+// Register loads the keys of the service config, to be used by the handlers created from then on, and
+// registers the admin endpoint if declared
+func Register(cfg config.ServiceConfig, l logging.Logger, engine *gin.Engine) {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil {
+		if err != ErrNoConfig {
+			l.Warning("apikey:", err.Error())
+		}
+		return
+	}
+	store, err := NewHashStore(service.Keys)
+	if err != nil {
+		l.Warning(err.Error())
+		return
+	}
+	current.mu.Lock()
+	current.store, current.header, current.query = store, service.Header, service.Query
+	current.mu.Unlock()
+	l.Debug(fmt.Sprintf("apikey: %d keys loaded", len(service.Keys)))
+
+	if service.AdminPath == "" {
+		return
+	}
+	group := engine.Group(service.AdminPath, admin.Middleware(service.AdminToken))
+	group.GET("", func(c *gin.Context) {
+		lister, ok := activeStore().(interface{ Keys() []Key })
+		if !ok {
+			c.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		c.JSON(http.StatusOK, lister.Keys())
+	})
+	group.DELETE("/:id", func(c *gin.Context) {
+		id := c.Param("id")
+		if err := activeStore().Revoke(c.Request.Context(), id); err != nil {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		l.Info("apikey admin: key revoked", id)
+		c.Status(http.StatusNoContent)
+	})
+	l.Debug("apikey admin: registered at", service.AdminPath)
+}
+
+// HandlerFactory returns a handler factory requiring a valid API key for the endpoints with an apikey
+// config
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err != nil {
+			if err != ErrNoConfig {
+				logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			}
+			return handlerFunc
+		}
+		store := activeStore()
+		current.mu.RLock()
+		header, query := current.header, current.query
+		current.mu.RUnlock()
+		if store == nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] apikey: no keys declared at service level", remote.Endpoint))
+			// the endpoint can not be exposed without its authentication
+			return func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusUnauthorized)
+			}
+		}
+		if header == "" {
+			header = defaultHeader
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] apikey: roles %v", remote.Endpoint, cfg.Roles))
+		return NewMiddleware(store, cfg, header, query)(handlerFunc)
+	}
+}
+
+// NewMiddleware returns a middleware authenticating the requests with the key found in the header or
+// the query string parameter (if not empty). Both are removed from the request before calling next.
+func NewMiddleware(store Store, cfg Config, header, query string) func(gin.HandlerFunc) gin.HandlerFunc {
+	return func(next gin.HandlerFunc) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			// the key is removed from the request, so it is not forwarded to the backends
+			key := c.Request.Header.Get(header)
+			c.Request.Header.Del(header)
+			if query != "" {
+				q := c.Request.URL.Query()
+				if key == "" {
+					key = q.Get(query)
+				}
+				if _, ok := q[query]; ok {
+					q.Del(query)
+					c.Request.URL.RawQuery = q.Encode()
+				}
+			}
+			k, err := store.Authenticate(c.Request.Context(), key)
+			if err != nil {
+				c.AbortWithError(http.StatusUnauthorized, err)
+				return
+			}
+			if !k.HasAnyRole(cfg.Roles) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Request = claims.Authenticate(c.Request, k.Claims())
+			next(c)
+		}
+	}
+}
@@ -4,6 +4,18 @@ import (
 	"context"
 
 	amqp "github.com/devopsfaith/krakend-amqp"
+	"github.com/devopsfaith/krakend-ce/bodytransform"
+	"github.com/devopsfaith/krakend-ce/conditional"
+	"github.com/devopsfaith/krakend-ce/faultinjection"
+	"github.com/devopsfaith/krakend-ce/fieldauth"
+	"github.com/devopsfaith/krakend-ce/kafka"
+	"github.com/devopsfaith/krakend-ce/pagination"
+	"github.com/devopsfaith/krakend-ce/partial"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/devopsfaith/krakend-ce/redis"
+	"github.com/devopsfaith/krakend-ce/responseschema"
+	"github.com/devopsfaith/krakend-ce/stub"
+	"github.com/devopsfaith/krakend-ce/transform"
 	cel "github.com/devopsfaith/krakend-cel"
 	cb "github.com/devopsfaith/krakend-circuitbreaker/gobreaker/proxy"
 	httpcache "github.com/devopsfaith/krakend-httpcache"
@@ -28,12 +40,24 @@ import (
 // - martian
 // - pubsub
 // - amqp
+// - redis
+// - kafka
+// - stub
+// - body transformation
+// - response schema validation
+// - fault injection
 // - cel
 // - lua
+// - transform
 // - rate-limit
+// - distributed rate-limit
 // - circuit breaker
+// - pagination
+// - field authorization
 // - metrics collector
 // - opencensus collector
+// - partial response policy
+// - conditional execution
 func NewBackendFactory(logger logging.Logger, metricCollector *metrics.Metrics) proxy.BackendFactory {
 	return NewBackendFactoryWithContext(context.Background(), logger, metricCollector)
 }
@@ -54,13 +78,25 @@ func NewBackendFactoryWithContext(ctx context.Context, logger logging.Logger, me
 	bf := pubsub.NewBackendFactory(ctx, logger, backendFactory)
 	backendFactory = bf.New
 	backendFactory = amqp.NewBackendFactory(ctx, logger, backendFactory)
+	backendFactory = redis.NewBackendFactory(ctx, logger, backendFactory)
+	backendFactory = kafka.NewBackendFactory(ctx, logger, backendFactory)
+	backendFactory = stub.BackendFactory(logger, backendFactory)
 	backendFactory = lambda.BackendFactory(backendFactory)
+	backendFactory = bodytransform.BackendFactory(logger, backendFactory)
+	backendFactory = responseschema.BackendFactory(logger, *metricCollector.Registry, backendFactory)
+	backendFactory = faultinjection.BackendFactory(logger, backendFactory)
 	backendFactory = cel.BackendFactory(logger, backendFactory)
 	backendFactory = lua.BackendFactory(logger, backendFactory)
+	backendFactory = transform.BackendFactory(logger, backendFactory)
 	backendFactory = juju.BackendFactory(backendFactory)
+	backendFactory = ratelimit.BackendFactory(logger, backendFactory)
 	backendFactory = cb.BackendFactory(backendFactory, logger)
+	backendFactory = pagination.BackendFactory(logger, backendFactory)
+	backendFactory = fieldauth.BackendFactory(logger, backendFactory)
 	backendFactory = metricCollector.BackendFactory("backend", backendFactory)
 	backendFactory = opencensus.BackendFactory(backendFactory)
+	backendFactory = partial.BackendFactory(logger, backendFactory)
+	backendFactory = conditional.BackendFactory(logger, backendFactory)
 	return backendFactory
 }
 
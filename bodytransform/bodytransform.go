@@ -0,0 +1,287 @@
+/*
+Package bodytransform rebuilds the body of the requests before they are sent to the backends.
+
+Sample backend config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/bodytransform": {
+			"template": "{\"data\": {{json .Body}}, \"user\": {{json (index .Claims \"sub\")}}, \"source\": {{json .Headers.Origin}}}",
+			"content_type": "application/json"
+		}
+	},
+	...
+
+The template is rendered with the request data (see the internal tmpl package) and the decoded body
+available as .Body: JSON bodies are decoded into their values, form bodies into an object with the
+first value of every field (or a list, when the field is repeated) and the rest are exposed as a string.
+Requests without body render the template with a nil .Body.
+
+The rendered document replaces the body of the request and the Content-Type (application/json by
+default) and Content-Length headers are updated. The layer runs right before the request executors, so
+it also applies to the pubsub, amqp, kafka and lambda backends.
+
+Instead of a template, the body can be built with a JSONata expression, adding "language": "jsonata" and
+the "expression" to the config. The expressions are evaluated against an object with the method, path,
+params, query, headers, claims and body keys, and their results are sent as JSON (an undefined result
+sends an empty body):
+
+	...
+	"github.com/devopsfaith/krakend-ce/bodytransform": {
+		"language": "jsonata",
+		"expression": "{\"data\": body, \"user\": claims.sub}"
+	}
+	...
+
+The form bodies are only decoded when the Content-Type header reaches the backends, so Validate rejects
+the endpoints whose headers_to_pass (when declared) does not include it.
+*/
+package bodytransform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	jsonata "github.com/blues/jsonata-go"
+	"github.com/devopsfaith/krakend-ce/internal/tmpl"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/bodytransform"
+
+// JSONata is the name of the JSONata language
+const JSONata = "jsonata"
+
+var (
+	// ErrNoConfig is returned when the backend has no bodytransform config
+	ErrNoConfig = errors.New("bodytransform: no config")
+	// ErrNoTemplate is returned when the config has no template
+	ErrNoTemplate = errors.New("bodytransform: no template defined")
+	// ErrNoExpression is returned when a JSONata config has no expression
+	ErrNoExpression = errors.New("bodytransform: no expression defined")
+	// ErrNoContentType is returned when the Content-Type header is not passed to the backends
+	ErrNoContentType = errors.New("bodytransform: the headers_to_pass must include the Content-Type")
+)
+
+// Config is the custom config struct of the body transformations
+type Config struct {
+	Template    string `json:"template"`
+	Expression  string `json:"expression"`
+	Language    string `json:"language"`
+	ContentType string `json:"content_type"`
+}
+
+// ConfigGetter parses the bodytransform config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	cfg.Language = strings.ToLower(cfg.Language)
+	switch cfg.Language {
+	case JSONata:
+		if cfg.Expression == "" {
+			return cfg, ErrNoExpression
+		}
+	case "":
+		if cfg.Template == "" {
+			return cfg, ErrNoTemplate
+		}
+	default:
+		return cfg, fmt.Errorf("bodytransform: unknown language %q", cfg.Language)
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "application/json"
+	}
+	return cfg, nil
+}
+
+// Validate parses every template and expression of the service config, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil {
+				_, err = New(c)
+			}
+			if err == nil && !passesContentType(e.HeadersToPass) {
+				err = ErrNoContentType
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// BackendFactory returns a backend factory rebuilding the request bodies of the backends with a
+// bodytransform config
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return next
+		}
+		mw, err := New(cfg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] bodytransform: %s", remote.URLPattern, err.Error()))
+			return next
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] rebuilding the request bodies", remote.URLPattern))
+		return mw(next)
+	}
+}
+
+// New returns the middleware of the config, parsing its template or compiling its expression
+func New(cfg Config) (proxy.Middleware, error) {
+	if cfg.Language == JSONata {
+		e, err := jsonata.Compile(cfg.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return NewJSONataMiddleware(e, cfg.ContentType), nil
+	}
+	t, err := tmpl.Parse("body", cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	return NewMiddleware(t, cfg.ContentType), nil
+}
+
+// NewMiddleware returns a middleware replacing the request body with the rendered template
+func NewMiddleware(t *template.Template, contentType string) proxy.Middleware {
+	return newMiddleware(func(data tmpl.Data) (string, error) {
+		return tmpl.Execute(t, data)
+	}, contentType)
+}
+
+// NewJSONataMiddleware returns a middleware replacing the request body with the JSON result of the
+// expression
+func NewJSONataMiddleware(e *jsonata.Expr, contentType string) proxy.Middleware {
+	return newMiddleware(func(data tmpl.Data) (string, error) {
+		res, err := e.Eval(map[string]interface{}{
+			"method":  data.Method,
+			"path":    data.Path,
+			"params":  data.Params,
+			"query":   data.Query,
+			"headers": data.Headers,
+			"claims":  data.Claims,
+			"body":    data.Body,
+		})
+		if err == jsonata.ErrUndefined {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(res)
+		return string(b), err
+	}, contentType)
+}
+
+func newMiddleware(render func(tmpl.Data) (string, error), contentType string) proxy.Middleware {
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) != 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			data := tmpl.FromRequest(r)
+			if r.Body != nil {
+				b, err := ioutil.ReadAll(r.Body)
+				r.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+				data.Body = decodeBody(data.Headers["Content-Type"], b)
+			}
+
+			body, err := render(data)
+			if err != nil {
+				return nil, err
+			}
+
+			headers := make(map[string][]string, len(r.Headers)+2)
+			for k, vs := range r.Headers {
+				headers[k] = vs
+			}
+			headers["Content-Type"] = []string{contentType}
+			headers["Content-Length"] = []string{strconv.Itoa(len(body))}
+			r.Headers = headers
+			r.Body = ioutil.NopCloser(strings.NewReader(body))
+
+			return next[0](ctx, r)
+		}
+	}
+}
+
+func passesContentType(headers []string) bool {
+	if len(headers) == 0 {
+		// lura passes the Content-Type by default
+		return true
+	}
+	for _, h := range headers {
+		if h == "*" || http.CanonicalHeaderKey(h) == "Content-Type" {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeBody(contentType string, b []byte) interface{} {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(b))
+		if err != nil {
+			return string(b)
+		}
+		res := make(map[string]interface{}, len(values))
+		for k, vs := range values {
+			if len(vs) == 1 {
+				res[k] = vs[0]
+				continue
+			}
+			list := make([]interface{}, len(vs))
+			for i, v := range vs {
+				list[i] = v
+			}
+			res[k] = list
+		}
+		return res
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	return v
+}
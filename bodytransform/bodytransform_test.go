@@ -0,0 +1,127 @@
+package bodytransform
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestBackendFactory(t *testing.T) {
+	gatewayClaims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1"}`))
+
+	template := map[string]interface{}{
+		"template":     `{"data":{{json .Body}},"user":{{json (index .Claims "sub")}}}`,
+		"content_type": "application/vnd.api+json",
+	}
+	expression := map[string]interface{}{
+		"language":     "JSONata",
+		"expression":   `{"data": body, "user": claims.sub}`,
+		"content_type": "application/vnd.api+json",
+	}
+
+	for _, tc := range []struct {
+		name        string
+		extra       map[string]interface{}
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			name:        "json",
+			extra:       template,
+			contentType: "application/json",
+			body:        `{"a":1,"b":[true]}`,
+			expected:    `{"data":{"a":1,"b":[true]},"user":"user-1"}`,
+		},
+		{
+			name:        "form",
+			extra:       template,
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        `a=1&b=x&b=y`,
+			expected:    `{"data":{"a":"1","b":["x","y"]},"user":"user-1"}`,
+		},
+		{
+			name:        "text",
+			extra:       template,
+			contentType: "text/plain",
+			body:        `hello`,
+			expected:    `{"data":"hello","user":"user-1"}`,
+		},
+		{
+			name:        "jsonata",
+			extra:       expression,
+			contentType: "application/x-www-form-urlencoded",
+			body:        `a=1&b=x&b=y`,
+			expected:    `{"data":{"a":"1","b":["x","y"]},"user":"user-1"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bf := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+				return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+					b, _ := ioutil.ReadAll(r.Body)
+					if string(b) != tc.expected {
+						t.Errorf("unexpected body: %s", string(b))
+					}
+					if ct := r.Headers["Content-Type"]; len(ct) != 1 || ct[0] != "application/vnd.api+json" {
+						t.Errorf("unexpected content type: %v", ct)
+					}
+					if cl := r.Headers["Content-Length"]; len(cl) != 1 || cl[0] != strconv.Itoa(len(b)) {
+						t.Errorf("unexpected content length: %v", cl)
+					}
+					return &proxy.Response{IsComplete: true}, nil
+				}
+			})
+			p := bf(&config.Backend{ExtraConfig: config.ExtraConfig{Namespace: tc.extra}})
+
+			headers := map[string][]string{"Content-Type": {tc.contentType}, "X-Gateway-Claims": {gatewayClaims}}
+			if _, err := p(context.Background(), &proxy.Request{
+				Headers: headers,
+				Body:    ioutil.NopCloser(strings.NewReader(tc.body)),
+			}); err != nil {
+				t.Error(err)
+			}
+			if headers["Content-Type"][0] != tc.contentType {
+				t.Error("the original headers were modified")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	newConfig := func(extra map[string]interface{}, headers ...string) config.ServiceConfig {
+		return config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint:      "/a",
+			HeadersToPass: headers,
+			Backend:       []*config.Backend{{ExtraConfig: config.ExtraConfig{Namespace: extra}}},
+		}}}
+	}
+
+	valid := map[string]interface{}{"expression": "body.a", "language": "jsonata"}
+	for _, headers := range [][]string{nil, {"content-type"}, {"*"}} {
+		if err := Validate(newConfig(valid, headers...)); err != nil {
+			t.Errorf("unexpected error with the headers %v: %v", headers, err)
+		}
+	}
+	if err := Validate(newConfig(valid, "Authorization")); err == nil || !strings.Contains(err.Error(), ErrNoContentType.Error()) {
+		t.Errorf("unexpected error without the content type: %v", err)
+	}
+
+	for _, extra := range []map[string]interface{}{
+		{"template": "{{.Body"},
+		{"expression": "body.a[", "language": "jsonata"},
+		{"template": "{}", "language": "jsonata"},
+		{"template": "{}", "language": "jq"},
+		{},
+	} {
+		if err := Validate(newConfig(extra)); err == nil {
+			t.Errorf("expecting error for %v", extra)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package canary
+
+import (
+	"net/http"
+
+	"github.com/devopsfaith/krakend-ce/internal/admin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+// AdminConfig is the service config of the canary admin handler
+type AdminConfig struct {
+	Path  string `json:"admin_path"`
+	Token string `json:"admin_token"`
+}
+
+// WeightsUpdate is the payload accepted by the admin handler
+type WeightsUpdate struct {
+	Method   string             `json:"method"`
+	Endpoint string             `json:"endpoint"`
+	Weights  map[string]float64 `json:"weights"`
+}
+
+// Register checks the service configuration and, if required, registers the admin handlers exposing
+// and updating the weights of the canary routers, which are not registered without an admin token
+func Register(cfg config.ServiceConfig, l logging.Logger, engine *gin.Engine) {
+	adminCfg := AdminConfig{}
+	if err := parse(cfg.ExtraConfig, &adminCfg); err != nil {
+		if err != ErrNoConfig {
+			l.Warning("canary admin:", err.Error())
+		}
+		return
+	}
+	if adminCfg.Path == "" {
+		return
+	}
+	if adminCfg.Token == "" {
+		l.Error("canary admin:", admin.ErrNoToken.Error())
+		return
+	}
+	group := engine.Group(adminCfg.Path, admin.Middleware(adminCfg.Token))
+	group.GET("", func(c *gin.Context) {
+		c.JSON(http.StatusOK, Weights.All())
+	})
+	group.PUT("", func(c *gin.Context) {
+		update := WeightsUpdate{}
+		if err := c.BindJSON(&update); err != nil {
+			return
+		}
+		if err := Weights.Set(update.Method, update.Endpoint, update.Weights); err != nil {
+			status := http.StatusBadRequest
+			if err == ErrNoConfig {
+				status = http.StatusNotFound
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		l.Info("canary admin: weights updated for", update.Method, update.Endpoint, update.Weights)
+		weights, _ := Weights.Get(update.Method, update.Endpoint)
+		c.JSON(http.StatusOK, weights)
+	})
+	l.Debug("canary admin: registered at", adminCfg.Path)
+}
@@ -0,0 +1,238 @@
+/*
+Package canary provides a proxy factory splitting the traffic of an endpoint between several sets of
+backends (variants) by weight.
+
+The backends are assigned to a variant with the backend extra config. Backends without variant belong
+to the default one, receiving the traffic not assigned to the other variants:
+
+	...
+	"backend": [
+		{ "url_pattern": "/v1/users/{id}" },
+		{
+			"url_pattern": "/v2/users/{id}",
+			"extra_config": {
+				"github.com/devopsfaith/krakend-ce/canary": { "variant": "v2" }
+			}
+		}
+	],
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/canary": {
+			"weights": { "v2": 10 },
+			"sticky": { "strategy": "claim", "key": "sub" },
+			"override_header": "X-Canary-Variant"
+		}
+	},
+	...
+
+Weights are percentages. When a sticky strategy ("claim", "cookie" or "header") is defined and the
+request contains the key, the same caller is always routed to the same variant for a given set of
+weights. The claim strategy reads the claims authenticated by the gateway, so the endpoint must
+declare the X-Gateway-Claims header in its headers_to_pass list. The override header, when present and
+containing a known variant name, forces the variant (useful for QA). The weights can be updated at
+runtime through the Weights registry, keyed by the method and the path of the endpoint (e.g. "GET
+/users/{id}"). The service extra config can expose them with an admin handler:
+
+	"github.com/devopsfaith/krakend-ce/canary": { "admin_path": "/__canary", "admin_token": "s3cr3t" }
+
+A GET request to the admin path lists the weights of every endpoint and a PUT request with a body like
+{"method": "GET", "endpoint": "/users/{id}", "weights": {"v2": 50}} updates them. Both require the
+admin_token as bearer token (Authorization: Bearer s3cr3t), and the handler is not registered without
+it.
+
+Every variant counts its requests and errors with the canary.<endpoint>.<variant>.requests and
+canary.<endpoint>.<variant>.errors metrics.
+*/
+package canary
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/devopsfaith/krakend-ce/internal/admin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/canary"
+
+// DefaultVariant is the name of the variant grouping the backends without an explicit variant
+const DefaultVariant = "default"
+
+var (
+	// ErrNoConfig is returned when there is no canary config
+	ErrNoConfig = errors.New("canary: no config")
+	// ErrUnknownVariant is returned when a weight is defined for a variant without backends
+	ErrUnknownVariant = errors.New("canary: unknown variant")
+	// ErrInvalidWeights is returned when the weights are negative or exceed 100
+	ErrInvalidWeights = errors.New("canary: weights must be positive and sum up to 100 or less")
+	// ErrInvalidSticky is returned when the sticky strategy is unknown or it has no key
+	ErrInvalidSticky = errors.New("canary: the sticky strategy must be claim, cookie or header, with a key")
+)
+
+// Config is the endpoint config of the canary router
+type Config struct {
+	Weights        map[string]float64 `json:"weights"`
+	Sticky         StickyConfig       `json:"sticky"`
+	OverrideHeader string             `json:"override_header"`
+}
+
+// StickyConfig defines how to identify the caller for the sticky assignments
+type StickyConfig struct {
+	Strategy string `json:"strategy"`
+	Key      string `json:"key"`
+}
+
+// BackendConfig is the backend config assigning it to a variant
+type BackendConfig struct {
+	Variant string `json:"variant"`
+}
+
+// ConfigGetter parses the canary config of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// BackendConfigGetter parses the canary config of the backend
+func BackendConfigGetter(e config.ExtraConfig) (BackendConfig, error) {
+	cfg := BackendConfig{}
+	err := parse(e, &cfg)
+	if cfg.Variant == "" {
+		cfg.Variant = DefaultVariant
+	}
+	return cfg, err
+}
+
+func parse(e config.ExtraConfig, dst interface{}) error {
+	v, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	return json.NewDecoder(buf).Decode(dst)
+}
+
+// NewFactory returns a proxy factory routing the requests of the endpoints with a canary config to
+// one of the variants defined at their backends. The rest of endpoints are delegated to the injected
+// factory.
+func NewFactory(f proxy.Factory, logger logging.Logger, registry gometrics.Registry) proxy.Factory {
+	if registry == nil {
+		registry = gometrics.NewRegistry()
+	}
+	return proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		canaryCfg, err := ConfigGetter(cfg.ExtraConfig)
+		if err == ErrNoConfig {
+			return f.New(cfg)
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] canary: %s", cfg.Endpoint, err.Error()))
+			return f.New(cfg)
+		}
+
+		variants, names, err := backendVariants(cfg)
+		if err != nil {
+			return proxy.NoopProxy, err
+		}
+		if len(variants) == 1 {
+			logger.Warning(fmt.Sprintf("[ENDPOINT: %s] canary: a single variant defined", cfg.Endpoint))
+			return f.New(cfg)
+		}
+
+		proxies := make(map[string]proxy.Proxy, len(variants))
+		for _, name := range names {
+			vcfg := *cfg
+			vcfg.Backend = variants[name]
+			p, err := f.New(&vcfg)
+			if err != nil {
+				return proxy.NoopProxy, err
+			}
+			proxies[name] = newMetricsProxy(p, registry, cfg.Endpoint, name)
+		}
+
+		r, err := newRouter(cfg.Endpoint, names, canaryCfg)
+		if err != nil {
+			return proxy.NoopProxy, err
+		}
+		Weights.register(key(cfg.Method, cfg.Endpoint), r)
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] canary: variants %v", cfg.Endpoint, names))
+		return NewProxy(r, proxies), nil
+	})
+}
+
+// Validate checks the canary config of every endpoint and the admin config of the service config,
+// returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	adminCfg := AdminConfig{}
+	if err := parse(cfg.ExtraConfig, &adminCfg); err != nil && err != ErrNoConfig {
+		return fmt.Errorf("canary admin: %s", err.Error())
+	}
+	if adminCfg.Path != "" && adminCfg.Token == "" {
+		return fmt.Errorf("canary admin: %s", admin.ErrNoToken.Error())
+	}
+	for _, e := range cfg.Endpoints {
+		if err := validate(e); err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+func validate(cfg *config.EndpointConfig) error {
+	canaryCfg, err := ConfigGetter(cfg.ExtraConfig)
+	if err == ErrNoConfig {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	variants, names, err := backendVariants(cfg)
+	if err != nil || len(variants) == 1 {
+		return err
+	}
+	_, err = newRouter(cfg.Endpoint, names, canaryCfg)
+	return err
+}
+
+// backendVariants groups the backends of the endpoint by variant, returning the sorted variant names.
+// Endpoints with several variants must have default backends.
+func backendVariants(cfg *config.EndpointConfig) (map[string][]*config.Backend, []string, error) {
+	variants := map[string][]*config.Backend{}
+	for _, b := range cfg.Backend {
+		backendCfg, err := BackendConfigGetter(b.ExtraConfig)
+		if err != nil && err != ErrNoConfig {
+			return nil, nil, err
+		}
+		variants[backendCfg.Variant] = append(variants[backendCfg.Variant], b)
+	}
+	if _, ok := variants[DefaultVariant]; !ok && len(variants) > 1 {
+		return nil, nil, fmt.Errorf("canary: the endpoint %s has no default backends", cfg.Endpoint)
+	}
+
+	names := make([]string, 0, len(variants))
+	for name := range variants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return variants, names, nil
+}
+
+func key(method, endpoint string) string {
+	if method == "" {
+		method = http.MethodGet
+	}
+	return strings.ToUpper(method) + " " + endpoint
+}
@@ -0,0 +1,158 @@
+package canary
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func newTestProxy(t *testing.T, method, endpoint string, extra map[string]interface{}) (proxy.Proxy, gometrics.Registry) {
+	registry := gometrics.NewRegistry()
+	pf := proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		name := cfg.Backend[0].URLPattern
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: map[string]interface{}{"backend": name}}, nil
+		}, nil
+	})
+	p, err := NewFactory(pf, logging.NoOp, registry).New(&config.EndpointConfig{
+		Method:   method,
+		Endpoint: endpoint,
+		Backend: []*config.Backend{
+			{URLPattern: "/v1"},
+			{URLPattern: "/v2", ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"variant": "v2"}}},
+		},
+		ExtraConfig: config.ExtraConfig{Namespace: extra},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, registry
+}
+
+func TestNewFactory_weights(t *testing.T) {
+	p, registry := newTestProxy(t, "GET", "/weights", map[string]interface{}{"weights": map[string]interface{}{"v2": 25}})
+
+	for i := 0; i < 1000; i++ {
+		if _, err := p(context.Background(), &proxy.Request{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v2 := gometrics.GetOrRegisterCounter("canary./weights.v2.requests", registry).Count()
+	v1 := gometrics.GetOrRegisterCounter("canary./weights.default.requests", registry).Count()
+	if v1+v2 != 1000 || v2 < 150 || v2 > 350 {
+		t.Errorf("unexpected distribution: default %d, v2 %d", v1, v2)
+	}
+
+	if err := Weights.Set("GET", "/weights", map[string]float64{"v2": 100}); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := p(context.Background(), &proxy.Request{})
+	if resp.Data["backend"] != "/v2" {
+		t.Errorf("unexpected backend: %v", resp.Data["backend"])
+	}
+	if err := Weights.Set("GET", "/weights", map[string]float64{"v3": 10}); err != ErrUnknownVariant {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewFactory_stickyAndOverride(t *testing.T) {
+	p, _ := newTestProxy(t, "GET", "/sticky", map[string]interface{}{
+		"weights":         map[string]interface{}{"v2": 50},
+		"sticky":          map[string]interface{}{"strategy": "claim", "key": "sub"},
+		"override_header": "X-Canary",
+	})
+
+	for _, sub := range []string{"a", "b", "c", "d"} {
+		gatewayClaims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"` + sub + `"}`))
+		first, _ := p(context.Background(), &proxy.Request{Headers: map[string][]string{"X-Gateway-Claims": {gatewayClaims}}})
+		for i := 0; i < 10; i++ {
+			resp, _ := p(context.Background(), &proxy.Request{Headers: map[string][]string{"X-Gateway-Claims": {gatewayClaims}}})
+			if resp.Data["backend"] != first.Data["backend"] {
+				t.Errorf("sub %s: assignment is not sticky", sub)
+			}
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		resp, _ := p(context.Background(), &proxy.Request{Headers: map[string][]string{"X-Canary": {"v2"}}})
+		if resp.Data["backend"] != "/v2" {
+			t.Errorf("unexpected backend: %v", resp.Data["backend"])
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	backends := []*config.Backend{
+		{URLPattern: "/v1"},
+		{URLPattern: "/v2", ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"variant": "v2"}}},
+	}
+	for name, tc := range map[string]struct {
+		service  map[string]interface{}
+		endpoint map[string]interface{}
+		valid    bool
+	}{
+		"valid": {
+			endpoint: map[string]interface{}{"weights": map[string]interface{}{"v2": 10}, "sticky": map[string]interface{}{"strategy": "claim", "key": "sub"}},
+			valid:    true,
+		},
+		"unknown variant":     {endpoint: map[string]interface{}{"weights": map[string]interface{}{"v3": 10}}},
+		"weights over 100":    {endpoint: map[string]interface{}{"weights": map[string]interface{}{"v2": 110}}},
+		"unknown strategy":    {endpoint: map[string]interface{}{"sticky": map[string]interface{}{"strategy": "ip", "key": "x"}}},
+		"sticky without key":  {endpoint: map[string]interface{}{"sticky": map[string]interface{}{"strategy": "header"}}},
+		"admin without token": {service: map[string]interface{}{"admin_path": "/__canary"}},
+	} {
+		cfg := config.ServiceConfig{Endpoints: []*config.EndpointConfig{{Endpoint: "/foo", Backend: backends}}}
+		if tc.service != nil {
+			cfg.ExtraConfig = config.ExtraConfig{Namespace: tc.service}
+		}
+		if tc.endpoint != nil {
+			cfg.Endpoints[0].ExtraConfig = config.ExtraConfig{Namespace: tc.endpoint}
+		}
+		if err := Validate(cfg); tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	newTestProxy(t, "GET", "/admin", map[string]interface{}{"weights": map[string]interface{}{"v2": 5}})
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	Register(config.ServiceConfig{ExtraConfig: config.ExtraConfig{
+		Namespace: map[string]interface{}{"admin_path": "/__canary", "admin_token": "s3cr3t"},
+	}}, logging.NoOp, engine)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", "/__canary", strings.NewReader(`{"method":"GET","endpoint":"/admin","weights":{"v2":10}}`))
+	req.Header.Set("Authorization", "Bearer wrong")
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code without the admin token: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/__canary", strings.NewReader(`{"method":"GET","endpoint":"/admin","weights":{"v2":40}}`))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != `{"default":60,"v2":40}` {
+		t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", "/__canary", strings.NewReader(`{"endpoint":"/unknown","weights":{"v2":40}}`))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unexpected status code: %d", w.Code)
+	}
+}
@@ -0,0 +1,254 @@
+package canary
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// buckets is the resolution of the traffic split (0.01%)
+const buckets = 10000
+
+// Router selects the variant for every request
+type Router struct {
+	endpoint string
+	variants []string
+	sticky   StickyConfig
+	override string
+
+	mu      sync.RWMutex
+	weights map[string]float64
+	ranges  []variantRange
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+type variantRange struct {
+	name  string
+	limit uint32
+}
+
+func newRouter(endpoint string, variants []string, cfg Config) (*Router, error) {
+	switch cfg.Sticky.Strategy {
+	case "":
+	case "claim", "cookie", "header":
+		if cfg.Sticky.Key == "" {
+			return nil, ErrInvalidSticky
+		}
+	default:
+		return nil, ErrInvalidSticky
+	}
+	r := &Router{
+		endpoint: endpoint,
+		variants: variants,
+		sticky:   cfg.Sticky,
+		override: cfg.OverrideHeader,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if err := r.SetWeights(cfg.Weights); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Weights returns a copy of the current weights
+func (r *Router) Weights() map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make(map[string]float64, len(r.weights))
+	for k, v := range r.weights {
+		res[k] = v
+	}
+	return res
+}
+
+// SetWeights replaces the weights of the router. The default variant receives the remaining traffic.
+func (r *Router) SetWeights(weights map[string]float64) error {
+	total := 0.0
+	for name, w := range weights {
+		if name == DefaultVariant {
+			continue
+		}
+		if !r.known(name) {
+			return ErrUnknownVariant
+		}
+		if w < 0 {
+			return ErrInvalidWeights
+		}
+		total += w
+	}
+	if total > 100 {
+		return ErrInvalidWeights
+	}
+
+	ranges := []variantRange{}
+	limit := uint32(0)
+	current := map[string]float64{}
+	for _, name := range r.variants {
+		if name == DefaultVariant {
+			continue
+		}
+		w := weights[name]
+		current[name] = w
+		limit += uint32(w * buckets / 100)
+		ranges = append(ranges, variantRange{name: name, limit: limit})
+	}
+	current[DefaultVariant] = 100 - total
+
+	r.mu.Lock()
+	r.weights = current
+	r.ranges = ranges
+	r.mu.Unlock()
+	return nil
+}
+
+// Select returns the variant to use for the received request
+func (r *Router) Select(req *proxy.Request) string {
+	if r.override != "" {
+		if v := header(req.Headers, r.override); v != "" && r.known(v) {
+			return v
+		}
+	}
+
+	var bucket uint32
+	if key := r.stickyKey(req); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(r.endpoint))
+		h.Write([]byte(key))
+		bucket = h.Sum32() % buckets
+	} else {
+		r.randMu.Lock()
+		bucket = uint32(r.rand.Intn(buckets))
+		r.randMu.Unlock()
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, vr := range r.ranges {
+		if bucket < vr.limit {
+			return vr.name
+		}
+	}
+	return DefaultVariant
+}
+
+func (r *Router) known(name string) bool {
+	for _, v := range r.variants {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) stickyKey(req *proxy.Request) string {
+	switch r.sticky.Strategy {
+	case "claim":
+		v, _ := claims.LookupString(claims.FromHeaders(req.Headers), r.sticky.Key)
+		return v
+	case "header":
+		return header(req.Headers, r.sticky.Key)
+	case "cookie":
+		httpReq := http.Request{Header: http.Header{"Cookie": headerValues(req.Headers, "Cookie")}}
+		if c, err := httpReq.Cookie(r.sticky.Key); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func header(headers map[string][]string, name string) string {
+	if vs := headerValues(headers, name); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func headerValues(headers map[string][]string, name string) []string {
+	if vs, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+		return vs
+	}
+	for k, vs := range headers {
+		if strings.EqualFold(k, name) {
+			return vs
+		}
+	}
+	return nil
+}
+
+// NewProxy returns a proxy forwarding every request to the proxy of the variant selected by the router
+func NewProxy(r *Router, variants map[string]proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		return variants[r.Select(req)](ctx, req)
+	}
+}
+
+func newMetricsProxy(next proxy.Proxy, registry gometrics.Registry, endpoint, variant string) proxy.Proxy {
+	prefix := "canary." + endpoint + "." + variant + "."
+	requests := gometrics.GetOrRegisterCounter(prefix+"requests", registry)
+	errs := gometrics.GetOrRegisterCounter(prefix+"errors", registry)
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		requests.Inc(1)
+		resp, err := next(ctx, req)
+		if err != nil {
+			errs.Inc(1)
+		}
+		return resp, err
+	}
+}
+
+// Weights is the registry of all the canary routers, indexed by method and endpoint
+var Weights = &registry{routers: map[string]*Router{}}
+
+type registry struct {
+	mu      sync.RWMutex
+	routers map[string]*Router
+}
+
+func (r *registry) register(k string, router *Router) {
+	r.mu.Lock()
+	r.routers[k] = router
+	r.mu.Unlock()
+}
+
+// Get returns the current weights of the endpoint
+func (r *registry) Get(method, endpoint string) (map[string]float64, bool) {
+	r.mu.RLock()
+	router, ok := r.routers[key(method, endpoint)]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return router.Weights(), true
+}
+
+// All returns the current weights of all the endpoints
+func (r *registry) All() map[string]map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make(map[string]map[string]float64, len(r.routers))
+	for endpoint, router := range r.routers {
+		res[endpoint] = router.Weights()
+	}
+	return res
+}
+
+// Set updates the weights of the endpoint
+func (r *registry) Set(method, endpoint string, weights map[string]float64) error {
+	r.mu.RLock()
+	router, ok := r.routers[key(method, endpoint)]
+	r.mu.RUnlock()
+	if !ok {
+		return ErrNoConfig
+	}
+	return router.SetWeights(weights)
+}
@@ -53,5 +53,5 @@ func main() {
 		})
 	}
 
-	cmd.Execute(cfg, krakend.NewExecutor(ctx))
+	cmd.Execute(krakend.NewConfigParser(cfg), krakend.NewExecutor(ctx))
 }
@@ -0,0 +1,388 @@
+/*
+Package compression compresses the responses of the gateway with brotli, zstd or gzip, negotiated
+through the Accept-Encoding header of the requests.
+
+Sample service config:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/compression": {
+			"algorithms": [ "br", "zstd", "gzip" ],
+			"min_size": 1024,
+			"content_types": [ "application/json", "application/xml", "text/*" ]
+		}
+	}
+
+The algorithms are listed in order of preference (all of them by default) and the first one accepted
+by the client is used. The responses smaller than min_size (1024 bytes by default) or with a content
+type out of the content_types list (the default one above) are sent as they are.
+
+The endpoints can override the service settings with the same namespace, and disable the compression
+with "disabled": true:
+
+	...
+	"endpoint": "/downloads/{file}",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/compression": {
+			"disabled": true
+		}
+	},
+	...
+
+Only the start of the responses (up to min_size) is buffered. The websocket upgrades, the event
+streams, the flushed responses and the responses already encoded (i.e. passed through by no-op
+backends with a Content-Encoding) are never compressed. The strong ETags of the compressed responses
+are sent as weak ones, as the encoded bodies are not byte-for-byte equal to the rendered ones.
+*/
+package compression
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/compression"
+
+const defaultMinSize = 1024
+
+var (
+	// ErrNoConfig is returned when there is no compression config
+	ErrNoConfig = errors.New("compression: no config")
+
+	defaultAlgorithms   = []string{Brotli, Zstd, Gzip}
+	defaultContentTypes = []string{"application/json", "application/xml", "text/*"}
+)
+
+// Config is the custom config struct of the compression middleware
+type Config struct {
+	Disabled     bool     `json:"disabled"`
+	Algorithms   []string `json:"algorithms"`
+	MinSize      *int     `json:"min_size"`
+	ContentTypes []string `json:"content_types"`
+}
+
+// ConfigGetter parses the compression config of the service or the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	for _, a := range cfg.Algorithms {
+		if _, ok := encoders[a]; !ok {
+			return cfg, fmt.Errorf("compression: unknown algorithm %q", a)
+		}
+	}
+	return cfg, nil
+}
+
+// merge returns the config with the settings declared by the override
+func (c Config) merge(override Config) Config {
+	c.Disabled = override.Disabled
+	if len(override.Algorithms) > 0 {
+		c.Algorithms = override.Algorithms
+	}
+	if override.MinSize != nil {
+		c.MinSize = override.MinSize
+	}
+	if len(override.ContentTypes) > 0 {
+		c.ContentTypes = override.ContentTypes
+	}
+	return c
+}
+
+type settings struct {
+	algorithms   []string
+	minSize      int
+	contentTypes []string
+}
+
+func newSettings(cfg Config) *settings {
+	if cfg.Disabled {
+		return nil
+	}
+	s := &settings{
+		algorithms:   cfg.Algorithms,
+		minSize:      defaultMinSize,
+		contentTypes: cfg.ContentTypes,
+	}
+	if len(s.algorithms) == 0 {
+		s.algorithms = defaultAlgorithms
+	}
+	if cfg.MinSize != nil {
+		s.minSize = *cfg.MinSize
+	}
+	if len(s.contentTypes) == 0 {
+		s.contentTypes = defaultContentTypes
+	}
+	return s
+}
+
+// Validate checks the compression config of the service and the endpoints
+func Validate(cfg config.ServiceConfig) error {
+	if _, err := ConfigGetter(cfg.ExtraConfig); err != nil && err != ErrNoConfig {
+		return err
+	}
+	for _, e := range cfg.Endpoints {
+		if _, err := ConfigGetter(e.ExtraConfig); err != nil && err != ErrNoConfig {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// Register adds the compression middleware to the engine if the service or any endpoint has a
+// compression config
+func Register(cfg config.ServiceConfig, l logging.Logger, engine *gin.Engine) {
+	service, err := ConfigGetter(cfg.ExtraConfig)
+	hasService := err == nil
+	if err != nil && err != ErrNoConfig {
+		l.Warning("compression:", err.Error())
+		return
+	}
+
+	routes := map[string]*settings{}
+	for _, e := range cfg.Endpoints {
+		override, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err != nil {
+			l.Warning(fmt.Sprintf("[ENDPOINT: %s] %s", e.Endpoint, err.Error()))
+			continue
+		}
+		routes[e.Method+" "+e.Endpoint] = newSettings(service.merge(override))
+	}
+	if !hasService && len(routes) == 0 {
+		return
+	}
+
+	var defaults *settings
+	if hasService {
+		defaults = newSettings(service)
+	}
+	engine.Use(NewMiddleware(defaults, routes))
+}
+
+// NewMiddleware returns a gin middleware compressing the responses with the settings of the matched
+// route, or the defaults ones. A nil settings disables the compression.
+func NewMiddleware(defaults *settings, routes map[string]*settings) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s, ok := routes[c.Request.Method+" "+c.FullPath()]
+		if !ok {
+			s = defaults
+		}
+		if s == nil || isStream(c.Request) {
+			c.Next()
+			return
+		}
+		algorithm := negotiate(c.GetHeader("Accept-Encoding"), s.algorithms)
+		if algorithm == "" {
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Accept-Encoding")
+
+		w := &writer{ResponseWriter: c.Writer, settings: s, algorithm: algorithm, status: http.StatusOK}
+		c.Writer = w
+		c.Next()
+		c.Writer = w.ResponseWriter
+		w.Close()
+	}
+}
+
+func isStream(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// negotiate returns the first algorithm accepted by the client, honouring the q-values
+func negotiate(acceptEncoding string, algorithms []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q
+	}
+	for _, a := range algorithms {
+		q, ok := accepted[a]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return a
+		}
+	}
+	return ""
+}
+
+func (s *settings) compressible(contentType string) bool {
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if contentType == "" || contentType == "text/event-stream" {
+		return false
+	}
+	for _, allowed := range s.contentTypes {
+		if allowed == contentType || allowed == "*/*" ||
+			(strings.HasSuffix(allowed, "/*") && strings.HasPrefix(contentType, allowed[:len(allowed)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	undecided = iota
+	passthrough
+	compressing
+)
+
+type writer struct {
+	gin.ResponseWriter
+	settings  *settings
+	algorithm string
+	status    int
+	state     int
+	buf       []byte
+	encoder   io.WriteCloser
+}
+
+func (w *writer) WriteHeader(code int) {
+	if w.state != undecided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 {
+		w.status = code
+	}
+}
+
+func (w *writer) WriteHeaderNow() {
+	if w.state == undecided {
+		// the headers are not sent until the body is classified
+		return
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	switch w.state {
+	case passthrough:
+		return w.ResponseWriter.Write(b)
+	case compressing:
+		return w.encoder.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.settings.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *writer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *writer) Status() int {
+	if w.state == undecided {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *writer) Written() bool {
+	return w.state != undecided || len(w.buf) > 0 || w.ResponseWriter.Written()
+}
+
+// Flush sends the pending data. The responses flushed before being classified are not compressed.
+func (w *writer) Flush() {
+	if w.state == undecided {
+		w.decide(false)
+	}
+	if f, ok := w.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// Close sends the pending data and closes the encoder
+func (w *writer) Close() error {
+	if w.state == undecided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	return nil
+}
+
+// decide sends the headers and the buffered data, compressing them if allowed
+func (w *writer) decide(compress bool) error {
+	h := w.ResponseWriter.Header()
+	compress = compress &&
+		h.Get("Content-Encoding") == "" &&
+		w.status != http.StatusNoContent && w.status != http.StatusNotModified &&
+		w.settings.compressible(h.Get("Content-Type"))
+
+	buf := w.buf
+	w.buf = nil
+	if !compress {
+		w.state = passthrough
+		w.ResponseWriter.WriteHeader(w.status)
+		if len(buf) == 0 {
+			w.ResponseWriter.WriteHeaderNow()
+			return nil
+		}
+		_, err := w.ResponseWriter.Write(buf)
+		return err
+	}
+
+	w.state = compressing
+	h.Set("Content-Encoding", w.algorithm)
+	h.Del("Content-Length")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	encoder, err := encoders[w.algorithm](w.ResponseWriter)
+	if err != nil {
+		return err
+	}
+	w.encoder = encoder
+	_, err = w.encoder.Write(buf)
+	return err
+}
@@ -0,0 +1,106 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestRegister(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	body := strings.Repeat(`{"foo":"bar"}`, 200)
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"min_size": 100}},
+		Endpoints: []*config.EndpointConfig{
+			{Endpoint: "/raw/:id", Method: http.MethodGet, ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"disabled": true}}},
+			{Endpoint: "/gzip", Method: http.MethodGet, ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"algorithms": []string{"gzip"}}}},
+		},
+	}
+	engine := gin.New()
+	Register(cfg, logging.NoOp, engine)
+	handler := func(c *gin.Context) {
+		c.Header("ETag", `"abc"`)
+		c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(body))
+	}
+	engine.GET("/json", handler)
+	engine.GET("/raw/:id", handler)
+	engine.GET("/gzip", handler)
+	engine.GET("/small", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"a": 1}) })
+	engine.GET("/encoded", func(c *gin.Context) {
+		c.Header("Content-Encoding", "gzip")
+		c.Data(http.StatusOK, "application/json", []byte(body))
+	})
+	engine.GET("/binary", func(c *gin.Context) { c.Data(http.StatusOK, "image/png", []byte(body)) })
+
+	decoders := map[string]func([]byte) ([]byte, error){
+		"": func(b []byte) ([]byte, error) { return b, nil },
+		Gzip: func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadAll(r)
+		},
+		Brotli: func(b []byte) ([]byte, error) { return ioutil.ReadAll(brotli.NewReader(bytes.NewReader(b))) },
+		Zstd: func(b []byte) ([]byte, error) {
+			r, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			return r.DecodeAll(b, nil)
+		},
+	}
+
+	for _, tc := range []struct {
+		path     string
+		accept   string
+		encoding string
+	}{
+		{path: "/json", accept: "gzip, br;q=0.5, zstd", encoding: Brotli},
+		{path: "/json", accept: "gzip, br;q=0, zstd", encoding: Zstd},
+		{path: "/json", accept: "gzip", encoding: Gzip},
+		{path: "/json", accept: "identity"},
+		{path: "/raw/1", accept: "gzip"},
+		{path: "/gzip", accept: "br, zstd, *", encoding: Gzip},
+		{path: "/small", accept: "gzip"},
+		{path: "/binary", accept: "gzip"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != tc.encoding {
+			t.Errorf("%s %s: unexpected response %d %v", tc.path, tc.accept, w.Code, w.Header())
+			continue
+		}
+		b, err := decoders[tc.encoding](w.Body.Bytes())
+		if err != nil {
+			t.Errorf("%s %s: %s", tc.path, tc.accept, err.Error())
+			continue
+		}
+		if tc.path != "/small" && string(b) != body {
+			t.Errorf("%s %s: unexpected body %s", tc.path, tc.accept, string(b))
+		}
+		if tc.encoding != "" && w.Header().Get("ETag") != `W/"abc"` {
+			t.Errorf("%s %s: unexpected etag %s", tc.path, tc.accept, w.Header().Get("ETag"))
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/encoded", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Body.String() != body {
+		t.Errorf("the encoded response was altered: %v", w.Header())
+	}
+}
@@ -0,0 +1,296 @@
+/*
+Package conditional decides with CEL expressions whether the backends of an endpoint are called.
+
+Sample backend config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/conditional": {
+			"run_if": "responses[0].account.type == 'premium' && 'admin' in JWT.roles"
+		}
+	},
+	...
+
+The expressions have access to the same request variables as the krakend-cel checks (req_method,
+req_path, req_params, req_headers, req_querystring and now), the JWT claims (JWT) and, in sequential
+endpoints, the data returned by the previous backends as the responses list, indexed by the position of
+the backend in the endpoint. The backends not executed yet, and every backend of the parallel endpoints,
+appear as empty objects.
+
+Skipped backends return an empty and complete response, so they do not break the sequence nor flag the
+merged response as incomplete. Expressions failing at runtime skip the backend as well. The url patterns
+of the skipped backends are only reported, in the X-Krakend-Skipped-Backends header, by the endpoints
+enabling the debug flag, since they disclose the internal routes:
+
+	...
+	"endpoint": "/account",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/conditional": {
+			"debug": true
+		}
+	},
+	...
+*/
+package conditional
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/devopsfaith/krakend-ce/internal/celexpr"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/conditional"
+
+// SkippedHeader is the header listing the backends skipped by their conditions, when the endpoint
+// enables the debug flag
+const SkippedHeader = "X-Krakend-Skipped-Backends"
+
+var (
+	// ErrNoConfig is returned when the backend has no conditional config
+	ErrNoConfig = errors.New("conditional: no config")
+	// ErrNoExpression is returned when the config has no run_if expression
+	ErrNoExpression = errors.New("conditional: no run_if expression defined")
+)
+
+// Config is the custom config struct of the conditional backends
+type Config struct {
+	RunIf string `json:"run_if"`
+}
+
+// ConfigGetter parses the conditional config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.RunIf == "" {
+		return cfg, ErrNoExpression
+	}
+	return cfg, nil
+}
+
+// Compile compiles the run_if expression
+func Compile(cfg Config) (cel.Program, error) {
+	return celexpr.Compile(cfg.RunIf, cel.Declarations(
+		decls.NewIdent("responses", decls.NewListType(decls.NewMapType(decls.String, decls.Dyn)), nil),
+	))
+}
+
+// Validate compiles every run_if expression of the service config, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil {
+				_, err = Compile(c)
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// BackendFactory returns a backend factory evaluating the conditions of the backends with a
+// conditional config. The rest of the backends are wrapped as well, so their responses are available
+// to the conditions of the next backends of the sequential endpoints.
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return recordingProxy(remote, next)
+		}
+		var p cel.Program
+		if err == nil {
+			p, err = Compile(cfg)
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return recordingProxy(remote, next)
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] conditional execution: %s", remote.URLPattern, cfg.RunIf))
+		return conditionalProxy(logger, remote, p, next)
+	}
+}
+
+func recordingProxy(remote *config.Backend, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if s, ok := ctx.Value(stateKey{}).(*state); ok {
+			s.record(remote, resp)
+		}
+		return resp, err
+	}
+}
+
+func conditionalProxy(logger logging.Logger, remote *config.Backend, p cel.Program, next proxy.Proxy) proxy.Proxy {
+	record := recordingProxy(remote, next)
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		s, _ := ctx.Value(stateKey{}).(*state)
+
+		vars := celexpr.RequestActivation(r)
+		vars["responses"] = s.responses()
+		run, err := celexpr.Eval(p, vars)
+		if err != nil {
+			logger.Debug(fmt.Sprintf("[BACKEND: %s] conditional: %s", remote.URLPattern, err.Error()))
+		}
+		if run {
+			return record(ctx, r)
+		}
+
+		s.skip(remote)
+		return &proxy.Response{
+			Data:       map[string]interface{}{},
+			IsComplete: true,
+			Metadata:   proxy.Metadata{Headers: map[string][]string{}},
+		}, nil
+	}
+}
+
+// ProxyFactory returns a proxy factory tracking the responses and the skipped backends of the
+// endpoints with conditional backends
+func ProxyFactory(logger logging.Logger, pf proxy.Factory) proxy.Factory {
+	return proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(remote)
+		if err != nil {
+			return next, err
+		}
+		conditional := false
+		for _, b := range remote.Backend {
+			if _, ok := b.ExtraConfig[Namespace]; ok {
+				conditional = true
+				break
+			}
+		}
+		if !conditional {
+			return next, nil
+		}
+		return NewProxy(remote, next), nil
+	})
+}
+
+// NewProxy returns a proxy injecting the state of the request into the context of the backends and,
+// with the debug flag of the endpoint, reporting the skipped ones
+func NewProxy(remote *config.EndpointConfig, next proxy.Proxy) proxy.Proxy {
+	index := make(map[*config.Backend]int, len(remote.Backend))
+	for i, b := range remote.Backend {
+		index[b] = i
+	}
+	sequential := isSequential(remote)
+	debug := isDebug(remote)
+
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		s := &state{index: index, data: make([]map[string]interface{}, len(remote.Backend)), sequential: sequential}
+		resp, err := next(context.WithValue(ctx, stateKey{}, s), r)
+		if !debug {
+			return resp, err
+		}
+
+		skipped := s.skippedBackends()
+		if resp == nil || len(skipped) == 0 {
+			return resp, err
+		}
+		headers := make(map[string][]string, len(resp.Metadata.Headers)+1)
+		for k, vs := range resp.Metadata.Headers {
+			headers[k] = vs
+		}
+		headers[SkippedHeader] = []string{strings.Join(skipped, ", ")}
+		resp.Metadata.Headers = headers
+		return resp, err
+	}
+}
+
+func isSequential(remote *config.EndpointConfig) bool {
+	e, ok := remote.ExtraConfig[proxy.Namespace].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	v, ok := e["sequential"].(bool)
+	return ok && v
+}
+
+func isDebug(remote *config.EndpointConfig) bool {
+	e, ok := remote.ExtraConfig[Namespace].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	v, ok := e["debug"].(bool)
+	return ok && v
+}
+
+type stateKey struct{}
+
+type state struct {
+	mu         sync.Mutex
+	index      map[*config.Backend]int
+	data       []map[string]interface{}
+	skipped    []string
+	sequential bool
+}
+
+func (s *state) record(remote *config.Backend, resp *proxy.Response) {
+	if !s.sequential || resp == nil {
+		return
+	}
+	s.mu.Lock()
+	if i, ok := s.index[remote]; ok {
+		s.data[i] = resp.Data
+	}
+	s.mu.Unlock()
+}
+
+func (s *state) skip(remote *config.Backend) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.skipped = append(s.skipped, remote.URLPattern)
+	s.mu.Unlock()
+}
+
+func (s *state) responses() []map[string]interface{} {
+	if s == nil {
+		return []map[string]interface{}{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]map[string]interface{}, len(s.data))
+	for i, d := range s.data {
+		if d == nil {
+			d = map[string]interface{}{}
+		}
+		res[i] = d
+	}
+	return res
+}
+
+func (s *state) skippedBackends() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skipped
+}
@@ -0,0 +1,91 @@
+package conditional
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestProxyFactory(t *testing.T) {
+	calls := map[string]int{}
+	bf := BackendFactory(logging.NoOp, func(remote *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			calls[remote.URLPattern]++
+			return &proxy.Response{Data: map[string]interface{}{remote.Group: map[string]interface{}{"type": "premium"}}, IsComplete: true}, nil
+		}
+	})
+
+	withCondition := func(pattern, group, expr string) *config.Backend {
+		b := &config.Backend{URLPattern: pattern, Group: group, Host: []string{"http://backend.local"}}
+		if expr != "" {
+			b.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{"run_if": expr}}
+		}
+		return b
+	}
+
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/",
+		Timeout:  time.Second,
+		Backend: []*config.Backend{
+			withCondition("/account", "account", ""),
+			withCondition("/premium", "premium", "responses[0].account.type == 'premium'"),
+			withCondition("/basic", "basic", "responses[0].account.type == 'basic'"),
+			withCondition("/admin", "admin", "'admin' in JWT.roles && req_params.Id == '42'"),
+			withCondition("/broken", "broken", "responses[0].unknown.field == 1"),
+		},
+		ExtraConfig: config.ExtraConfig{proxy.Namespace: map[string]interface{}{"sequential": true}},
+	}
+	if err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{endpoint}}); err != nil {
+		t.Fatal(err)
+	}
+
+	gatewayClaims := base64.RawURLEncoding.EncodeToString([]byte(`{"roles":["admin"]}`))
+	for _, debug := range []bool{false, true} {
+		endpoint.ExtraConfig[Namespace] = map[string]interface{}{"debug": debug}
+		p, err := ProxyFactory(logging.NoOp, proxy.NewDefaultFactory(bf, logging.NoOp)).New(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		calls = map[string]int{}
+		resp, err := p(context.Background(), &proxy.Request{
+			Params:  map[string]string{"Id": "42"},
+			Headers: map[string][]string{"X-Gateway-Claims": {gatewayClaims}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.IsComplete {
+			t.Error("the response should be complete")
+		}
+		var expectedHeader []string
+		if debug {
+			expectedHeader = []string{"/basic, /broken"}
+		}
+		if h := resp.Metadata.Headers[SkippedHeader]; !reflect.DeepEqual(h, expectedHeader) {
+			t.Errorf("debug %v: unexpected skipped header: %v", debug, h)
+		}
+		expected := map[string]int{"/account": 1, "/premium": 1, "/admin": 1}
+		if !reflect.DeepEqual(calls, expected) {
+			t.Errorf("debug %v: unexpected calls: %v", debug, calls)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, expr := range []string{"responses[0].", "req_method", "unknown_var == 1"} {
+		cfg := config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/",
+			Backend:  []*config.Backend{{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"run_if": expr}}}},
+		}}}
+		if err := Validate(cfg); err == nil {
+			t.Errorf("expecting error for %s", expr)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Package etag adds strong ETags to the responses rendered by the gateway and answers the conditional
+GET requests with 304 Not Modified.
+
+Sample endpoint config:
+
+	...
+	"endpoint": "/feed",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/etag": {
+			"forward_conditional": false
+		}
+	},
+	...
+
+The handler buffers the output of the render (json, xml, rss, no-op or any other registered one) and
+computes the ETag over the final body of the 200 responses to the GET and HEAD requests. The rest of
+the responses, the ones with Cache-Control: no-store and the flushed (streamed) ones are written
+straight through, without being buffered. If-None-Match takes precedence over
+If-Modified-Since, which is only evaluated when the response carries a Last-Modified header (i.e. it
+was returned by a no-op backend or added by the proxy layer).
+
+With forward_conditional, the endpoints with a single no-op backend also forward If-None-Match and
+If-Modified-Since to the backend, so it can answer with its own 304. The ETag returned by such a
+backend is kept instead of computing a new one.
+*/
+package etag
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/encoding"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/luraproject/lura/router"
+	krakendgin "github.com/luraproject/lura/router/gin"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/etag"
+
+// ErrNoConfig is returned when the endpoint has no etag config
+var ErrNoConfig = errors.New("etag: no config")
+
+// Config is the custom config struct of the etag handler
+type Config struct {
+	ForwardConditional bool `json:"forward_conditional"`
+}
+
+// ConfigGetter parses the etag config of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(b, &cfg)
+	return cfg, err
+}
+
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// HandlerFactory returns a handler factory adding ETags and conditional GET support to the GET
+// endpoints with an etag config
+func HandlerFactory(next krakendgin.HandlerFactory, logger logging.Logger) krakendgin.HandlerFactory {
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		etagCfg, err := ConfigGetter(cfg.ExtraConfig)
+		if err != nil || cfg.Method != http.MethodGet {
+			if err != nil && err != ErrNoConfig {
+				logger.Error(fmt.Sprintf("[ENDPOINT: %s] etag: %s", cfg.Endpoint, err.Error()))
+			}
+			return next(cfg, p)
+		}
+		if etagCfg.ForwardConditional && isNoop(cfg) {
+			cfg = withConditionalHeaders(cfg)
+			logger.Debug(fmt.Sprintf("[ENDPOINT: %s] forwarding the conditional headers", cfg.Endpoint))
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] etag enabled", cfg.Endpoint))
+		return NewHandler(next(cfg, p))
+	}
+}
+
+func isNoop(cfg *config.EndpointConfig) bool {
+	return len(cfg.Backend) == 1 && (cfg.OutputEncoding == encoding.NOOP || cfg.Backend[0].Encoding == encoding.NOOP)
+}
+
+// withConditionalHeaders returns a copy of the endpoint config adding the conditional headers to the
+// list of headers to pass
+func withConditionalHeaders(cfg *config.EndpointConfig) *config.EndpointConfig {
+	c := *cfg
+	headers := cfg.HeadersToPass
+	if len(headers) == 0 {
+		headers = router.HeadersToSend
+	}
+	c.HeadersToPass = append([]string{}, headers...)
+	for _, h := range conditionalHeaders {
+		found := false
+		for _, v := range c.HeadersToPass {
+			found = found || v == "*" || strings.EqualFold(v, h)
+		}
+		if !found {
+			c.HeadersToPass = append(c.HeadersToPass, h)
+		}
+	}
+	return &c
+}
+
+// NewHandler returns a gin handler buffering the cacheable responses to add their ETag and answer the
+// conditional requests
+func NewHandler(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			next(c)
+			return
+		}
+		w := &bufferedWriter{ResponseWriter: c.Writer, status: http.StatusOK}
+		c.Writer = w
+		next(c)
+		c.Writer = w.ResponseWriter
+		if !w.streaming {
+			w.flush(c.Request)
+		}
+	}
+}
+
+// bufferedWriter buffers the 200 responses until the handler is done. The rest of the responses stop
+// the buffering as soon as their status or headers are known.
+type bufferedWriter struct {
+	gin.ResponseWriter
+	status    int
+	written   bool
+	streaming bool
+	buf       bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.streaming {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code > 0 && !w.written {
+		w.status = code
+		if code != http.StatusOK {
+			w.bypass()
+		}
+	}
+}
+
+func (w *bufferedWriter) WriteHeaderNow() {
+	if w.streaming {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.start()
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	if !w.streaming {
+		w.start()
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+func (w *bufferedWriter) WriteString(s string) (int, error) {
+	if !w.streaming {
+		w.start()
+	}
+	if w.streaming {
+		return w.ResponseWriter.WriteString(s)
+	}
+	return w.buf.WriteString(s)
+}
+
+func (w *bufferedWriter) Status() int {
+	if w.streaming {
+		return w.ResponseWriter.Status()
+	}
+	return w.status
+}
+
+func (w *bufferedWriter) Size() int {
+	if w.streaming {
+		return w.ResponseWriter.Size()
+	}
+	if !w.written {
+		return -1
+	}
+	return w.buf.Len()
+}
+
+func (w *bufferedWriter) Written() bool {
+	if w.streaming {
+		return w.ResponseWriter.Written()
+	}
+	return w.written
+}
+
+// Flush stops the buffering, so the streamed responses get no ETag
+func (w *bufferedWriter) Flush() {
+	if !w.streaming {
+		w.bypass()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// start flags the response as written, stopping the buffering when its headers forbid storing it
+func (w *bufferedWriter) start() {
+	if w.written {
+		return
+	}
+	w.written = true
+	if strings.Contains(strings.ToLower(w.ResponseWriter.Header().Get("Cache-Control")), "no-store") {
+		w.bypass()
+	}
+}
+
+// bypass stops the buffering, writing the status and the data buffered so far
+func (w *bufferedWriter) bypass() {
+	w.streaming = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+// flush writes the buffered response, or a 304 if the client already has it
+func (w *bufferedWriter) flush(r *http.Request) {
+	h := w.ResponseWriter.Header()
+	tag := h.Get("ETag")
+	if tag == "" {
+		tag = New(w.buf.Bytes())
+		h.Set("ETag", tag)
+	}
+
+	if NotModified(r, tag, h.Get("Last-Modified")) {
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(http.StatusNotModified)
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	w.ResponseWriter.Write(w.buf.Bytes())
+}
+
+// New returns the strong ETag of the body
+func New(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// NotModified checks the conditional headers of the request against the ETag and the last
+// modification date of the response
+func NotModified(r *http.Request, tag, lastModified string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(tag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
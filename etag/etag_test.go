@@ -0,0 +1,117 @@
+package etag
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	krakendgin "github.com/luraproject/lura/router/gin"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	p := func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"foo": 42}}, nil
+	}
+	cfg := &config.EndpointConfig{
+		Endpoint:    "/feed",
+		Method:      http.MethodGet,
+		Timeout:     time.Second,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{}},
+	}
+	engine := gin.New()
+	engine.GET("/feed", HandlerFactory(krakendgin.EndpointHandler, logging.NoOp)(cfg, p))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/feed", nil))
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != `{"foo":42}` || tag != New([]byte(`{"foo":42}`)) {
+		t.Fatalf("unexpected response: %d %s %s", w.Code, w.Body.String(), tag)
+	}
+
+	for _, tc := range []struct {
+		inm    string
+		status int
+	}{
+		{inm: tag, status: http.StatusNotModified},
+		{inm: `"other", W/` + tag, status: http.StatusNotModified},
+		{inm: `"other"`, status: http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/feed", nil)
+		req.Header.Set("If-None-Match", tc.inm)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: unexpected status %d", tc.inm, w.Code)
+		}
+		if tc.status == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: unexpected body %s", tc.inm, w.Body.String())
+		}
+	}
+}
+
+func TestNewHandler_passThrough(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, tc := range []struct {
+		name   string
+		method string
+		status int
+		header string
+	}{
+		{name: "error", method: http.MethodGet, status: http.StatusBadGateway},
+		{name: "no-store", method: http.MethodGet, status: http.StatusOK, header: "no-store, max-age=0"},
+		{name: "post", method: http.MethodPost, status: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		engine := gin.New()
+		engine.Handle(tc.method, "/", NewHandler(func(c *gin.Context) {
+			if tc.header != "" {
+				c.Header("Cache-Control", tc.header)
+			}
+			c.String(tc.status, "body")
+			if w.Body.String() != "body" {
+				t.Errorf("%s: the response was buffered", tc.name)
+			}
+		}))
+		engine.ServeHTTP(w, httptest.NewRequest(tc.method, "/", nil))
+		if w.Code != tc.status || w.Header().Get("ETag") != "" {
+			t.Errorf("%s: unexpected response: %d %v", tc.name, w.Code, w.Header())
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	for _, tc := range []struct {
+		ims      string
+		expected bool
+	}{
+		{ims: lastModified, expected: true},
+		{ims: "Tue, 03 Jan 2006 15:04:05 GMT", expected: true},
+		{ims: "Sun, 01 Jan 2006 15:04:05 GMT"},
+		{ims: "garbage"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("If-Modified-Since", tc.ims)
+		if NotModified(req, `"a"`, lastModified) != tc.expected {
+			t.Errorf("%s: unexpected result", tc.ims)
+		}
+	}
+}
+
+func TestWithConditionalHeaders(t *testing.T) {
+	cfg := &config.EndpointConfig{Backend: []*config.Backend{{Encoding: "no-op"}}}
+	if !isNoop(cfg) {
+		t.Fatal("expecting a no-op endpoint")
+	}
+	c := withConditionalHeaders(cfg)
+	if len(c.HeadersToPass) != 3 || len(cfg.HeadersToPass) != 0 {
+		t.Errorf("unexpected headers: %v", c.HeadersToPass)
+	}
+}
@@ -9,6 +9,12 @@ import (
 	"time"
 
 	krakendbf "github.com/devopsfaith/bloomfilter/krakend"
+	"github.com/devopsfaith/krakend-ce/internal/httpserver"
+	"github.com/devopsfaith/krakend-ce/ipfilter"
+	"github.com/devopsfaith/krakend-ce/limits"
+	"github.com/devopsfaith/krakend-ce/mtls"
+	"github.com/devopsfaith/krakend-ce/policy"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
 	cel "github.com/devopsfaith/krakend-cel"
 	cmd "github.com/devopsfaith/krakend-cobra"
 	cors "github.com/devopsfaith/krakend-cors/gin"
@@ -35,7 +41,6 @@ import (
 	"github.com/luraproject/lura/core"
 	"github.com/luraproject/lura/logging"
 	"github.com/luraproject/lura/proxy"
-	krakendrouter "github.com/luraproject/lura/router"
 	router "github.com/luraproject/lura/router/gin"
 	server "github.com/luraproject/lura/transport/http/server/plugin"
 )
@@ -143,6 +148,10 @@ func (e *ExecutorBuilder) NewCmdExecutor(ctx context.Context) cmd.Executor {
 
 		metricCollector := e.MetricsAndTracesRegister.Register(ctx, cfg, logger)
 
+		ratelimit.Register(ctx, cfg, logger)
+		policy.Register(ctx, cfg, logger)
+		ipfilter.Register(ctx, cfg, logger)
+
 		tokenRejecterFactory, err := e.TokenRejecterFactory.NewTokenRejecter(
 			ctx,
 			cfg,
@@ -153,10 +162,13 @@ func (e *ExecutorBuilder) NewCmdExecutor(ctx context.Context) cmd.Executor {
 			logger.Warning("bloomFilter:", err.Error())
 		}
 
-		// Inject service configuration into handler factory if it supports it
+		// Inject service configuration into the handler and proxy factories if they support it
 		if hf, ok := e.HandlerFactory.(*handlerFactory); ok {
 			hf.serviceConfig = cfg
 		}
+		if pf, ok := e.ProxyFactory.(*proxyFactory); ok {
+			pf.serviceConfig = cfg
+		}
 
 		// setup the krakend router
 		routerFactory := router.NewFactory(router.Config{
@@ -169,7 +181,7 @@ func (e *ExecutorBuilder) NewCmdExecutor(ctx context.Context) cmd.Executor {
 			Middlewares:    e.Middlewares,
 			Logger:         logger,
 			HandlerFactory: e.HandlerFactory.NewHandlerFactory(logger, metricCollector, tokenRejecterFactory),
-			RunServer:      router.RunServerFunc(e.RunServerFactory.NewRunServer(logger, krakendrouter.RunServer)),
+			RunServer:      router.RunServerFunc(e.RunServerFactory.NewRunServer(logger, httpserver.RunServer)),
 		})
 
 		// start the engines
@@ -211,13 +223,13 @@ func (e *ExecutorBuilder) checkCollaborators() {
 }
 
 // DefaultRunServerFactory creates the default RunServer by wrapping the injected RunServer
-// with the plugin loader and the CORS module
+// with the plugin loader, the CORS module, the request limits and the client certificate authentication
 type DefaultRunServerFactory struct{}
 
 func (d *DefaultRunServerFactory) NewRunServer(l logging.Logger, next router.RunServerFunc) RunServer {
 	return RunServer(server.New(
 		l,
-		server.RunServer(cors.NewRunServer(cors.NewRunServerWithLogger(cors.RunServer(next), l))),
+		server.RunServer(cors.NewRunServer(cors.NewRunServerWithLogger(cors.RunServer(limits.NewRunServer(l, mtls.NewRunServer(l, next))), l))),
 	))
 }
 
@@ -0,0 +1,356 @@
+/*
+Package fanout expands the collections returned by the backends of an endpoint, calling another backend
+for every element (or for chunks of elements) and embedding the results into them.
+
+The backends with a fanout config are excluded from the regular merge. Once the rest of the backends
+have answered, the collection is extracted from the merged data and the fanout backend is called with
+the url_pattern of its fanout config, where the {item} placeholder is replaced by the escaped id of the
+element (or by the comma-separated escaped ids of the chunk, in batch mode). The rest of the placeholders refer to the
+params of the endpoint, as usual. Sample backend config:
+
+	...
+	"url_pattern": "/users",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/fanout": {
+			"collection": "orders",
+			"id": "customer_id",
+			"target": "customer",
+			"url_pattern": "/users/{item}",
+			"concurrency": 5,
+			"max_items": 100
+		}
+	},
+	...
+
+With a batch_size greater than zero, the ids are grouped in chunks and every response is matched back to
+the elements using the match field of the returned objects (they can be returned as a collection or as
+an object keyed by id):
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/fanout": {
+			"collection": "orders",
+			"id": "customer_id",
+			"target": "customer",
+			"url_pattern": "/users?ids={item}",
+			"batch_size": 20,
+			"match": "id"
+		}
+	},
+	...
+
+The collection is a dot-separated path in the merged data. The id is a field of the elements; when it is
+empty, the elements themselves are used as ids. The results are embedded under the target key of the
+object elements, while scalar elements are replaced by them. Failed calls leave their elements untouched
+and flag the response as incomplete.
+*/
+package fanout
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/fanout"
+
+// ItemParam is the name of the request param containing the escaped ids of the element or chunk
+const ItemParam = "Item"
+
+const defaultConcurrency = 10
+
+var (
+	// ErrNoConfig is returned when the backend has no fanout config
+	ErrNoConfig = errors.New("fanout: no config")
+	// ErrNoRegularBackends is returned when every backend of the endpoint has a fanout config
+	ErrNoRegularBackends = errors.New("fanout: the endpoint has no backend returning the collection")
+)
+
+// Config is the custom config struct of the fanout backends
+type Config struct {
+	Collection  string `json:"collection"`
+	ID          string `json:"id"`
+	Target      string `json:"target"`
+	URLPattern  string `json:"url_pattern"`
+	Concurrency int    `json:"concurrency"`
+	BatchSize   int    `json:"batch_size"`
+	Match       string `json:"match"`
+	MaxItems    int    `json:"max_items"`
+}
+
+// ConfigGetter parses the fanout config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Collection == "" {
+		return cfg, errors.New("fanout: no collection defined")
+	}
+	if !strings.Contains(cfg.URLPattern, "{item}") {
+		return cfg, errors.New("fanout: the url_pattern must contain the {item} placeholder")
+	}
+	if cfg.Target == "" {
+		cfg.Target = "fanout"
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultConcurrency
+	}
+	if cfg.BatchSize > 0 && cfg.Match == "" {
+		cfg.Match = "id"
+	}
+	return cfg, nil
+}
+
+var placeholder = regexp.MustCompile(`\{([\w\-\.]+)\}`)
+
+// urlPattern translates the placeholders to the lura format, as the config parser does
+func urlPattern(pattern string) string {
+	return placeholder.ReplaceAllStringFunc(pattern, func(m string) string {
+		name := m[1 : len(m)-1]
+		if name == "item" {
+			return "{{." + ItemParam + "}}"
+		}
+		return "{{." + strings.Title(name[:1]) + name[1:] + "}}"
+	})
+}
+
+// ProxyFactory returns a proxy factory expanding the collections of the endpoints with fanout
+// backends
+func ProxyFactory(logger logging.Logger, pf proxy.Factory) proxy.Factory {
+	return proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		regular := []*config.Backend{}
+		expansions := []expansion{}
+		for _, b := range remote.Backend {
+			cfg, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				regular = append(regular, b)
+				continue
+			}
+			if err != nil {
+				logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+				return proxy.NoopProxy, err
+			}
+
+			backend := *b
+			backend.URLPattern = urlPattern(cfg.URLPattern)
+			sub := *remote
+			sub.Backend = []*config.Backend{&backend}
+			p, err := pf.New(&sub)
+			if err != nil {
+				return proxy.NoopProxy, err
+			}
+			expansions = append(expansions, expansion{cfg: cfg, proxy: p})
+		}
+
+		if len(expansions) == 0 {
+			return pf.New(remote)
+		}
+		if len(regular) == 0 {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, ErrNoRegularBackends.Error()))
+			return proxy.NoopProxy, ErrNoRegularBackends
+		}
+
+		main := *remote
+		main.Backend = regular
+		next, err := pf.New(&main)
+		if err != nil {
+			return next, err
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] fanout over %d backends", remote.Endpoint, len(expansions)))
+		return newProxy(next, expansions...), nil
+	})
+}
+
+type expansion struct {
+	cfg   Config
+	proxy proxy.Proxy
+}
+
+// newProxy returns a proxy applying the expansions, in order, to the responses of the next proxy
+func newProxy(next proxy.Proxy, expansions ...expansion) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if resp == nil || resp.Data == nil {
+			return resp, err
+		}
+		for _, e := range expansions {
+			if !e.expand(ctx, r, resp.Data) {
+				resp.IsComplete = false
+			}
+		}
+		return resp, err
+	}
+}
+
+// expand embeds the results into the elements of the collection, returning false if any call failed
+func (e expansion) expand(ctx context.Context, r *proxy.Request, data map[string]interface{}) bool {
+	items, ok := lookup(data, e.cfg.Collection).([]interface{})
+	if !ok || len(items) == 0 {
+		return true
+	}
+	if e.cfg.MaxItems > 0 && len(items) > e.cfg.MaxItems {
+		items = items[:e.cfg.MaxItems]
+	}
+
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = e.id(item)
+	}
+
+	var mu sync.Mutex
+	complete := true
+	results := map[string]interface{}{}
+
+	sem := make(chan struct{}, e.cfg.Concurrency)
+	var wg sync.WaitGroup
+	for _, chunk := range e.chunks(ids) {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk []string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			req := r.Clone()
+			req.Body = nil
+			req.Headers = proxy.CloneRequestHeaders(r.Headers)
+			req.Params = proxy.CloneRequestParams(r.Params)
+			escaped := make([]string, len(chunk))
+			for i, id := range chunk {
+				escaped[i] = url.PathEscape(id)
+			}
+			req.Params[ItemParam] = strings.Join(escaped, ",")
+
+			resp, err := e.proxy(ctx, &req)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || resp == nil {
+				complete = false
+				return
+			}
+			if e.cfg.BatchSize <= 0 {
+				results[chunk[0]] = resp.Data
+				return
+			}
+			for id, v := range e.match(resp.Data) {
+				results[id] = v
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	for i, item := range items {
+		v, ok := results[ids[i]]
+		if !ok {
+			continue
+		}
+		if m, ok := item.(map[string]interface{}); ok {
+			m[e.cfg.Target] = v
+			continue
+		}
+		items[i] = v
+	}
+	return complete
+}
+
+func (e expansion) id(item interface{}) string {
+	if e.cfg.ID != "" {
+		if m, ok := item.(map[string]interface{}); ok {
+			item = lookup(m, e.cfg.ID)
+		}
+	}
+	return stringify(item)
+}
+
+// chunks splits the unique ids into the calls to issue
+func (e expansion) chunks(ids []string) [][]string {
+	seen := map[string]struct{}{}
+	unique := []string{}
+	for _, id := range ids {
+		if _, ok := seen[id]; ok || id == "" {
+			continue
+		}
+		seen[id] = struct{}{}
+		unique = append(unique, id)
+	}
+
+	size := e.cfg.BatchSize
+	if size <= 0 {
+		size = 1
+	}
+	res := [][]string{}
+	for len(unique) > 0 {
+		n := size
+		if n > len(unique) {
+			n = len(unique)
+		}
+		res = append(res, unique[:n])
+		unique = unique[n:]
+	}
+	return res
+}
+
+// match indexes the results of a batch by the match field. Responses without collection are
+// considered objects keyed by id.
+func (e expansion) match(data map[string]interface{}) map[string]interface{} {
+	collection, ok := data["collection"].([]interface{})
+	if !ok {
+		return data
+	}
+	res := make(map[string]interface{}, len(collection))
+	for _, v := range collection {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		res[stringify(lookup(m, e.cfg.Match))] = m
+	}
+	return res
+}
+
+func lookup(data map[string]interface{}, path string) interface{} {
+	var current interface{} = data
+	for _, k := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[k]
+	}
+	return current
+}
+
+func stringify(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
@@ -0,0 +1,172 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestProxyFactory(t *testing.T) {
+	var mu sync.Mutex
+	paths := []string{}
+	bf := func(remote *config.Backend) proxy.Proxy {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			mu.Lock()
+			paths = append(paths, r.Path)
+			mu.Unlock()
+			switch {
+			case remote.URLPattern == "/orders":
+				return &proxy.Response{IsComplete: true, Data: map[string]interface{}{
+					"orders": []interface{}{
+						map[string]interface{}{"id": "a", "customer_id": 1.0},
+						map[string]interface{}{"id": "b", "customer_id": 2.0},
+						map[string]interface{}{"id": "c", "customer_id": 1.0},
+						map[string]interface{}{"id": "d", "customer_id": 3.0},
+					},
+				}}, nil
+			case strings.HasPrefix(r.Path, "/users/3"):
+				return nil, errors.New("not found")
+			case strings.HasPrefix(r.Path, "/users/"):
+				return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"name": "user " + r.Path[7:]}}, nil
+			default:
+				return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"collection": []interface{}{
+					map[string]interface{}{"id": 1.0, "name": "one"},
+					map[string]interface{}{"id": 2.0, "name": "two"},
+				}}}, nil
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cfg      map[string]interface{}
+		paths    []string
+		complete bool
+		expected []interface{}
+	}{
+		{
+			name: "single",
+			cfg: map[string]interface{}{
+				"collection":  "orders",
+				"id":          "customer_id",
+				"target":      "customer",
+				"url_pattern": "/users/{item}/{region}",
+				"concurrency": 2,
+			},
+			paths: []string{"/orders", "/users/1/eu", "/users/2/eu", "/users/3/eu"},
+			expected: []interface{}{
+				map[string]interface{}{"id": "a", "customer_id": 1.0, "customer": map[string]interface{}{"name": "user 1/eu"}},
+				map[string]interface{}{"id": "b", "customer_id": 2.0, "customer": map[string]interface{}{"name": "user 2/eu"}},
+				map[string]interface{}{"id": "c", "customer_id": 1.0, "customer": map[string]interface{}{"name": "user 1/eu"}},
+				map[string]interface{}{"id": "d", "customer_id": 3.0},
+			},
+		},
+		{
+			name: "batch",
+			cfg: map[string]interface{}{
+				"collection":  "orders",
+				"id":          "customer_id",
+				"target":      "customer",
+				"url_pattern": "/batch?ids={item}",
+				"batch_size":  2,
+			},
+			paths:    []string{"/orders", "/batch?ids=1,2", "/batch?ids=3"},
+			complete: true,
+			expected: []interface{}{
+				map[string]interface{}{"id": "a", "customer_id": 1.0, "customer": map[string]interface{}{"id": 1.0, "name": "one"}},
+				map[string]interface{}{"id": "b", "customer_id": 2.0, "customer": map[string]interface{}{"id": 2.0, "name": "two"}},
+				map[string]interface{}{"id": "c", "customer_id": 1.0, "customer": map[string]interface{}{"id": 1.0, "name": "one"}},
+				map[string]interface{}{"id": "d", "customer_id": 3.0},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			paths = []string{}
+			endpoint := &config.EndpointConfig{
+				Endpoint: "/orders/{region}",
+				Timeout:  time.Second,
+				Backend: []*config.Backend{
+					{URLPattern: "/orders", Host: []string{"http://orders"}},
+					{URLPattern: "/users", Host: []string{"http://users"}, ExtraConfig: config.ExtraConfig{Namespace: tc.cfg}},
+				},
+			}
+			p, err := ProxyFactory(logging.NoOp, proxy.NewDefaultFactory(bf, logging.NoOp)).New(endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := p(context.Background(), &proxy.Request{Params: map[string]string{"Region": "eu"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.IsComplete != tc.complete {
+				t.Errorf("unexpected completion flag: %v", resp.IsComplete)
+			}
+			if !reflect.DeepEqual(resp.Data["orders"], tc.expected) {
+				t.Errorf("unexpected data: %v", resp.Data["orders"])
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(paths) != len(tc.paths) {
+				t.Errorf("unexpected calls: %v", paths)
+			}
+			for _, p := range tc.paths {
+				found := false
+				for _, called := range paths {
+					found = found || called == p
+				}
+				if !found {
+					t.Errorf("%s not called: %v", p, paths)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyFactory_escapedIds(t *testing.T) {
+	var mu sync.Mutex
+	paths := []string{}
+	bf := func(remote *config.Backend) proxy.Proxy {
+		return func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+			if remote.URLPattern == "/orders" {
+				return &proxy.Response{IsComplete: true, Data: map[string]interface{}{
+					"orders": []interface{}{"../admin?x=1", "a,b"},
+				}}, nil
+			}
+			mu.Lock()
+			paths = append(paths, r.Path)
+			mu.Unlock()
+			return &proxy.Response{IsComplete: true, Data: map[string]interface{}{}}, nil
+		}
+	}
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/orders",
+		Timeout:  time.Second,
+		Backend: []*config.Backend{
+			{URLPattern: "/orders", Host: []string{"http://orders"}},
+			{URLPattern: "/users", Host: []string{"http://users"}, ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+				"collection":  "orders",
+				"target":      "user",
+				"url_pattern": "/users?ids={item}",
+				"batch_size":  2,
+			}}},
+		},
+	}
+	p, err := ProxyFactory(logging.NoOp, proxy.NewDefaultFactory(bf, logging.NoOp)).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p(context.Background(), &proxy.Request{}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"/users?ids=..%2Fadmin%3Fx=1,a%2Cb"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("unexpected calls: %v", paths)
+	}
+}
@@ -0,0 +1,427 @@
+/*
+Package faultinjection provides backend and handler middlewares injecting failures on purpose, so the
+circuit breakers, retries and timeouts can be exercised in non production environments.
+
+The middlewares are disabled unless the "enabled" flag is set. Sample extra config:
+
+	...
+	"extra_config": {
+		...
+		"github.com/devopsfaith/krakend-ce/faultinjection": {
+			"enabled": true,
+			"delay": {
+				"percentage": 20,
+				"distribution": "uniform",
+				"min": "100ms",
+				"max": "800ms"
+			},
+			"abort": {
+				"percentage": 5,
+				"status": 503
+			},
+			"drop": { "percentage": 1 },
+			"corrupt": { "percentage": 1 },
+			"match": {
+				"headers": { "X-Fault-Injection": "on", "X-User-Role": "qa" }
+			}
+		},
+		...
+	},
+	...
+
+Every fault is evaluated independently for each request matching the "match" section (an empty match
+section matches every request). The JWT claims can be matched through the headers krakend-jose sets
+with its propagate_claims option once the token has been validated. The supported delay distributions
+are "fixed" (default, using the "fixed" value), "uniform" (between "min" and "max") and "normal" (using
+"mean" and "stddev").
+
+The corrupt fault flips random bytes of the raw (no-op) backend responses and of the responses rendered
+by the handlers, while it drops or mangles random fields of the decoded backend responses.
+*/
+package faultinjection
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/config"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/faultinjection"
+
+var (
+	// ErrNoConfig is returned when there is no fault injection config
+	ErrNoConfig = errors.New("faultinjection: no config")
+	// ErrDisabled is returned when the fault injection config is not explicitly enabled
+	ErrDisabled = errors.New("faultinjection: disabled")
+	// ErrConnectionDropped is the error returned by the backends when a drop fault is injected
+	ErrConnectionDropped = errors.New("faultinjection: connection dropped")
+	// ErrInvalidPercentage is returned when a fault percentage is not between 0 and 100
+	ErrInvalidPercentage = errors.New("faultinjection: the percentages must be between 0 and 100")
+	// ErrNegativeDelay is returned when a delay duration is negative
+	ErrNegativeDelay = errors.New("faultinjection: the delays can not be negative")
+)
+
+// Config is the custom config struct containing the fault definitions
+type Config struct {
+	Enabled bool         `json:"enabled"`
+	Delay   *DelayConfig `json:"delay"`
+	Abort   *AbortConfig `json:"abort"`
+	Drop    *FaultConfig `json:"drop"`
+	Corrupt *FaultConfig `json:"corrupt"`
+	Match   MatchConfig  `json:"match"`
+}
+
+// FaultConfig contains the percentage of the requests affected by a fault
+type FaultConfig struct {
+	Percentage float64 `json:"percentage"`
+}
+
+// DelayConfig defines the delay to add to the affected requests
+type DelayConfig struct {
+	FaultConfig
+	Distribution string `json:"distribution"`
+	Fixed        string `json:"fixed"`
+	Min          string `json:"min"`
+	Max          string `json:"max"`
+	Mean         string `json:"mean"`
+	StdDev       string `json:"stddev"`
+}
+
+// AbortConfig defines the status code to return for the affected requests
+type AbortConfig struct {
+	FaultConfig
+	Status int `json:"status"`
+}
+
+// MatchConfig restricts the requests eligible for the fault injection. Header values set to "*" just
+// require the presence of the header.
+type MatchConfig struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// ConfigGetter parses the extra config of the fault injection middlewares
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if !cfg.Enabled {
+		return cfg, ErrDisabled
+	}
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	faults := []*FaultConfig{c.Drop, c.Corrupt}
+	if c.Delay != nil {
+		faults = append(faults, &c.Delay.FaultConfig)
+	}
+	if c.Abort != nil {
+		faults = append(faults, &c.Abort.FaultConfig)
+	}
+	for _, f := range faults {
+		if f != nil && (f.Percentage < 0 || f.Percentage > 100) {
+			return ErrInvalidPercentage
+		}
+	}
+	if c.Delay == nil {
+		return nil
+	}
+	for _, v := range []string{c.Delay.Fixed, c.Delay.Min, c.Delay.Max, c.Delay.Mean, c.Delay.StdDev} {
+		if d, err := time.ParseDuration(v); err == nil && d < 0 {
+			return ErrNegativeDelay
+		}
+	}
+	return nil
+}
+
+// Validate checks every fault injection config of the service config, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		if err := validate(e.ExtraConfig); err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+		for _, b := range e.Backend {
+			if err := validate(b.ExtraConfig); err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func validate(e config.ExtraConfig) error {
+	_, err := New(e)
+	if err == ErrNoConfig || err == ErrDisabled {
+		return nil
+	}
+	return err
+}
+
+// Faults contains the faults to inject into a single request
+type Faults struct {
+	Delay   time.Duration
+	Abort   int
+	Drop    bool
+	Corrupt bool
+}
+
+// Empty returns true if there is no fault to inject
+func (f Faults) Empty() bool {
+	return f == Faults{}
+}
+
+// Injector decides which faults should be injected into every request
+type Injector struct {
+	cfg   Config
+	delay func() time.Duration
+	rand  *source
+}
+
+// New returns an Injector for the received extra config
+func New(e config.ExtraConfig) (*Injector, error) {
+	cfg, err := ConfigGetter(e)
+	if err != nil {
+		return nil, err
+	}
+	return NewInjector(cfg, time.Now().UnixNano())
+}
+
+// NewInjector returns an Injector for the received config, using the seed for the random source
+func NewInjector(cfg Config, seed int64) (*Injector, error) {
+	i := &Injector{
+		cfg:  cfg,
+		rand: &source{r: rand.New(rand.NewSource(seed))},
+	}
+	if cfg.Delay != nil {
+		delay, err := newDelay(*cfg.Delay, i.rand)
+		if err != nil {
+			return nil, err
+		}
+		i.delay = delay
+	}
+	if cfg.Abort != nil && (cfg.Abort.Status < 100 || cfg.Abort.Status > 599) {
+		return nil, fmt.Errorf("faultinjection: invalid abort status %d", cfg.Abort.Status)
+	}
+	return i, nil
+}
+
+// Decide returns the faults to inject into a request with the received headers
+func (i *Injector) Decide(headers map[string][]string) Faults {
+	f := Faults{}
+	if !i.match(headers) {
+		return f
+	}
+	if i.delay != nil && i.rand.hit(i.cfg.Delay.Percentage) {
+		f.Delay = i.delay()
+	}
+	if i.cfg.Abort != nil && i.rand.hit(i.cfg.Abort.Percentage) {
+		f.Abort = i.cfg.Abort.Status
+	}
+	if i.cfg.Drop != nil && i.rand.hit(i.cfg.Drop.Percentage) {
+		f.Drop = true
+	}
+	if i.cfg.Corrupt != nil && i.rand.hit(i.cfg.Corrupt.Percentage) {
+		f.Corrupt = true
+	}
+	return f
+}
+
+func (i *Injector) match(headers map[string][]string) bool {
+	for name, expected := range i.cfg.Match.Headers {
+		value, ok := headerValue(headers, name)
+		if !ok || (expected != "*" && value != expected) {
+			return false
+		}
+	}
+	return true
+}
+
+func headerValue(headers map[string][]string, name string) (string, bool) {
+	if vs, ok := headers[http.CanonicalHeaderKey(name)]; ok && len(vs) > 0 {
+		return vs[0], true
+	}
+	for k, vs := range headers {
+		if strings.EqualFold(k, name) && len(vs) > 0 {
+			return vs[0], true
+		}
+	}
+	return "", false
+}
+
+func newDelay(cfg DelayConfig, rnd *source) (func() time.Duration, error) {
+	parse := func(name, v string) (time.Duration, error) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("faultinjection: invalid delay %s: %s", name, err.Error())
+		}
+		return d, nil
+	}
+
+	switch strings.ToLower(cfg.Distribution) {
+	case "", "fixed":
+		fixed, err := parse("fixed", cfg.Fixed)
+		if err != nil {
+			return nil, err
+		}
+		return func() time.Duration { return fixed }, nil
+	case "uniform":
+		min, err := parse("min", cfg.Min)
+		if err != nil {
+			return nil, err
+		}
+		max, err := parse("max", cfg.Max)
+		if err != nil {
+			return nil, err
+		}
+		if max < min {
+			return nil, errors.New("faultinjection: the max delay must be greater than the min delay")
+		}
+		return func() time.Duration {
+			return min + time.Duration(rnd.float64()*float64(max-min))
+		}, nil
+	case "normal":
+		mean, err := parse("mean", cfg.Mean)
+		if err != nil {
+			return nil, err
+		}
+		stddev, err := parse("stddev", cfg.StdDev)
+		if err != nil {
+			return nil, err
+		}
+		return func() time.Duration {
+			if d := time.Duration(rnd.normFloat64()*float64(stddev)) + mean; d > 0 {
+				return d
+			}
+			return 0
+		}, nil
+	}
+	return nil, fmt.Errorf("faultinjection: unknown delay distribution %q", cfg.Distribution)
+}
+
+// AbortError is the error returned when an abort fault is injected
+type AbortError struct {
+	Code int
+}
+
+// Error implements the error interface
+func (a AbortError) Error() string {
+	return fmt.Sprintf("faultinjection: aborted with status %d", a.Code)
+}
+
+// StatusCode returns the injected status code
+func (a AbortError) StatusCode() int {
+	return a.Code
+}
+
+type source struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (s *source) hit(percentage float64) bool {
+	return percentage > 0 && s.float64()*100 < percentage
+}
+
+func (s *source) float64() float64 {
+	s.mu.Lock()
+	v := s.r.Float64()
+	s.mu.Unlock()
+	return v
+}
+
+func (s *source) normFloat64() float64 {
+	s.mu.Lock()
+	v := s.r.NormFloat64()
+	s.mu.Unlock()
+	return v
+}
+
+func (s *source) intn(n int) int {
+	s.mu.Lock()
+	v := s.r.Intn(n)
+	s.mu.Unlock()
+	return v
+}
+
+// corruptData returns a copy of the data with some random fields dropped or mangled
+func (s *source) corruptData(data map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(data))
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		res[k] = v
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return res
+	}
+	sort.Strings(keys)
+	for n := len(keys)/10 + 1; n > 0; n-- {
+		k := keys[s.intn(len(keys))]
+		v, ok := res[k]
+		if !ok {
+			continue
+		}
+		if s.intn(2) == 0 {
+			delete(res, k)
+			continue
+		}
+		res[k] = s.mangle(v)
+	}
+	return res
+}
+
+// mangle returns a corrupted version of the value, keeping its type when possible
+func (s *source) mangle(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if t == "" {
+			return nil
+		}
+		b := []byte(t)
+		s.corrupt(b)
+		return string(b)
+	case float64:
+		return -t - 1
+	case bool:
+		return !t
+	case map[string]interface{}:
+		return s.corruptData(t)
+	case []interface{}:
+		if len(t) == 0 {
+			return nil
+		}
+		i := s.intn(len(t))
+		return append(append([]interface{}{}, t[:i]...), t[i+1:]...)
+	default:
+		return nil
+	}
+}
+
+// corrupt flips some random bytes of the received buffer
+func (s *source) corrupt(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	for n := len(b)/100 + 1; n > 0; n-- {
+		b[s.intn(len(b))] ^= 0xff
+	}
+}
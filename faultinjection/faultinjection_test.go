@@ -0,0 +1,199 @@
+package faultinjection
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestConfigGetter_disabled(t *testing.T) {
+	if _, err := ConfigGetter(config.ExtraConfig{}); err != ErrNoConfig {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ConfigGetter(config.ExtraConfig{
+		Namespace: map[string]interface{}{"abort": map[string]interface{}{"percentage": 100, "status": 500}},
+	}); err != ErrDisabled {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg map[string]interface{}
+		err error
+	}{
+		"valid": {
+			cfg: map[string]interface{}{"enabled": true, "abort": map[string]interface{}{"percentage": 100, "status": 503}},
+		},
+		"disabled": {
+			cfg: map[string]interface{}{"abort": map[string]interface{}{"percentage": 200, "status": 503}},
+		},
+		"percentage over 100": {
+			cfg: map[string]interface{}{"enabled": true, "drop": map[string]interface{}{"percentage": 101}},
+			err: ErrInvalidPercentage,
+		},
+		"negative percentage": {
+			cfg: map[string]interface{}{"enabled": true, "abort": map[string]interface{}{"percentage": -1, "status": 503}},
+			err: ErrInvalidPercentage,
+		},
+		"negative delay": {
+			cfg: map[string]interface{}{"enabled": true, "delay": map[string]interface{}{"percentage": 10, "fixed": "-1s"}},
+			err: ErrNegativeDelay,
+		},
+	} {
+		err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/foo",
+			Backend:  []*config.Backend{{URLPattern: "/bar", ExtraConfig: config.ExtraConfig{Namespace: tc.cfg}}},
+		}}})
+		if tc.err == nil && err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if tc.err != nil && (err == nil || !strings.Contains(err.Error(), tc.err.Error())) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestNewInjector_invalid(t *testing.T) {
+	for _, cfg := range []Config{
+		{Enabled: true, Abort: &AbortConfig{FaultConfig{100}, 42}},
+		{Enabled: true, Delay: &DelayConfig{FaultConfig: FaultConfig{100}, Fixed: "foo"}},
+		{Enabled: true, Delay: &DelayConfig{FaultConfig: FaultConfig{100}, Distribution: "uniform", Min: "1s", Max: "1ms"}},
+		{Enabled: true, Delay: &DelayConfig{FaultConfig: FaultConfig{100}, Distribution: "poisson"}},
+	} {
+		if _, err := NewInjector(cfg, 1); err == nil {
+			t.Errorf("expecting error for %+v", cfg)
+		}
+	}
+}
+
+func TestInjector_Decide(t *testing.T) {
+	i, err := NewInjector(Config{
+		Enabled: true,
+		Delay:   &DelayConfig{FaultConfig: FaultConfig{100}, Distribution: "uniform", Min: "10ms", Max: "20ms"},
+		Abort:   &AbortConfig{FaultConfig{100}, 503},
+		Match: MatchConfig{
+			Headers: map[string]string{"X-Fault": "on", "X-User-Role": "*"},
+		},
+	}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f := i.Decide(map[string][]string{"X-Fault": {"on"}}); !f.Empty() {
+		t.Errorf("unexpected faults without the role: %+v", f)
+	}
+
+	f := i.Decide(map[string][]string{"X-Fault": {"on"}, "x-user-role": {"qa"}})
+	if f.Abort != 503 || f.Delay < 10*time.Millisecond || f.Delay > 20*time.Millisecond || f.Drop || f.Corrupt {
+		t.Errorf("unexpected faults: %+v", f)
+	}
+}
+
+func TestNewProxy(t *testing.T) {
+	i, err := NewInjector(Config{Enabled: true, Corrupt: &FaultConfig{100}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"a":"some content"}`)
+	p := NewProxy(i, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{Io: bytes.NewReader(body), IsComplete: true}, nil
+	})
+	resp, err := p(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Io)
+	if bytes.Equal(b, body) || len(b) != len(body) {
+		t.Errorf("unexpected body: %s", string(b))
+	}
+
+	data := map[string]interface{}{
+		"a": "some content",
+		"b": 42.0,
+		"c": map[string]interface{}{"d": true, "e": []interface{}{1.0, 2.0}},
+	}
+	original := map[string]interface{}{
+		"a": "some content",
+		"b": 42.0,
+		"c": map[string]interface{}{"d": true, "e": []interface{}{1.0, 2.0}},
+	}
+	p = NewProxy(i, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{Data: data, IsComplete: true}, nil
+	})
+	for n := 0; n < 10; n++ {
+		resp, err := p(context.Background(), &proxy.Request{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(resp.Data, original) {
+			t.Errorf("#%d: the decoded response was not corrupted", n)
+		}
+		if !reflect.DeepEqual(data, original) {
+			t.Fatalf("#%d: the backend data was modified: %v", n, data)
+		}
+	}
+
+	i, _ = NewInjector(Config{Enabled: true, Abort: &AbortConfig{FaultConfig{100}, 502}}, 1)
+	p = NewProxy(i, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		t.Error("backend called")
+		return nil, nil
+	})
+	if _, err := p(context.Background(), &proxy.Request{}); err == nil || err.(AbortError).StatusCode() != 502 {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.String(http.StatusOK, "hello") }
+	}, logging.NoOp)
+
+	engine := gin.New()
+	engine.GET("/abort", hf(&config.EndpointConfig{
+		Endpoint: "/abort",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"enabled": true,
+			"abort":   map[string]interface{}{"percentage": 100, "status": 418},
+			"match":   map[string]interface{}{"headers": map[string]interface{}{"X-Fault": "*"}},
+		}},
+	}, proxy.NoopProxy))
+	engine.GET("/disabled", hf(&config.EndpointConfig{
+		Endpoint: "/disabled",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"abort": map[string]interface{}{"percentage": 100, "status": 418},
+		}},
+	}, proxy.NoopProxy))
+
+	for _, tc := range []struct {
+		path   string
+		header string
+		status int
+	}{
+		{"/abort", "", http.StatusOK},
+		{"/abort", "yes", http.StatusTeapot},
+		{"/disabled", "yes", http.StatusOK},
+	} {
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		if tc.header != "" {
+			req.Header.Set("X-Fault", tc.header)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: unexpected status code %d", tc.path, w.Code)
+		}
+	}
+}
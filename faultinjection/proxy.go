@@ -0,0 +1,81 @@
+package faultinjection
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// BackendFactory returns a backend factory injecting the configured faults into the backend proxies
+// with an enabled fault injection config
+func BackendFactory(logger logging.Logger, next proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		p := next(remote)
+		i, err := New(remote.ExtraConfig)
+		if err == ErrNoConfig || err == ErrDisabled {
+			return p
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return p
+		}
+		logger.Warning(fmt.Sprintf("[BACKEND: %s] fault injection enabled", remote.URLPattern))
+		return NewProxy(i, p)
+	}
+}
+
+// NewProxy returns a proxy injecting the faults decided by the injector before or after calling
+// the next one
+func NewProxy(i *Injector, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		f := i.Decide(r.Headers)
+		if f.Empty() {
+			return next(ctx, r)
+		}
+
+		if f.Delay > 0 {
+			t := time.NewTimer(f.Delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+		}
+
+		if f.Drop {
+			return nil, ErrConnectionDropped
+		}
+
+		if f.Abort > 0 {
+			return nil, AbortError{Code: f.Abort}
+		}
+
+		resp, err := next(ctx, r)
+		if !f.Corrupt || resp == nil {
+			return resp, err
+		}
+		if resp.Io == nil {
+			resp.Data = i.rand.corruptData(resp.Data)
+			return resp, err
+		}
+		resp.Io = corruptReader{r: resp.Io, rand: i.rand}
+		return resp, err
+	}
+}
+
+type corruptReader struct {
+	r    io.Reader
+	rand *source
+}
+
+func (c corruptReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.rand.corrupt(b[:n])
+	return n, err
+}
@@ -0,0 +1,98 @@
+package faultinjection
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	krakendgin "github.com/luraproject/lura/router/gin"
+)
+
+// HandlerFactory returns a handler factory injecting the configured faults into the endpoints with
+// an enabled fault injection config
+func HandlerFactory(next krakendgin.HandlerFactory, logger logging.Logger) krakendgin.HandlerFactory {
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(cfg, p)
+		i, err := New(cfg.ExtraConfig)
+		if err == ErrNoConfig || err == ErrDisabled {
+			return handler
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", cfg.Endpoint, err.Error()))
+			return handler
+		}
+		logger.Warning(fmt.Sprintf("[ENDPOINT: %s] fault injection enabled", cfg.Endpoint))
+		return NewHandler(i, handler)
+	}
+}
+
+// NewHandler returns a gin handler injecting the faults decided by the injector before calling the
+// next one
+func NewHandler(i *Injector, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f := i.Decide(c.Request.Header)
+		if f.Empty() {
+			next(c)
+			return
+		}
+
+		if f.Delay > 0 {
+			t := time.NewTimer(f.Delay)
+			select {
+			case <-c.Request.Context().Done():
+				t.Stop()
+				c.Abort()
+				return
+			case <-t.C:
+			}
+		}
+
+		if f.Drop {
+			drop(c)
+			return
+		}
+
+		if f.Abort > 0 {
+			c.AbortWithError(f.Abort, AbortError{Code: f.Abort})
+			return
+		}
+
+		if f.Corrupt {
+			c.Writer = &corruptWriter{ResponseWriter: c.Writer, rand: i.rand}
+		}
+
+		next(c)
+	}
+}
+
+// drop closes the client connection without writing any response. If the connection can not be
+// hijacked, the request is aborted with a 503 status code
+func drop(c *gin.Context) {
+	conn, _, err := c.Writer.Hijack()
+	if err != nil {
+		c.AbortWithError(http.StatusServiceUnavailable, ErrConnectionDropped)
+		return
+	}
+	conn.Close()
+	c.Abort()
+}
+
+type corruptWriter struct {
+	gin.ResponseWriter
+	rand *source
+}
+
+func (w *corruptWriter) Write(b []byte) (int, error) {
+	tmp := make([]byte, len(b))
+	copy(tmp, b)
+	w.rand.corrupt(tmp)
+	return w.ResponseWriter.Write(tmp)
+}
+
+func (w *corruptWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
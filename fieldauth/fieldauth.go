@@ -0,0 +1,207 @@
+/*
+Package fieldauth removes the fields of the backend responses the callers are not allowed to see,
+deciding with CEL expressions over the JWT claims.
+
+Sample backend config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/fieldauth": {
+			"rules": [
+				{ "paths": [ "email", "addresses.phone" ], "allow_if": "'admin' in JWT.roles" },
+				{ "paths": [ "billing" ], "allow_if": "JWT.scope.contains('billing:read')", "action": "null" }
+			]
+		}
+	},
+	...
+
+The fields listed in the paths of a rule are kept when its allow_if expression returns true, and they
+are dropped (the default action) or set to null otherwise. Expressions failing at runtime deny the
+access as well. The paths use the dot notation, where "*" matches every key or item and the
+collections are traversed transparently, and refer to the data of the backend after its formatting, as
+the rules are applied to every backend before the merge.
+
+The expressions have access to the same request variables as the krakend-cel checks (req_method,
+req_path, req_params, req_headers, req_querystring and now) and to the JWT claims (JWT), the ones
+authenticated by the gateway (a token validated by the jose or auth handlers, an API key or a client
+certificate) in the X-Gateway-Claims header, so it must be declared in the headers_to_pass list of the
+endpoint. The endpoints with rules must authenticate the requests, and their backends can not use the
+no-op encoding, as the raw responses are rejected.
+*/
+package fieldauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/devopsfaith/krakend-ce/internal/celexpr"
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/internal/datapath"
+	"github.com/google/cel-go/cel"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/encoding"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/fieldauth"
+
+// The supported actions
+const (
+	ActionDrop = "drop"
+	ActionNull = "null"
+)
+
+var (
+	// ErrNoConfig is returned when the backend has no fieldauth config
+	ErrNoConfig = errors.New("fieldauth: no config")
+	// ErrRawResponse is returned instead of the responses without decoded data (no-op encoding), whose
+	// fields can not be checked
+	ErrRawResponse = errors.New("fieldauth: the fields of a raw response can not be authorized")
+)
+
+// Config is the custom config struct of the field authorization layer
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule protects a set of fields with a CEL expression
+type Rule struct {
+	Paths   []string `json:"paths"`
+	AllowIf string   `json:"allow_if"`
+	Action  string   `json:"action"`
+}
+
+// ConfigGetter parses the fieldauth config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	for i, r := range cfg.Rules {
+		if len(r.Paths) == 0 || r.AllowIf == "" {
+			return cfg, fmt.Errorf("fieldauth: rule #%d must declare paths and allow_if", i)
+		}
+		switch r.Action {
+		case "":
+			cfg.Rules[i].Action = ActionDrop
+		case ActionDrop, ActionNull:
+		default:
+			return cfg, fmt.Errorf("fieldauth: rule #%d has an unknown action %q", i, r.Action)
+		}
+	}
+	return cfg, nil
+}
+
+type rule struct {
+	program cel.Program
+	paths   [][]string
+	action  string
+}
+
+func compile(cfg Config) ([]rule, error) {
+	rules := make([]rule, len(cfg.Rules))
+	for i, r := range cfg.Rules {
+		p, err := celexpr.Compile(r.AllowIf)
+		if err != nil {
+			return nil, fmt.Errorf("fieldauth: rule #%d: %s", i, err.Error())
+		}
+		rules[i] = rule{program: p, action: r.Action}
+		for _, path := range r.Paths {
+			rules[i].paths = append(rules[i].paths, datapath.Split(path))
+		}
+	}
+	return rules, nil
+}
+
+// Validate compiles the rules of every backend, returning the first error. The backends with rules
+// can not use the no-op encoding and their endpoints must authenticate the requests.
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil {
+				_, err = compile(c)
+			}
+			if err == nil && (b.Encoding == encoding.NOOP || e.OutputEncoding == encoding.NOOP) {
+				err = errors.New("fieldauth: the rules can not be applied with the no-op encoding")
+			}
+			if err == nil && !claims.Authenticates(e.ExtraConfig) {
+				err = errors.New("fieldauth: the endpoint does not authenticate the requests")
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// BackendFactory returns a backend factory removing the fields protected by the rules of the backends
+// with a fieldauth config
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next
+		}
+		var rules []rule
+		if err == nil {
+			rules, err = compile(cfg)
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			// the protected fields can not be exposed because of a bad config
+			return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+				return nil, err
+			}
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] fieldauth: %d rules", remote.URLPattern, len(rules)))
+		return newProxy(rules, next)
+	}
+}
+
+func newProxy(rules []rule, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		vars := celexpr.RequestActivation(r)
+		resp, err := next(ctx, r)
+		if resp != nil && resp.Io != nil {
+			if c, ok := resp.Io.(io.Closer); ok {
+				c.Close()
+			}
+			return nil, ErrRawResponse
+		}
+		if resp == nil || resp.Data == nil {
+			return resp, err
+		}
+		for _, rule := range rules {
+			if allowed, evalErr := celexpr.Eval(rule.program, vars); evalErr == nil && allowed {
+				continue
+			}
+			for _, path := range rule.paths {
+				datapath.Apply(resp.Data, path, rule.deny)
+			}
+		}
+		return resp, err
+	}
+}
+
+func (r rule) deny(_ interface{}) (interface{}, bool) {
+	return nil, r.action == ActionNull
+}
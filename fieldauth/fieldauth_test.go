@@ -0,0 +1,138 @@
+package fieldauth
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestBackendFactory(t *testing.T) {
+	bf := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{IsComplete: true, Data: map[string]interface{}{
+				"name":    "foo",
+				"email":   "foo@example.com",
+				"billing": map[string]interface{}{"iban": "ES00"},
+				"addresses": []interface{}{
+					map[string]interface{}{"city": "a", "phone": "1"},
+					map[string]interface{}{"city": "b", "phone": "2"},
+				},
+			}}, nil
+		}
+	})
+	p := bf(&config.Backend{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{"paths": []interface{}{"email", "addresses.phone"}, "allow_if": "'admin' in JWT.roles"},
+			map[string]interface{}{"paths": []interface{}{"billing"}, "allow_if": "JWT.scope.contains('billing')", "action": "null"},
+		},
+	}}})
+
+	for _, tc := range []struct {
+		name     string
+		claims   string
+		expected map[string]interface{}
+	}{
+		{
+			name: "anonymous",
+			expected: map[string]interface{}{
+				"name":    "foo",
+				"billing": nil,
+				"addresses": []interface{}{
+					map[string]interface{}{"city": "a"},
+					map[string]interface{}{"city": "b"},
+				},
+			},
+		},
+		{
+			name:   "admin",
+			claims: `{"roles":["admin"],"scope":"profile"}`,
+			expected: map[string]interface{}{
+				"name":    "foo",
+				"email":   "foo@example.com",
+				"billing": nil,
+				"addresses": []interface{}{
+					map[string]interface{}{"city": "a", "phone": "1"},
+					map[string]interface{}{"city": "b", "phone": "2"},
+				},
+			},
+		},
+		{
+			name:   "billing",
+			claims: `{"roles":["user"],"scope":"profile billing"}`,
+			expected: map[string]interface{}{
+				"name":    "foo",
+				"billing": map[string]interface{}{"iban": "ES00"},
+				"addresses": []interface{}{
+					map[string]interface{}{"city": "a"},
+					map[string]interface{}{"city": "b"},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string][]string{}
+			if tc.claims != "" {
+				headers["X-Gateway-Claims"] = []string{base64.RawURLEncoding.EncodeToString([]byte(tc.claims))}
+			}
+			resp, err := p(context.Background(), &proxy.Request{Headers: headers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Data, tc.expected) {
+				t.Errorf("unexpected data: %v", resp.Data)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, rule := range []map[string]interface{}{
+		{"paths": []interface{}{"email"}, "allow_if": "JWT.roles +"},
+		{"paths": []interface{}{"email"}, "allow_if": "true", "action": "mask"},
+		{"allow_if": "true"},
+	} {
+		cfg := config.ServiceConfig{Endpoints: []*config.EndpointConfig{{Backend: []*config.Backend{{
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"rules": []interface{}{rule}}},
+		}}}}}
+		if err := Validate(cfg); err == nil {
+			t.Errorf("expecting an error for %v", rule)
+		}
+	}
+
+	backend := &config.Backend{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"rules": []interface{}{map[string]interface{}{"paths": []interface{}{"email"}, "allow_if": "true"}},
+	}}}
+	e := &config.EndpointConfig{Backend: []*config.Backend{backend}, ExtraConfig: config.ExtraConfig{}}
+	cfg := config.ServiceConfig{Endpoints: []*config.EndpointConfig{e}}
+	if err := Validate(cfg); err == nil {
+		t.Error("rules accepted on an endpoint without authentication")
+	}
+	e.ExtraConfig["github.com/devopsfaith/krakend-ce/apikey"] = map[string]interface{}{}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	backend.Encoding = "no-op"
+	if err := Validate(cfg); err == nil {
+		t.Error("rules accepted with the no-op encoding")
+	}
+}
+
+func TestBackendFactory_raw(t *testing.T) {
+	bf := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{IsComplete: true, Io: strings.NewReader(`{"email":"foo@example.com"}`)}, nil
+		}
+	})
+	p := bf(&config.Backend{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"rules": []interface{}{map[string]interface{}{"paths": []interface{}{"email"}, "allow_if": "false"}},
+	}}})
+	if resp, err := p(context.Background(), &proxy.Request{}); resp != nil || err != ErrRawResponse {
+		t.Errorf("raw response not rejected: %v %v", resp, err)
+	}
+}
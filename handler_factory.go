@@ -2,6 +2,17 @@ package krakend
 
 import (
 	botdetector "github.com/devopsfaith/krakend-botdetector/gin"
+	"github.com/devopsfaith/krakend-ce/apikey"
+	"github.com/devopsfaith/krakend-ce/etag"
+	"github.com/devopsfaith/krakend-ce/faultinjection"
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/ipfilter"
+	"github.com/devopsfaith/krakend-ce/limits"
+	"github.com/devopsfaith/krakend-ce/mtls"
+	"github.com/devopsfaith/krakend-ce/partial"
+	"github.com/devopsfaith/krakend-ce/policy"
+	"github.com/devopsfaith/krakend-ce/quota"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
 	jose "github.com/devopsfaith/krakend-jose"
 	ginjose "github.com/devopsfaith/krakend-jose/gin"
 	lua "github.com/devopsfaith/krakend-lua/router/gin"
@@ -27,12 +38,23 @@ func (h handlerFactory) NewHandlerFactory(l logging.Logger, m *metrics.Metrics,
 // NewHandlerFactoryWithConfig returns a HandlerFactory with service configuration for WebSocket backends
 func NewHandlerFactoryWithConfig(logger logging.Logger, metricCollector *metrics.Metrics, rejecter jose.RejecterFactory, serviceConfig config.ServiceConfig) router.HandlerFactory {
 	handlerFactory := juju.HandlerFactory
+	handlerFactory = ratelimit.HandlerFactory(handlerFactory, logger)
+	handlerFactory = quota.HandlerFactory(handlerFactory, logger)
+	handlerFactory = partial.HandlerFactory(handlerFactory, logger)
+	handlerFactory = etag.HandlerFactory(handlerFactory, logger)
+	handlerFactory = faultinjection.HandlerFactory(handlerFactory, logger)
 	handlerFactory = lua.HandlerFactory(logger, handlerFactory)
+	handlerFactory = policy.HandlerFactory(handlerFactory, logger)
+	handlerFactory = claims.HandlerFactory(handlerFactory)
 	handlerFactory = krakendauth.HandlerFactory(handlerFactory, logger)
 	handlerFactory = ginjose.HandlerFactory(handlerFactory, logger, rejecter)
+	handlerFactory = apikey.HandlerFactory(handlerFactory, logger)
+	handlerFactory = mtls.HandlerFactory(handlerFactory, logger)
 	handlerFactory = metricCollector.NewHTTPHandlerFactory(handlerFactory)
 	handlerFactory = opencensus.New(handlerFactory)
 	handlerFactory = botdetector.New(handlerFactory, logger)
+	handlerFactory = limits.HandlerFactory(handlerFactory, logger)
+	handlerFactory = ipfilter.HandlerFactory(handlerFactory, logger)
 
 	// Wrap with SSE middleware
 	handlerFactory = sse.New(handlerFactory, logger)
@@ -43,4 +65,3 @@ func NewHandlerFactoryWithConfig(logger logging.Logger, metricCollector *metrics
 
 	return handlerFactory
 }
-
@@ -0,0 +1,37 @@
+// Package admin protects the admin endpoints of the components, which require the admin_token declared
+// next to their admin_path as bearer token.
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrNoToken is returned when an admin path is declared without an admin token
+var ErrNoToken = errors.New("the admin_path requires an admin_token")
+
+// Middleware rejects with a 401 the requests without the token as bearer token. An empty token
+// rejects every request.
+func Middleware(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !Authorized(c.Request, token) {
+			c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Authorized tells if the request contains the token as bearer token, comparing them in constant time
+func Authorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[7:])), []byte(token)) == 1
+}
@@ -0,0 +1,94 @@
+// Package celexpr compiles and evaluates the boolean CEL expressions of the components. The request
+// variables follow the krakend-cel naming (req_method, req_path, req_params, req_headers,
+// req_querystring and now), so the expressions can be moved between both without changes, and the
+// claims authenticated by the gateway for the request are exposed as the JWT map. They are only
+// available on the endpoints declaring the X-Gateway-Claims header in their headers_to_pass list.
+package celexpr
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/luraproject/lura/proxy"
+)
+
+// ErrNotBool is returned when the expression does not evaluate to a boolean
+var ErrNotBool = errors.New("cel: the expression must return a bool")
+
+// RequestDeclarations declares the request variables
+func RequestDeclarations() cel.EnvOption {
+	return cel.Declarations(
+		decls.NewIdent("now", decls.String, nil),
+		decls.NewIdent("req_method", decls.String, nil),
+		decls.NewIdent("req_path", decls.String, nil),
+		decls.NewIdent("req_params", decls.NewMapType(decls.String, decls.String), nil),
+		decls.NewIdent("req_headers", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
+		decls.NewIdent("req_querystring", decls.NewMapType(decls.String, decls.NewListType(decls.String)), nil),
+		decls.NewIdent("JWT", decls.NewMapType(decls.String, decls.Dyn), nil),
+	)
+}
+
+// RequestActivation returns the values of the request variables
+func RequestActivation(r *proxy.Request) map[string]interface{} {
+	c := claims.FromHeaders(r.Headers)
+	if c == nil {
+		c = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"now":             time.Now().Format(time.RFC3339),
+		"req_method":      r.Method,
+		"req_path":        r.Path,
+		"req_params":      nonNilParams(r.Params),
+		"req_headers":     nonNilValues(r.Headers),
+		"req_querystring": nonNilValues(r.Query),
+		"JWT":             c,
+	}
+}
+
+// Compile parses and checks the expression with the request declarations and the received options.
+// Expressions with a static type other than bool or dyn are rejected.
+func Compile(expr string, opts ...cel.EnvOption) (cel.Program, error) {
+	env, err := cel.NewEnv(append([]cel.EnvOption{RequestDeclarations()}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if iss != nil && iss.Err() != nil {
+		return nil, fmt.Errorf("cel: %s", iss.Err().Error())
+	}
+	if t := ast.ResultType().String(); t != decls.Bool.String() && t != decls.Dyn.String() {
+		return nil, ErrNotBool
+	}
+	return env.Program(ast)
+}
+
+// Eval evaluates the program with the received variables
+func Eval(p cel.Program, vars map[string]interface{}) (bool, error) {
+	out, _, err := p.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	v, ok := out.Value().(bool)
+	if !ok {
+		return false, ErrNotBool
+	}
+	return v, nil
+}
+
+func nonNilParams(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+func nonNilValues(m map[string][]string) map[string][]string {
+	if m == nil {
+		return map[string][]string{}
+	}
+	return m
+}
@@ -0,0 +1,168 @@
+// Package claims gives the middlewares access to the claims of the identities authenticated by the
+// gateway.
+//
+// The claims travel in the GatewayHeader, as base64url encoded JSON. The HandlerFactory removes the
+// header sent by the clients and sets it only once the request has been authenticated: with the claims
+// of the bearer token on the endpoints validating it with krakend-jose or krakend-auth, where the token
+// has been verified by the time the request reaches it, or with the ones of the identities
+// authenticated by the gateway itself (API keys, client certificates...), set in the request context
+// with Authenticate. The tokens are never decoded on the endpoints not validating them, so unsigned or
+// forged tokens grant nothing.
+//
+// Forwarding the claims is opt-in: the proxy stack and the backends of an endpoint only receive them if
+// the GatewayHeader is declared in its headers_to_pass list.
+package claims
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthHeader is the header containing the bearer token
+const AuthHeader = "Authorization"
+
+// GatewayHeader is the header containing the base64url encoded JSON claims of the identity
+// authenticated by the gateway for the request
+const GatewayHeader = "X-Gateway-Claims"
+
+type contextKey struct{}
+
+// FromHeaders decodes the claims in the GatewayHeader. The lookup is case insensitive because the proxy
+// requests keep the header names as declared in the headers_to_pass list. It returns nil if there are
+// no claims or they can not be decoded.
+func FromHeaders(headers map[string][]string) map[string]interface{} {
+	for k, vs := range headers {
+		if len(vs) > 0 && strings.EqualFold(k, GatewayHeader) {
+			return decodePayload(vs[0])
+		}
+	}
+	return nil
+}
+
+// FromHTTPRequest decodes the claims in the GatewayHeader of the received request, as FromHeaders
+func FromHTTPRequest(r *http.Request) map[string]interface{} {
+	return decodePayload(r.Header.Get(GatewayHeader))
+}
+
+// Authenticate sets the claims of the identity authenticated by a gateway authenticator (an API key, a
+// client certificate...) in the GatewayHeader and in the context of the returned request
+func Authenticate(r *http.Request, claims map[string]interface{}) *http.Request {
+	r.Header.Set(GatewayHeader, Encode(claims))
+	return r.WithContext(context.WithValue(r.Context(), contextKey{}, claims))
+}
+
+// FromContext returns the claims of the identity authenticated by a gateway authenticator for the
+// request owning the context, or nil. Unlike the GatewayHeader, they never contain token claims.
+func FromContext(ctx context.Context) map[string]interface{} {
+	c, _ := ctx.Value(contextKey{}).(map[string]interface{})
+	return c
+}
+
+// Encode returns the claims encoded for the GatewayHeader
+func Encode(claims map[string]interface{}) string {
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Decode returns the claims contained in the payload of the received token, without verifying it. The
+// "Bearer " prefix is optional.
+func Decode(token string) map[string]interface{} {
+	token = strings.TrimSpace(token)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	return decodePayload(parts[1])
+}
+
+func decodePayload(s string) map[string]interface{} {
+	if s == "" {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil
+	}
+	res := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &res); err != nil {
+		return nil
+	}
+	return res
+}
+
+// Lookup returns the value stored at the received dot-separated path
+func Lookup(claims map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// LookupString returns the string representation of the value stored at the received path
+func LookupString(claims map[string]interface{}, path string) (string, bool) {
+	v, ok := Lookup(claims, path)
+	if !ok || v == nil {
+		return "", false
+	}
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return fmt.Sprintf("%v", t), true
+	case bool:
+		return fmt.Sprintf("%v", t), true
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// Contains checks if the claim stored at the received path is equal to the expected value or, if the
+// claim is a list (roles, scopes...), if it contains it. Space separated strings, like the standard
+// "scope" claim, are handled as lists.
+func Contains(claims map[string]interface{}, path, expected string) bool {
+	v, ok := Lookup(claims, path)
+	if !ok {
+		return false
+	}
+	switch t := v.(type) {
+	case []interface{}:
+		for _, e := range t {
+			if fmt.Sprintf("%v", e) == expected {
+				return true
+			}
+		}
+		return false
+	case string:
+		if t == expected {
+			return true
+		}
+		for _, e := range strings.Fields(t) {
+			if e == expected {
+				return true
+			}
+		}
+		return false
+	}
+	s, _ := LookupString(claims, path)
+	return s == expected
+}
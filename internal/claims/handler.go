@@ -0,0 +1,67 @@
+package claims
+
+import (
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// The namespaces of the endpoint authenticators. The gateway ones are not imported to avoid cycles.
+const (
+	authNamespace   = "github.com/unacademy/krakend-auth"
+	apikeyNamespace = "github.com/devopsfaith/krakend-ce/apikey"
+	mtlsNamespace   = "github.com/devopsfaith/krakend-ce/mtls"
+)
+
+// ValidatesTokens tells if the endpoint rejects the requests without a valid bearer token before they
+// reach the rest of the handlers: with a valid krakend-jose validator config (an invalid one leaves the
+// endpoint unprotected) or with krakend-auth enabled and aborting the unauthorized requests.
+func ValidatesTokens(e config.ExtraConfig) bool {
+	if _, err := krakendjose.GetSignatureConfig(&config.EndpointConfig{ExtraConfig: e}); err == nil {
+		return true
+	}
+	cfg, ok := e[authNamespace].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	enabled, _ := cfg["enable"].(bool)
+	abort, _ := cfg["abort_if_unauthorized"].(bool)
+	return enabled && abort
+}
+
+// Authenticates tells if the endpoint rejects the unauthenticated requests, validating their tokens or
+// requiring an API key or a client certificate
+func Authenticates(e config.ExtraConfig) bool {
+	if ValidatesTokens(e) {
+		return true
+	}
+	_, apikey := e[apikeyNamespace]
+	_, mtls := e[mtlsNamespace]
+	return apikey || mtls
+}
+
+// HandlerFactory returns a handler factory removing the GatewayHeader sent by the clients and setting
+// the claims of the gateway authenticators in it or, on the endpoints validating the tokens, the ones
+// of the bearer token, taking precedence. It must run after the token validators and the gateway
+// authenticators.
+func HandlerFactory(next router.HandlerFactory) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		validates := ValidatesTokens(remote.ExtraConfig)
+		return func(c *gin.Context) {
+			c.Request.Header.Del(GatewayHeader)
+			claims := FromContext(c.Request.Context())
+			if validates {
+				if token := Decode(c.GetHeader(AuthHeader)); token != nil {
+					claims = token
+				}
+			}
+			if claims != nil {
+				c.Request.Header.Set(GatewayHeader, Encode(claims))
+			}
+			handlerFunc(c)
+		}
+	}
+}
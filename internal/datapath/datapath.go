@@ -0,0 +1,67 @@
+// Package datapath applies functions to the values found at the dot-separated paths of the response
+// data. A "*" key matches every key of an object or every item of a collection, and the collections
+// found before the end of the path are traversed transparently by the rest of the keys, so
+// "items.email" and "items.*.email" are equivalent.
+package datapath
+
+import "strings"
+
+// Split returns the keys of the dot-separated path
+func Split(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// Apply calls fn with every value found at the path, replacing it with the returned value or removing
+// it when fn returns false. It returns the updated node, as removing the items of a collection
+// replaces it.
+func Apply(node interface{}, path []string, fn func(interface{}) (interface{}, bool)) interface{} {
+	if len(path) == 0 {
+		return node
+	}
+	switch t := node.(type) {
+	case map[string]interface{}:
+		keys := []string{path[0]}
+		if path[0] == "*" {
+			keys = make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			v, ok := t[k]
+			if !ok {
+				continue
+			}
+			if len(path) > 1 {
+				t[k] = Apply(v, path[1:], fn)
+				continue
+			}
+			if v, keep := fn(v); keep {
+				t[k] = v
+			} else {
+				delete(t, k)
+			}
+		}
+	case []interface{}:
+		if path[0] != "*" {
+			for i := range t {
+				t[i] = Apply(t[i], path, fn)
+			}
+			return t
+		}
+		if len(path) > 1 {
+			for i := range t {
+				t[i] = Apply(t[i], path[1:], fn)
+			}
+			return t
+		}
+		items := t[:0]
+		for _, v := range t {
+			if v, keep := fn(v); keep {
+				items = append(items, v)
+			}
+		}
+		return items
+	}
+	return node
+}
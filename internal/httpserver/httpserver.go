@@ -0,0 +1,87 @@
+// Package httpserver starts the listeners of the gateway, letting the RunServerFunc wrappers customize
+// the http.Server they create. The RunServerFunc signature only carries the service config, so the
+// options travel in the context received by the wrapped RunServerFunc, which must be the RunServer of
+// this package for them to apply.
+package httpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/transport/http/server"
+)
+
+// Option modifies the server before it starts listening
+type Option func(*http.Server)
+
+type optionsKey struct{}
+
+// WithOptions returns a copy of the context adding the options, applied after the ones already in it
+func WithOptions(ctx context.Context, opts ...Option) context.Context {
+	prev := Options(ctx)
+	all := make([]Option, 0, len(prev)+len(opts))
+	all = append(append(all, prev...), opts...)
+	return context.WithValue(ctx, optionsKey{}, all)
+}
+
+// Options returns the options of the context
+func Options(ctx context.Context) []Option {
+	opts, _ := ctx.Value(optionsKey{}).([]Option)
+	return opts
+}
+
+// Addr sets the address of the listener
+func Addr(addr string) Option {
+	return func(s *http.Server) { s.Addr = addr }
+}
+
+// TLSConfig replaces the tls config of the server. The config must contain the server certificates.
+func TLSConfig(cfg *tls.Config) Option {
+	return func(s *http.Server) { s.TLSConfig = cfg }
+}
+
+// MaxHeaderBytes sets the max size of the request line and the headers read by the server
+func MaxHeaderBytes(n int) Option {
+	return func(s *http.Server) { s.MaxHeaderBytes = n }
+}
+
+// RunServer runs a http.Server with the given handler and configuration, as the lura one, applying the
+// options of the context to it. The TLS configs with certificates do not require the public and private
+// keys of the service.
+func RunServer(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+	s := server.NewServer(cfg, handler)
+	for _, opt := range Options(ctx) {
+		opt(s)
+	}
+
+	done := make(chan error)
+	switch {
+	case s.TLSConfig == nil:
+		go func() {
+			done <- s.ListenAndServe()
+		}()
+	case len(s.TLSConfig.Certificates) > 0:
+		go func() {
+			done <- s.ListenAndServeTLS("", "")
+		}()
+	default:
+		if cfg.TLS == nil || cfg.TLS.PublicKey == "" {
+			return server.ErrPublicKey
+		}
+		if cfg.TLS.PrivateKey == "" {
+			return server.ErrPrivateKey
+		}
+		go func() {
+			done <- s.ListenAndServeTLS(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
+		}()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return s.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,83 @@
+// Package redispool creates the redigo connection pools shared by the components talking to
+// redis-compatible stores.
+package redispool
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	defaultMaxIdle     = 10
+	defaultDialTimeout = 5 * time.Second
+)
+
+// Config contains the connection and pool options
+type Config struct {
+	Address     string
+	Password    string
+	DB          int
+	MaxIdle     int
+	MaxActive   int
+	DialTimeout time.Duration
+	IdleTimeout time.Duration
+}
+
+// HostPort returns the host and port of the server. The redis:// and tcp:// schemes are removed, and
+// so are the http:// and https:// ones added by the sanitization of the backend hosts.
+func (c Config) HostPort() string {
+	addr := c.Address
+	for _, scheme := range []string{"redis://", "tcp://", "http://", "https://"} {
+		addr = strings.TrimPrefix(addr, scheme)
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+// Pool is a redigo pool sending the commands with a context. A MaxActive of zero means no limit and,
+// when reached, the commands wait for a free connection until their context is done.
+type Pool struct {
+	*redis.Pool
+}
+
+// New returns a pool with the received config
+func New(cfg Config) *Pool {
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = defaultMaxIdle
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	addr := cfg.HostPort()
+	return &Pool{&redis.Pool{
+		MaxIdle:     cfg.MaxIdle,
+		MaxActive:   cfg.MaxActive,
+		IdleTimeout: cfg.IdleTimeout,
+		Wait:        true,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", addr,
+				redis.DialPassword(cfg.Password),
+				redis.DialDatabase(cfg.DB),
+				redis.DialConnectTimeout(cfg.DialTimeout),
+			)
+		},
+	}}
+}
+
+// Do gets a connection from the pool, sends the command and returns the connection to the pool. The
+// replies are the redigo ones: string (simple strings), int64, []byte (bulk strings), []interface{}
+// and nil, with the error replies returned as a redis.Error.
+func (p *Pool) Do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	params := make([]interface{}, len(args)-1)
+	for i, a := range args[1:] {
+		params[i] = a
+	}
+	return redis.DoContext(c, ctx, args[0], params...)
+}
@@ -0,0 +1,84 @@
+// Package tmpl renders Go templates over the data of the proxy requests, so the backend components can
+// build keys, topics or payloads from the path params, query string, headers and claims. The claims are
+// the ones authenticated by the gateway, available on the endpoints declaring the X-Gateway-Claims
+// header in their headers_to_pass list.
+package tmpl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"text/template"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Data is the request data available to the templates. Params keep the lura naming (first letter in
+// upper case, as in {{.Params.Id}}), while Query and Headers contain the first value of every key.
+type Data struct {
+	Method  string
+	Path    string
+	Params  map[string]string
+	Query   map[string]string
+	Headers map[string]string
+	Claims  map[string]interface{}
+	Body    interface{}
+}
+
+// FromRequest extracts the template data from the received request. The body is not consumed.
+func FromRequest(r *proxy.Request) Data {
+	d := Data{
+		Method:  r.Method,
+		Path:    r.Path,
+		Params:  r.Params,
+		Query:   make(map[string]string, len(r.Query)),
+		Headers: make(map[string]string, len(r.Headers)),
+		Claims:  claims.FromHeaders(r.Headers),
+	}
+	if d.Params == nil {
+		d.Params = map[string]string{}
+	}
+	if d.Claims == nil {
+		d.Claims = map[string]interface{}{}
+	}
+	for k, vs := range r.Query {
+		if len(vs) > 0 {
+			d.Query[k] = vs[0]
+		}
+	}
+	for k, vs := range r.Headers {
+		if len(vs) > 0 {
+			d.Headers[http.CanonicalHeaderKey(k)] = vs[0]
+		}
+	}
+	return d
+}
+
+// Funcs are the helpers available to every template
+var Funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// Parse compiles the received text. Missing keys are reported as errors at execution time.
+func Parse(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(Funcs).Option("missingkey=error").Parse(text)
+}
+
+// Execute renders the template with the received data
+func Execute(t *template.Template, data interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,176 @@
+package ipfilter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+var current = struct {
+	mu       sync.RWMutex
+	service  *filter
+	resolver Resolver
+	denyFile Nets
+}{}
+
+type filter struct {
+	allow Nets
+	deny  Nets
+	// denyAll rejects every request, when the filter can not be built from its config
+	denyAll bool
+}
+
+func denyFile() Nets {
+	current.mu.RLock()
+	n := current.denyFile
+	current.mu.RUnlock()
+	return n
+}
+
+func setDenyFile(n Nets) {
+	current.mu.Lock()
+	current.denyFile = n
+	current.mu.Unlock()
+}
+
+// Register sets the filter of the service config, to be used by the handlers created from then on,
+// and reloads its deny file on change until the context is cancelled. An invalid config sets a filter
+// rejecting every request.
+func Register(ctx context.Context, cfg config.ServiceConfig, l logging.Logger) {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err == ErrNoConfig {
+		return
+	}
+	f := &filter{}
+	var trusted Nets
+	if err == nil {
+		f.allow, err = ParseNets(service.Allow)
+	}
+	if err == nil {
+		f.deny, err = ParseNets(service.Deny)
+	}
+	if err == nil {
+		trusted, err = ParseNets(service.TrustedProxies)
+	}
+	if err != nil {
+		// the endpoints can not be exposed without the restrictions of the service
+		l.Error(err.Error(), "(rejecting every request)")
+		f = &filter{denyAll: true}
+	}
+
+	current.mu.Lock()
+	current.service, current.resolver = f, Resolver{Trusted: trusted, Header: service.ClientIPHeader}
+	current.mu.Unlock()
+
+	if f.denyAll || service.DenyFile == "" {
+		return
+	}
+	fp := fingerprint(service.DenyFile)
+	nets, err := LoadNets(service.DenyFile)
+	if err != nil {
+		l.Warning(err.Error())
+	} else {
+		setDenyFile(nets)
+		l.Debug(fmt.Sprintf("ipfilter: %d entries loaded from %s", len(nets), service.DenyFile))
+	}
+	go watch(ctx, service, fp, l)
+}
+
+func watch(ctx context.Context, cfg ServiceConfig, last string, l logging.Logger) {
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fp := fingerprint(cfg.DenyFile)
+		if fp == last {
+			continue
+		}
+		last = fp
+		nets, err := LoadNets(cfg.DenyFile)
+		if err != nil {
+			l.Error(err.Error(), "(keeping the previous entries)")
+			continue
+		}
+		setDenyFile(nets)
+		l.Info(fmt.Sprintf("ipfilter: %d entries reloaded from %s", len(nets), cfg.DenyFile))
+	}
+}
+
+func fingerprint(file string) string {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+}
+
+// HandlerFactory returns a handler factory rejecting the requests of the clients not allowed by the
+// filters of the service and the endpoint
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+
+		current.mu.RLock()
+		service, resolver := current.service, current.resolver
+		current.mu.RUnlock()
+
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig && service == nil {
+			return handlerFunc
+		}
+		if err != nil && err != ErrNoConfig {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			return forbidden
+		}
+
+		f := filter{}
+		if service != nil {
+			f = *service
+		}
+		if f.denyAll {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] ipfilter: invalid service config, rejecting every request", remote.Endpoint))
+			return forbidden
+		}
+		if len(cfg.Allow) > 0 {
+			if f.allow, err = ParseNets(cfg.Allow); err != nil {
+				logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+				return forbidden
+			}
+		}
+		deny, err := ParseNets(cfg.Deny)
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			return forbidden
+		}
+		f.deny = append(append(Nets{}, f.deny...), deny...)
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] ipfilter: %d allowed and %d denied networks", remote.Endpoint, len(f.allow), len(f.deny)))
+
+		return func(c *gin.Context) {
+			ip := resolver.ClientIP(c.Request)
+			if f.deny.Contains(ip) || denyFile().Contains(ip) || (len(f.allow) > 0 && !f.allow.Contains(ip)) {
+				logger.Debug(fmt.Sprintf("[ENDPOINT: %s] ipfilter: %s rejected", remote.Endpoint, ip))
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			handlerFunc(c)
+		}
+	}
+}
+
+// forbidden rejects every request, since the endpoints can not be exposed without their restrictions
+func forbidden(c *gin.Context) {
+	c.AbortWithStatus(http.StatusForbidden)
+}
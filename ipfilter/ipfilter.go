@@ -0,0 +1,248 @@
+/*
+Package ipfilter restricts the access to the endpoints by the IP of the clients, with allow and deny
+lists of CIDRs declared at service and endpoint level.
+
+The service config applies to every endpoint and declares the proxies in front of the gateway, whose
+forwarding header is trusted to find the real IP of the clients:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/ipfilter": {
+			"deny": [ "203.0.113.0/24" ],
+			"trusted_proxies": [ "10.0.0.0/8" ],
+			"client_ip_header": "X-Forwarded-For",
+			"deny_file": "./denylist.txt",
+			"reload_interval": "10s"
+		}
+	}
+
+The endpoints add their own lists:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/ipfilter": {
+			"allow": [ "192.168.10.0/24", "172.16.0.0/12" ]
+		}
+	}
+
+The entries are CIDRs or single IPs. A request is rejected with a 403 when its client IP matches any
+deny list (the service, the endpoint or the file one), or when there is an allow list and the IP does
+not match it. The allow list of the endpoint, if any, replaces the one of the service. The endpoints
+with invalid lists, or every endpoint when the service config is invalid, reject all the requests.
+
+Without trusted proxies, the client IP is the address of the connection. When the connection comes
+from a trusted proxy, the client_ip_header (X-Forwarded-For by default) is read from right to left
+and the first address not belonging to a trusted proxy is the client IP, so the values injected by
+the clients themselves are ignored.
+
+The deny_file contains an entry per line, with the empty lines and the ones starting with # ignored.
+It is checked every reload_interval (10s by default) and reloaded when it changes, keeping the
+previous entries if the new ones can not be loaded.
+*/
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/config"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/ipfilter"
+
+const (
+	defaultHeader         = "X-Forwarded-For"
+	defaultReloadInterval = 10 * time.Second
+)
+
+// ErrNoConfig is returned when there is no ipfilter config
+var ErrNoConfig = errors.New("ipfilter: no config")
+
+// ServiceConfig is the custom config struct of the filter applied to every endpoint
+type ServiceConfig struct {
+	Config
+	TrustedProxies []string `json:"trusted_proxies"`
+	ClientIPHeader string   `json:"client_ip_header"`
+	DenyFile       string   `json:"deny_file"`
+	ReloadInterval string   `json:"reload_interval"`
+
+	interval time.Duration
+}
+
+// Config is the custom config struct of the endpoint filters
+type Config struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the filter config of the service
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{ClientIPHeader: defaultHeader, interval: defaultReloadInterval}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.ReloadInterval != "" {
+		d, err := time.ParseDuration(cfg.ReloadInterval)
+		if err != nil {
+			return cfg, fmt.Errorf("ipfilter: %s", err.Error())
+		}
+		if d <= 0 {
+			return cfg, fmt.Errorf("ipfilter: non-positive reload_interval %s", cfg.ReloadInterval)
+		}
+		cfg.interval = d
+	}
+	for _, list := range [][]string{cfg.Allow, cfg.Deny, cfg.TrustedProxies} {
+		if _, err := ParseNets(list); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// ConfigGetter parses the filter config of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	for _, list := range [][]string{cfg.Allow, cfg.Deny} {
+		if _, err := ParseNets(list); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// Validate checks the filter config of the service, its deny file and the lists of every endpoint
+func Validate(cfg config.ServiceConfig) error {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	if err == nil && service.DenyFile != "" {
+		if _, err := LoadNets(service.DenyFile); err != nil {
+			return err
+		}
+	}
+	for _, e := range cfg.Endpoints {
+		if _, err := ConfigGetter(e.ExtraConfig); err != nil && err != ErrNoConfig {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// Nets is a list of networks
+type Nets []*net.IPNet
+
+// ParseNets parses the received CIDRs and single IPs
+func ParseNets(entries []string) (Nets, error) {
+	nets := make(Nets, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("ipfilter: invalid IP %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("ipfilter: invalid CIDR %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// LoadNets parses the entries of the file, one per line
+func LoadNets(file string) (Nets, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("ipfilter: %s", err.Error())
+	}
+	entries := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ipfilter: %s", err.Error())
+	}
+	return ParseNets(entries)
+}
+
+// Contains tells if any network contains the IP
+func (n Nets) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver finds the IP of the clients behind the trusted proxies
+type Resolver struct {
+	Trusted Nets
+	Header  string
+}
+
+// ClientIP returns the IP of the client sending the request
+func (r Resolver) ClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil {
+		host = strings.TrimSpace(req.RemoteAddr)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || len(r.Trusted) == 0 || !r.Trusted.Contains(ip) {
+		return ip
+	}
+	hops := []string{}
+	for _, v := range req.Header.Values(r.Header) {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// the chain is broken, so the last trusted address is the one to use
+			return ip
+		}
+		ip = hop
+		if !r.Trusted.Contains(hop) {
+			return hop
+		}
+	}
+	return ip
+}
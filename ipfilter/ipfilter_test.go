@@ -0,0 +1,180 @@
+package ipfilter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestResolver_ClientIP(t *testing.T) {
+	trusted, _ := ParseNets([]string{"10.0.0.0/8", "192.168.1.1"})
+	r := Resolver{Trusted: trusted, Header: defaultHeader}
+	for i, tc := range []struct {
+		remote string
+		xff    string
+		ip     string
+	}{
+		{remote: "203.0.113.7:1234", xff: "1.1.1.1", ip: "203.0.113.7"},
+		{remote: "10.0.0.1:1234", xff: "1.1.1.1", ip: "1.1.1.1"},
+		{remote: "10.0.0.1:1234", xff: "6.6.6.6, 1.1.1.1, 192.168.1.1", ip: "1.1.1.1"},
+		{remote: "10.0.0.1:1234", xff: "10.0.0.3, 10.0.0.2", ip: "10.0.0.3"},
+		{remote: "10.0.0.1:1234", xff: "1.1.1.1, garbage", ip: "10.0.0.1"},
+		{remote: "10.0.0.1:1234", ip: "10.0.0.1"},
+		{remote: "[2001:db8::1]:1234", xff: "1.1.1.1", ip: "2001:db8::1"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set(defaultHeader, tc.xff)
+		}
+		if got := r.ClientIP(req).String(); got != tc.ip {
+			t.Errorf("#%d: unexpected client IP %s", i, got)
+		}
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "denylist.txt")
+	if err := ioutil.WriteFile(file, []byte("# abusive\n198.51.100.0/24\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Register(ctx, config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"deny":            []interface{}{"203.0.113.0/24"},
+		"trusted_proxies": []interface{}{"10.0.0.1"},
+		"deny_file":       file,
+		"reload_interval": "10ms",
+	}}}, logging.NoOp)
+	defer func() {
+		current.mu.Lock()
+		current.service, current.resolver, current.denyFile = nil, Resolver{}, nil
+		current.mu.Unlock()
+	}()
+
+	gin.SetMode(gin.TestMode)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	}, logging.NoOp)
+	engine := gin.New()
+	engine.GET("/public", hf(&config.EndpointConfig{Endpoint: "/public"}, proxy.NoopProxy))
+	engine.GET("/admin", hf(&config.EndpointConfig{
+		Endpoint:    "/admin",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"allow": []interface{}{"192.168.10.0/24"}}},
+	}, proxy.NoopProxy))
+
+	do := func(path, xff string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(defaultHeader, xff)
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w.Code
+	}
+	for i, tc := range []struct {
+		path   string
+		xff    string
+		status int
+	}{
+		{path: "/public", xff: "1.1.1.1", status: http.StatusOK},
+		{path: "/public", xff: "203.0.113.9", status: http.StatusForbidden},
+		{path: "/public", xff: "198.51.100.9", status: http.StatusForbidden},
+		{path: "/admin", xff: "1.1.1.1", status: http.StatusForbidden},
+		{path: "/admin", xff: "192.168.10.20", status: http.StatusOK},
+		{path: "/admin", xff: "192.168.10.20, 1.1.1.1", status: http.StatusForbidden},
+	} {
+		if code := do(tc.path, tc.xff); code != tc.status {
+			t.Errorf("#%d: unexpected status code %d", i, code)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte("1.1.1.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Second)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for do("/public", "1.1.1.1") != http.StatusForbidden {
+		if time.Now().After(deadline) {
+			t.Fatal("deny file not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := do("/public", "198.51.100.9"); code != http.StatusOK {
+		t.Errorf("unexpected status code %d after the reload", code)
+	}
+}
+
+func TestHandlerFactory_invalidConfig(t *testing.T) {
+	defer func() {
+		current.mu.Lock()
+		current.service, current.resolver, current.denyFile = nil, Resolver{}, nil
+		current.mu.Unlock()
+	}()
+
+	gin.SetMode(gin.TestMode)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	}, logging.NoOp)
+	do := func(remote *config.EndpointConfig) int {
+		engine := gin.New()
+		engine.GET("/", hf(remote, proxy.NoopProxy))
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	invalid := config.ExtraConfig{Namespace: map[string]interface{}{"deny": []interface{}{"10.0.0.0/33"}}}
+	if code := do(&config.EndpointConfig{Endpoint: "/", ExtraConfig: invalid}); code != http.StatusForbidden {
+		t.Errorf("unexpected status code with an invalid endpoint config: %d", code)
+	}
+	Register(context.Background(), config.ServiceConfig{ExtraConfig: invalid}, logging.NoOp)
+	if code := do(&config.EndpointConfig{Endpoint: "/"}); code != http.StatusForbidden {
+		t.Errorf("unexpected status code with an invalid service config: %d", code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"deny": []interface{}{"10.0.0.0/33"}}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	cfg.ExtraConfig[Namespace] = map[string]interface{}{"deny_file": filepath.Join(t.TempDir(), "missing")}
+	if err := Validate(cfg); err == nil {
+		t.Error("missing deny file accepted")
+	}
+	for _, interval := range []string{"0s", "-1s"} {
+		cfg.ExtraConfig[Namespace] = map[string]interface{}{"reload_interval": interval}
+		if err := Validate(cfg); err == nil {
+			t.Errorf("reload interval %s accepted", interval)
+		}
+	}
+	cfg.ExtraConfig[Namespace] = map[string]interface{}{"trusted_proxies": []interface{}{"10.0.0.1", "::1"}}
+	cfg.Endpoints = []*config.EndpointConfig{{
+		Method:      "GET",
+		Endpoint:    "/a",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"allow": []interface{}{"localhost"}}},
+	}}
+	if err := Validate(cfg); err == nil {
+		t.Error("invalid IP accepted")
+	}
+	cfg.Endpoints[0].ExtraConfig[Namespace] = map[string]interface{}{"allow": []interface{}{"127.0.0.1", "fd00::/8"}}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+}
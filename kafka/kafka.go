@@ -0,0 +1,487 @@
+/*
+Package kafka provides a fire-and-forget backend publishing the request body as a Kafka record.
+
+The hosts of the backend, without scheme, are used as the bootstrap brokers. Sample backend config:
+
+	...
+	"host": [ "kafka-1.internal:9092", "kafka-2.internal:9092" ],
+	"url_pattern": "/",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/kafka": {
+			"topic": "analytics.{{.Params.Type}}",
+			"key": "{{.Claims.sub}}",
+			"headers": [ "X-Request-Id" ],
+			"partitioner": "murmur2",
+			"acks": "all",
+			"async": false,
+			"compression": "snappy",
+			"version": "2.1.0",
+			"batch": {
+				"max_messages": 500,
+				"max_bytes": 1048576,
+				"flush_frequency": "50ms"
+			}
+		}
+	},
+	...
+
+The topic and the key are Go templates rendered with the request data (see the internal tmpl
+package). The supported partitioners are "hash" (default), "murmur2" (compatible with the Java
+client), "random" and "roundrobin". The acks can be "all" (default), "leader" or "none", and the
+compression "none", "gzip", "snappy", "lz4" or "zstd".
+
+In sync mode the backend waits for the acknowledgement and returns the topic, partition and offset of
+the record. In async mode the record is queued in the producer and only the topic is returned. The
+response metadata always has a 202 status code and a JSON body, so endpoints using the no-op output
+encoding return a real 202 Accepted to the client.
+*/
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/devopsfaith/krakend-ce/internal/tmpl"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/kafka"
+
+var (
+	// ErrNoConfig is returned when the backend has no kafka config
+	ErrNoConfig = errors.New("kafka: no config")
+	// ErrNoTopic is returned when the config has no topic
+	ErrNoTopic = errors.New("kafka: no topic defined")
+	// ErrNoBrokers is returned when the backend has no hosts
+	ErrNoBrokers = errors.New("kafka: no brokers defined")
+)
+
+// Config is the custom config struct of the kafka backend
+type Config struct {
+	Topic       string      `json:"topic"`
+	Key         string      `json:"key"`
+	Headers     []string    `json:"headers"`
+	Partitioner string      `json:"partitioner"`
+	Acks        string      `json:"acks"`
+	Async       bool        `json:"async"`
+	Compression string      `json:"compression"`
+	Version     string      `json:"version"`
+	ClientID    string      `json:"client_id"`
+	Batch       BatchConfig `json:"batch"`
+}
+
+// BatchConfig contains the flush settings of the producer
+type BatchConfig struct {
+	MaxMessages    int    `json:"max_messages"`
+	MaxBytes       int    `json:"max_bytes"`
+	FlushFrequency string `json:"flush_frequency"`
+}
+
+// ConfigGetter parses the kafka config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Topic == "" {
+		return cfg, ErrNoTopic
+	}
+	return cfg, nil
+}
+
+// NewSaramaConfig translates the backend config into a producer config
+func NewSaramaConfig(cfg Config) (*sarama.Config, error) {
+	sc := sarama.NewConfig()
+	sc.ClientID = "krakend"
+	if cfg.ClientID != "" {
+		sc.ClientID = cfg.ClientID
+	}
+	if cfg.Version != "" {
+		v, err := sarama.ParseKafkaVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+		sc.Version = v
+	}
+
+	switch strings.ToLower(cfg.Acks) {
+	case "", "all":
+		sc.Producer.RequiredAcks = sarama.WaitForAll
+	case "leader":
+		sc.Producer.RequiredAcks = sarama.WaitForLocal
+	case "none":
+		sc.Producer.RequiredAcks = sarama.NoResponse
+	default:
+		return nil, fmt.Errorf("kafka: unknown acks %q", cfg.Acks)
+	}
+
+	switch strings.ToLower(cfg.Partitioner) {
+	case "", "hash":
+		sc.Producer.Partitioner = sarama.NewHashPartitioner
+	case "murmur2":
+		sc.Producer.Partitioner = sarama.NewReferenceHashPartitioner
+	case "random":
+		sc.Producer.Partitioner = sarama.NewRandomPartitioner
+	case "roundrobin":
+		sc.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	default:
+		return nil, fmt.Errorf("kafka: unknown partitioner %q", cfg.Partitioner)
+	}
+
+	switch strings.ToLower(cfg.Compression) {
+	case "", "none":
+		sc.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		sc.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		sc.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		sc.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		sc.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return nil, fmt.Errorf("kafka: unknown compression %q", cfg.Compression)
+	}
+
+	sc.Producer.Flush.Messages = cfg.Batch.MaxMessages
+	sc.Producer.Flush.Bytes = cfg.Batch.MaxBytes
+	if cfg.Batch.FlushFrequency != "" {
+		d, err := time.ParseDuration(cfg.Batch.FlushFrequency)
+		if err != nil {
+			return nil, err
+		}
+		sc.Producer.Flush.Frequency = d
+	}
+
+	sc.Producer.Return.Successes = !cfg.Async
+	sc.Producer.Return.Errors = true
+
+	return sc, sc.Validate()
+}
+
+// NewBackendFactory returns a backend factory creating kafka producer backends for the backends with
+// a kafka config and delegating the rest to the injected one. The producers are closed when the
+// context is done.
+func NewBackendFactory(ctx context.Context, logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return bf(remote)
+		}
+		if err == nil && len(remote.Host) == 0 {
+			err = ErrNoBrokers
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return bf(remote)
+		}
+
+		sc, err := NewSaramaConfig(cfg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] kafka: %s", remote.URLPattern, err.Error()))
+			return bf(remote)
+		}
+
+		addrs := brokers(remote.Host)
+		producer := &lazyProducer{new: func() (Producer, error) {
+			if cfg.Async {
+				return NewAsyncProducer(addrs, sc, logger)
+			}
+			return NewSyncProducer(addrs, sc)
+		}}
+		go func() {
+			<-ctx.Done()
+			producer.Close()
+		}()
+
+		p, err := NewProxy(producer, cfg)
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] kafka: %s", remote.URLPattern, err.Error()))
+			return bf(remote)
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] kafka producer for the topic %s", remote.URLPattern, cfg.Topic))
+		return p
+	}
+}
+
+// brokers returns the addresses of the hosts, without the http:// and https:// schemes added by their
+// sanitization
+func brokers(hosts []string) []string {
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		h = strings.TrimPrefix(strings.TrimPrefix(h, "http://"), "https://")
+		addrs[i] = strings.TrimSuffix(h, "/")
+	}
+	return addrs
+}
+
+// Validate checks the kafka configs of the backends of the service, so the invalid ones fail at startup
+// instead of falling back to the http backend
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil && len(b.Host) == 0 {
+				err = ErrNoBrokers
+			}
+			if err == nil {
+				_, err = NewSaramaConfig(c)
+			}
+			if err == nil {
+				_, _, err = parseTemplates(c)
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func parseTemplates(cfg Config) (*template.Template, *template.Template, error) {
+	topic, err := tmpl.Parse("topic", cfg.Topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	var key *template.Template
+	if cfg.Key != "" {
+		if key, err = tmpl.Parse("key", cfg.Key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return topic, key, nil
+}
+
+// NewProxy returns a proxy publishing the body of every request as a record
+func NewProxy(producer Producer, cfg Config) (proxy.Proxy, error) {
+	topic, key, err := parseTemplates(cfg)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		data := tmpl.FromRequest(r)
+		msg := &sarama.ProducerMessage{}
+
+		if msg.Topic, err = tmpl.Execute(topic, data); err != nil {
+			return nil, err
+		}
+		if key != nil {
+			k, err := tmpl.Execute(key, data)
+			if err != nil {
+				return nil, err
+			}
+			msg.Key = sarama.StringEncoder(k)
+		}
+		for _, h := range cfg.Headers {
+			if v, ok := data.Headers[http.CanonicalHeaderKey(h)]; ok {
+				msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(h), Value: []byte(v)})
+			}
+		}
+		if r.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			msg.Value = sarama.ByteEncoder(body)
+		}
+
+		ack, err := producer.Produce(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		res := map[string]interface{}{"topic": msg.Topic}
+		if !ack.Async {
+			res["partition"] = ack.Partition
+			res["offset"] = ack.Offset
+		}
+		b, _ := json.Marshal(res)
+		return &proxy.Response{
+			Data:       res,
+			IsComplete: true,
+			Metadata: proxy.Metadata{
+				StatusCode: http.StatusAccepted,
+				Headers:    map[string][]string{"Content-Type": {"application/json"}},
+			},
+			Io: bytes.NewReader(b),
+		}, nil
+	}, nil
+}
+
+// Ack is the acknowledgement of a published record. Async acks have no partition nor offset.
+type Ack struct {
+	Partition int32
+	Offset    int64
+	Async     bool
+}
+
+// Producer publishes records
+type Producer interface {
+	Produce(context.Context, *sarama.ProducerMessage) (Ack, error)
+	Close() error
+}
+
+// NewSyncProducer returns a producer waiting for the acknowledgement of every record
+func NewSyncProducer(brokers []string, cfg *sarama.Config) (Producer, error) {
+	p, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return SyncProducer{p}, nil
+}
+
+// SyncProducer adapts a sarama.SyncProducer to the Producer interface
+type SyncProducer struct {
+	sarama.SyncProducer
+}
+
+// Produce sends the message and waits for its acknowledgement or the cancellation of the context. A
+// canceled record may still be published.
+func (s SyncProducer) Produce(ctx context.Context, msg *sarama.ProducerMessage) (Ack, error) {
+	type result struct {
+		ack Ack
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		partition, offset, err := s.SendMessage(msg)
+		done <- result{Ack{Partition: partition, Offset: offset}, err}
+	}()
+	select {
+	case r := <-done:
+		return r.ack, r.err
+	case <-ctx.Done():
+		return Ack{}, ctx.Err()
+	}
+}
+
+// NewAsyncProducer returns a producer queueing the records. The delivery errors are logged.
+func NewAsyncProducer(brokers []string, cfg *sarama.Config, logger logging.Logger) (Producer, error) {
+	p, err := sarama.NewAsyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for err := range p.Errors() {
+			logger.Error("kafka: async delivery to", err.Msg.Topic, "failed:", err.Err.Error())
+		}
+	}()
+	return AsyncProducer{p}, nil
+}
+
+// AsyncProducer adapts a sarama.AsyncProducer to the Producer interface
+type AsyncProducer struct {
+	sarama.AsyncProducer
+}
+
+// Produce queues the message
+func (a AsyncProducer) Produce(ctx context.Context, msg *sarama.ProducerMessage) (Ack, error) {
+	select {
+	case a.Input() <- msg:
+		return Ack{Async: true}, nil
+	case <-ctx.Done():
+		return Ack{}, ctx.Err()
+	}
+}
+
+// lazyProducer creates the producer on its first use, so the gateway can start while the brokers are
+// unavailable. The creation runs outside the lock and is shared by the concurrent requests, which stop
+// waiting for it when their context is done. Failed creations are retried on the next request.
+type lazyProducer struct {
+	mu      sync.Mutex
+	new     func() (Producer, error)
+	p       Producer
+	dialing *dial
+	closed  bool
+}
+
+// dial is an in-flight creation of the producer. Its fields are set before closing the done channel.
+type dial struct {
+	done chan struct{}
+	p    Producer
+	err  error
+}
+
+func (l *lazyProducer) Produce(ctx context.Context, msg *sarama.ProducerMessage) (Ack, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return Ack{}, sarama.ErrClosedClient
+	}
+	p := l.p
+	d := l.dialing
+	if p == nil && d == nil {
+		d = &dial{done: make(chan struct{})}
+		l.dialing = d
+		go l.dial(d)
+	}
+	l.mu.Unlock()
+
+	if p == nil {
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return Ack{}, ctx.Err()
+		}
+		if d.err != nil {
+			return Ack{}, d.err
+		}
+		p = d.p
+	}
+	return p.Produce(ctx, msg)
+}
+
+func (l *lazyProducer) dial(d *dial) {
+	p, err := l.new()
+
+	l.mu.Lock()
+	l.dialing = nil
+	switch {
+	case err != nil:
+		d.err = err
+	case l.closed:
+		p.Close()
+		d.err = sarama.ErrClosedClient
+	default:
+		l.p = p
+		d.p = p
+	}
+	l.mu.Unlock()
+	close(d.done)
+}
+
+func (l *lazyProducer) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.p == nil {
+		return nil
+	}
+	return l.p.Close()
+}
@@ -0,0 +1,207 @@
+package kafka
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestNewProxy_sync(t *testing.T) {
+	cfg, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+		"topic":   "events.{{.Params.Type}}",
+		"key":     "{{.Claims.sub}}",
+		"headers": []interface{}{"X-Request-Id"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := NewSaramaConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mp := mocks.NewSyncProducer(t, sc)
+	mp.ExpectSendMessageWithCheckerFunctionAndSucceed(func(b []byte) error {
+		if string(b) != `{"event":"click"}` {
+			t.Errorf("unexpected value: %s", string(b))
+		}
+		return nil
+	})
+	defer mp.Close()
+
+	p, err := NewProxy(&checkingProducer{t: t, next: SyncProducer{mp}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gatewayClaims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1"}`))
+	resp, err := p(context.Background(), &proxy.Request{
+		Params:  map[string]string{"Type": "clicks"},
+		Headers: map[string][]string{"X-Gateway-Claims": {gatewayClaims}, "X-Request-Id": {"abc"}},
+		Body:    ioutil.NopCloser(strings.NewReader(`{"event":"click"}`)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Metadata.StatusCode != http.StatusAccepted || resp.Data["topic"] != "events.clicks" || resp.Data["offset"] != int64(1) {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	b, _ := ioutil.ReadAll(resp.Io)
+	if string(b) != `{"offset":1,"partition":0,"topic":"events.clicks"}` {
+		t.Errorf("unexpected body: %s", string(b))
+	}
+}
+
+func TestNewProxy_async(t *testing.T) {
+	cfg := Config{Topic: "events", Async: true}
+	sc, err := NewSaramaConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := mocks.NewAsyncProducer(t, sc)
+	mp.ExpectInputAndSucceed()
+	defer mp.Close()
+
+	p, err := NewProxy(AsyncProducer{mp}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p(context.Background(), &proxy.Request{Body: ioutil.NopCloser(strings.NewReader(`{}`))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.Data["offset"]; ok || resp.Data["topic"] != "events" {
+		t.Errorf("unexpected response: %+v", resp.Data)
+	}
+}
+
+func TestNewSaramaConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{Topic: "a", Acks: "some"},
+		{Topic: "a", Partitioner: "manual"},
+		{Topic: "a", Compression: "brotli"},
+		{Topic: "a", Compression: "zstd", Version: "1.0.0"},
+		{Topic: "a", Batch: BatchConfig{FlushFrequency: "soon"}},
+	} {
+		if _, err := NewSaramaConfig(cfg); err == nil {
+			t.Errorf("expecting error for %+v", cfg)
+		}
+	}
+}
+
+func TestBrokers(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Version: config.ConfigVersion,
+		Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/events",
+			Method:   "POST",
+			Backend: []*config.Backend{{
+				Host:        []string{"kafka-1.internal:9092", "kafka-2.internal:9092/"},
+				URLPattern:  "/",
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"topic": "events"}},
+			}},
+		}},
+	}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+	addrs := brokers(cfg.Endpoints[0].Backend[0].Host)
+	if len(addrs) != 2 || addrs[0] != "kafka-1.internal:9092" || addrs[1] != "kafka-2.internal:9092" {
+		t.Errorf("unexpected brokers %v", addrs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		host  []string
+		cfg   map[string]interface{}
+		valid bool
+	}{
+		"valid":            {host: []string{"kafka:9092"}, cfg: map[string]interface{}{"topic": "events.{{.Params.Type}}"}, valid: true},
+		"no brokers":       {cfg: map[string]interface{}{"topic": "events"}},
+		"no topic":         {host: []string{"kafka:9092"}, cfg: map[string]interface{}{"key": "a"}},
+		"invalid topic":    {host: []string{"kafka:9092"}, cfg: map[string]interface{}{"topic": "{{.Params.Type"}},
+		"invalid key":      {host: []string{"kafka:9092"}, cfg: map[string]interface{}{"topic": "events", "key": "{{.Claims.sub"}},
+		"invalid producer": {host: []string{"kafka:9092"}, cfg: map[string]interface{}{"topic": "events", "acks": "some"}},
+	} {
+		err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/foo",
+			Backend:  []*config.Backend{{URLPattern: "/bar", Host: tc.host, ExtraConfig: config.ExtraConfig{Namespace: tc.cfg}}},
+		}}})
+		if tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+func TestLazyProducer(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	mp := mocks.NewSyncProducer(t, nil)
+	mp.ExpectSendMessageAndSucceed()
+	mp.ExpectSendMessageAndSucceed()
+	l := &lazyProducer{new: func() (Producer, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, errors.New("brokers unavailable")
+		}
+		<-release
+		return SyncProducer{mp}, nil
+	}}
+	defer l.Close()
+
+	if _, err := l.Produce(context.Background(), &sarama.ProducerMessage{Topic: "a"}); err == nil {
+		t.Error("expecting the creation error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Produce(ctx, &sarama.ProducerMessage{Topic: "a"}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error while dialing: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := l.Produce(context.Background(), &sarama.ProducerMessage{Topic: "a"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(release)
+	wg.Wait()
+
+	if c := atomic.LoadInt32(&calls); c != 2 {
+		t.Errorf("unexpected number of creations: %d", c)
+	}
+}
+
+type checkingProducer struct {
+	t    *testing.T
+	next Producer
+}
+
+func (c *checkingProducer) Produce(ctx context.Context, msg *sarama.ProducerMessage) (Ack, error) {
+	if k, _ := msg.Key.Encode(); string(k) != "user-1" {
+		c.t.Errorf("unexpected key: %s", string(k))
+	}
+	if len(msg.Headers) != 1 || string(msg.Headers[0].Value) != "abc" {
+		c.t.Errorf("unexpected headers: %v", msg.Headers)
+	}
+	return c.next.Produce(ctx, msg)
+}
+
+func (c *checkingProducer) Close() error { return c.next.Close() }
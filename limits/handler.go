@@ -0,0 +1,137 @@
+package limits
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/devopsfaith/krakend-ce/internal/httpserver"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// NewRunServer returns a RunServerFunc applying the timeouts and the max header size of the limits
+// config, if declared, to the servers started by the injected one and the rest of the limits to every
+// request. The max header size is applied by the httpserver RunServer only.
+func NewRunServer(l logging.Logger, next router.RunServerFunc) router.RunServerFunc {
+	return func(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+		lcfg, err := ServiceConfigGetter(cfg.ExtraConfig)
+		if err == ErrNoConfig {
+			return next(ctx, cfg, handler)
+		}
+		if err != nil {
+			return err
+		}
+		if lcfg.readHeaderTimeout > 0 {
+			cfg.ReadHeaderTimeout = lcfg.readHeaderTimeout
+		}
+		if cfg.ReadHeaderTimeout == 0 {
+			cfg.ReadHeaderTimeout = defaultReadHeaderTimeout
+		}
+		if lcfg.readTimeout > 0 {
+			cfg.ReadTimeout = lcfg.readTimeout
+		}
+		if lcfg.idleTimeout > 0 {
+			cfg.IdleTimeout = lcfg.idleTimeout
+		}
+		if lcfg.MinTransferRate > 0 && cfg.ReadTimeout == 0 {
+			return ErrNoReadTimeout
+		}
+		if lcfg.MaxHeaderSize > 0 {
+			// the server stops reading the oversized headers, while the handler rejects them with a 431
+			ctx = httpserver.WithOptions(ctx, httpserver.MaxHeaderBytes(lcfg.MaxHeaderSize))
+		}
+		l.Debug(fmt.Sprintf("limits: body %d, headers %d, read header timeout %s, read timeout %s, idle timeout %s, min transfer rate %d",
+			lcfg.MaxBodySize, lcfg.MaxHeaderSize, cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.IdleTimeout, lcfg.MinTransferRate))
+		return next(ctx, cfg, Handler(lcfg, handler))
+	}
+}
+
+// Handler rejects the requests over the size limits of the service and guards the reading of their
+// bodies
+func Handler(cfg ServiceConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.MaxHeaderSize > 0 && headerSize(r) > cfg.MaxHeaderSize {
+			http.Error(w, http.StatusText(http.StatusRequestHeaderFieldsTooLarge), http.StatusRequestHeaderFieldsTooLarge)
+			return
+		}
+		if cfg.MinTransferRate > 0 && r.Body != nil && r.Body != http.NoBody {
+			r.Body = newRateReader(r.Body, cfg.MinTransferRate, cfg.grace)
+		}
+		if status := limitBody(w, r, cfg.MaxBodySize); status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandlerFactory returns a handler factory rejecting the requests over the size limits of the
+// endpoints with a limits config
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return handlerFunc
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			// the endpoint can not be exposed without its limits
+			return func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] limits: body %d, headers %d", remote.Endpoint, cfg.MaxBodySize, cfg.MaxHeaderSize))
+		return func(c *gin.Context) {
+			if cfg.MaxHeaderSize > 0 && headerSize(c.Request) > cfg.MaxHeaderSize {
+				c.AbortWithStatus(http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+			if status := cfg.limitBody(c); status != 0 {
+				c.AbortWithStatus(status)
+				return
+			}
+			handlerFunc(c)
+		}
+	}
+}
+
+func (c Config) limitBody(ctx *gin.Context) int {
+	return limitBody(ctx.Writer, ctx.Request, c.MaxBodySize)
+}
+
+// limitBody limits the body of the request to max bytes, reading it in advance when its size is
+// unknown, and returns the status to reject the request with, if any
+func limitBody(w http.ResponseWriter, r *http.Request, max int64) int {
+	if max == 0 || r.Body == nil || r.Body == http.NoBody {
+		return 0
+	}
+	if r.ContentLength > max {
+		return http.StatusRequestEntityTooLarge
+	}
+	if r.ContentLength >= 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		return 0
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	switch {
+	case err == ErrTooSlow:
+		return http.StatusRequestTimeout
+	case int64(len(b)) > max, err != nil && int64(len(b)) == max:
+		// the service limit can be the one cutting the body
+		return http.StatusRequestEntityTooLarge
+	case err != nil:
+		return http.StatusBadRequest
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	return 0
+}
@@ -0,0 +1,219 @@
+/*
+Package limits protects the gateway from oversized requests and slow clients.
+
+The service config applies to every request received by the gateway:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/limits": {
+			"max_body_size": 1048576,
+			"max_header_size": 16384,
+			"read_header_timeout": "5s",
+			"read_timeout": "30s",
+			"idle_timeout": "60s",
+			"min_transfer_rate": 1024,
+			"min_transfer_grace": "5s"
+		}
+	}
+
+The requests whose headers (including the request line) exceed max_header_size bytes are rejected
+with a 431 and the ones whose body exceeds max_body_size bytes with a 413. The max_header_size is set
+as the MaxHeaderBytes of the servers as well, so the oversized headers are not read in full. The bodies
+without a Content-Length are read in advance, up to the limit, so the oversized ones are rejected with
+a 413 as well, and the ones failing the transfer rate with a 408.
+
+The timeouts replace the ones of the service (read_header_timeout defaults to 10s when none is
+declared) and apply to every listener, including the client certificate one. Since a slow client can
+keep a request open for the whole read_timeout sending a few bytes at a time, the bodies sent below
+min_transfer_rate bytes per second once the min_transfer_grace period (5s by default) is over fail to
+be read as well. The rate is checked as the data arrives, so a client sending nothing at all is only
+stopped by the read_timeout, which is required with a min_transfer_rate.
+
+The endpoints can lower the size limits of the service:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/limits": {
+			"max_body_size": 4096
+		}
+	}
+
+The bodies of the endpoints with a limit and without a Content-Length are read in advance, up to the
+limit of the endpoint, as the service ones.
+*/
+package limits
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/luraproject/lura/config"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/limits"
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultGrace             = 5 * time.Second
+)
+
+var (
+	// ErrNoConfig is returned when there is no limits config
+	ErrNoConfig = errors.New("limits: no config")
+	// ErrTooSlow is returned when the body is sent below the minimum transfer rate
+	ErrTooSlow = errors.New("limits: request body sent below the minimum transfer rate")
+	// ErrNoReadTimeout is returned when a minimum transfer rate is declared without a read timeout
+	ErrNoReadTimeout = errors.New("limits: the min_transfer_rate requires a read_timeout")
+)
+
+// ServiceConfig is the custom config struct of the limits of the service
+type ServiceConfig struct {
+	Config
+	ReadHeaderTimeout string `json:"read_header_timeout"`
+	ReadTimeout       string `json:"read_timeout"`
+	IdleTimeout       string `json:"idle_timeout"`
+	MinTransferRate   int64  `json:"min_transfer_rate"`
+	MinTransferGrace  string `json:"min_transfer_grace"`
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	idleTimeout       time.Duration
+	grace             time.Duration
+}
+
+// Config is the custom config struct of the size limits of the endpoints
+type Config struct {
+	MaxBodySize   int64 `json:"max_body_size"`
+	MaxHeaderSize int   `json:"max_header_size"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the limits config of the service
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Config.validate(); err != nil {
+		return cfg, err
+	}
+	if cfg.MinTransferRate < 0 {
+		return cfg, errors.New("limits: negative min_transfer_rate")
+	}
+	cfg.grace = defaultGrace
+	for _, d := range []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{cfg.ReadHeaderTimeout, &cfg.readHeaderTimeout},
+		{cfg.ReadTimeout, &cfg.readTimeout},
+		{cfg.IdleTimeout, &cfg.idleTimeout},
+		{cfg.MinTransferGrace, &cfg.grace},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return cfg, fmt.Errorf("limits: %s", err.Error())
+		}
+		*d.dst = v
+	}
+	return cfg, nil
+}
+
+// ConfigGetter parses the size limits of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	if c.MaxBodySize < 0 || c.MaxHeaderSize < 0 {
+		return errors.New("limits: negative size")
+	}
+	return nil
+}
+
+// Validate checks the limits of the service and the ones of every endpoint, which can not be over the
+// service ones
+func Validate(cfg config.ServiceConfig) error {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	if service.MinTransferRate > 0 && service.readTimeout == 0 && cfg.ReadTimeout == 0 {
+		return ErrNoReadTimeout
+	}
+	for _, e := range cfg.Endpoints {
+		c, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil && (exceeds(c.MaxBodySize, service.MaxBodySize) || exceeds(int64(c.MaxHeaderSize), int64(service.MaxHeaderSize))) {
+			err = errors.New("limits: the endpoint limits can not be over the service ones")
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+func exceeds(v, max int64) bool {
+	return max > 0 && v > max
+}
+
+// headerSize returns the size of the request line and the headers of the request
+func headerSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for k, vs := range r.Header {
+		for _, v := range vs {
+			size += len(k) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// rateReader fails when the body is read below the minimum transfer rate once the grace period is over.
+// The rate is only checked when the reads return, so the stalled clients are bounded by the read timeout.
+type rateReader struct {
+	io.ReadCloser
+	min   float64
+	grace time.Duration
+	start time.Time
+	read  int64
+}
+
+func newRateReader(body io.ReadCloser, min int64, grace time.Duration) *rateReader {
+	return &rateReader{ReadCloser: body, min: float64(min), grace: grace, start: time.Now()}
+}
+
+func (r *rateReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if elapsed := time.Since(r.start); elapsed > r.grace && float64(r.read)/elapsed.Seconds() < r.min {
+		return n, ErrTooSlow
+	}
+	return n, nil
+}
@@ -0,0 +1,155 @@
+package limits
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/httpserver"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func newRequest(body string, contentLength int64) *http.Request {
+	req := httptest.NewRequest("POST", "/orders", strings.NewReader(body))
+	req.ContentLength = contentLength
+	return req
+}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(b)
+}
+
+func TestNewRunServer(t *testing.T) {
+	var got config.ServiceConfig
+	var h http.Handler
+	s := &http.Server{}
+	rs := NewRunServer(logging.NoOp, func(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+		got, h = cfg, handler
+		for _, opt := range httpserver.Options(ctx) {
+			opt(s)
+		}
+		return nil
+	})
+	err := rs(context.Background(), config.ServiceConfig{
+		IdleTimeout: time.Minute,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"max_body_size":   10,
+			"max_header_size": 100,
+			"read_timeout":    "30s",
+		}},
+	}, http.HandlerFunc(echo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ReadHeaderTimeout != defaultReadHeaderTimeout || got.ReadTimeout != 30*time.Second || got.IdleTimeout != time.Minute {
+		t.Errorf("unexpected timeouts %s %s %s", got.ReadHeaderTimeout, got.ReadTimeout, got.IdleTimeout)
+	}
+	if s.MaxHeaderBytes != 100 {
+		t.Errorf("unexpected max header bytes %d", s.MaxHeaderBytes)
+	}
+
+	large := newRequest("", 0)
+	large.Header.Set("X-Large", strings.Repeat("a", 100))
+	for i, tc := range []struct {
+		req    *http.Request
+		status int
+	}{
+		{req: large, status: http.StatusRequestHeaderFieldsTooLarge},
+		{req: newRequest("0123456789a", 11), status: http.StatusRequestEntityTooLarge},
+		{req: newRequest("0123456789a", -1), status: http.StatusRequestEntityTooLarge},
+		{req: newRequest("0123456789", -1), status: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, tc.req)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code %d", i, w.Code)
+		}
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { echo(c.Writer, c.Request) }
+	}, logging.NoOp)
+	engine := gin.New()
+	engine.POST("/orders", hf(&config.EndpointConfig{
+		Endpoint:    "/orders",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"max_body_size": 4}},
+	}, proxy.NoopProxy))
+
+	for i, tc := range []struct {
+		req    *http.Request
+		status int
+		body   string
+	}{
+		{req: newRequest("0123", 4), status: http.StatusOK, body: "0123"},
+		{req: newRequest("0123", -1), status: http.StatusOK, body: "0123"},
+		{req: newRequest("01234", 5), status: http.StatusRequestEntityTooLarge},
+		{req: newRequest("01234", -1), status: http.StatusRequestEntityTooLarge},
+	} {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, tc.req)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code %d", i, w.Code)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("#%d: unexpected body %s", i, w.Body.String())
+		}
+	}
+
+	slow := newRequest("0123", -1)
+	slow.Body = newRateReader(slow.Body, 1e12, 0)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, slow)
+	if w.Code != http.StatusRequestTimeout {
+		t.Errorf("unexpected status code %d for a slow client", w.Code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"max_body_size": 100, "read_timeout": "30"}},
+		Endpoints: []*config.EndpointConfig{{
+			Method:      "POST",
+			Endpoint:    "/a",
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"max_header_size": 1000}},
+		}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("invalid timeout accepted")
+	}
+	cfg.ExtraConfig[Namespace] = map[string]interface{}{"max_body_size": 100}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Endpoints[0].ExtraConfig[Namespace] = map[string]interface{}{"max_body_size": 1000}
+	if err := Validate(cfg); err == nil {
+		t.Error("endpoint limit over the service one accepted")
+	}
+	cfg.Endpoints[0].ExtraConfig[Namespace] = map[string]interface{}{"max_body_size": -1}
+	if err := Validate(cfg); err == nil {
+		t.Error("negative limit accepted")
+	}
+	cfg.Endpoints = nil
+	cfg.ExtraConfig[Namespace] = map[string]interface{}{"min_transfer_rate": 1024}
+	if err := Validate(cfg); err != ErrNoReadTimeout {
+		t.Errorf("min transfer rate accepted without read timeout: %v", err)
+	}
+	cfg.ReadTimeout = time.Minute
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,146 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathMatcher checks if a dot-separated path is covered by any of the ignored paths. A "*" segment
+// matches any key or index.
+type pathMatcher [][]string
+
+func newPathMatcher(paths []string) pathMatcher {
+	m := make(pathMatcher, 0, len(paths))
+	for _, p := range paths {
+		if p = strings.Trim(p, "."); p != "" {
+			m = append(m, strings.Split(p, "."))
+		}
+	}
+	return m
+}
+
+func (m pathMatcher) Match(path string) bool {
+	if len(m) == 0 || path == "" {
+		return false
+	}
+	segments := strings.Split(path, ".")
+	for _, pattern := range m {
+		if len(pattern) > len(segments) {
+			continue
+		}
+		matched := true
+		for i, s := range pattern {
+			if s != "*" && s != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// diffData returns a human readable list of the differences between the two received values
+func diffData(path string, a, b interface{}, ignore pathMatcher) []string {
+	if ignore.Match(path) {
+		return nil
+	}
+
+	switch ta := a.(type) {
+	case map[string]interface{}:
+		tb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(ta)+len(tb))
+		for k := range ta {
+			keys = append(keys, k)
+		}
+		for k := range tb {
+			if _, ok := ta[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		diffs := []string{}
+		for _, k := range keys {
+			va, okA := ta[k]
+			vb, okB := tb[k]
+			p := join(path, k)
+			switch {
+			case ignore.Match(p):
+			case !okA:
+				diffs = append(diffs, fmt.Sprintf("%s: missing in primary", p))
+			case !okB:
+				diffs = append(diffs, fmt.Sprintf("%s: missing in shadow", p))
+			default:
+				diffs = append(diffs, diffData(p, va, vb, ignore)...)
+			}
+		}
+		return diffs
+
+	case []interface{}:
+		tb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		diffs := []string{}
+		if len(ta) != len(tb) {
+			diffs = append(diffs, fmt.Sprintf("%s: length %d != %d", displayPath(path), len(ta), len(tb)))
+		}
+		for i := 0; i < len(ta) && i < len(tb); i++ {
+			diffs = append(diffs, diffData(join(path, strconv.Itoa(i)), ta[i], tb[i], ignore)...)
+		}
+		return diffs
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s != %s", displayPath(path), encode(a), encode(b))}
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "body"
+	}
+	return path
+}
+
+func encode(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	if len(b) > 128 {
+		return string(b[:128]) + "..."
+	}
+	return string(b)
+}
+
+func header(headers map[string][]string, name string) string {
+	if vs, ok := headers[http.CanonicalHeaderKey(name)]; ok {
+		return strings.Join(vs, ", ")
+	}
+	for k, vs := range headers {
+		if strings.EqualFold(k, name) {
+			return strings.Join(vs, ", ")
+		}
+	}
+	return ""
+}
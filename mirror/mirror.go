@@ -0,0 +1,369 @@
+/*
+Package mirror provides a shadow proxy factory able to compare the responses of the shadow backends
+with the ones returned by the primary backends.
+
+Without a comparison config, it behaves exactly as the lura shadow factory: the responses of the
+backends flagged as shadow are discarded. Sample endpoint extra config enabling the comparison:
+
+	...
+	"extra_config": {
+		...
+		"github.com/devopsfaith/krakend-ce/mirror": {
+			"headers": [ "Content-Type", "X-Version" ],
+			"ignore_paths": [ "meta.generated_at", "items.*.updated_at" ],
+			"sample_rate": 10,
+			"max_diffs": 20,
+			"sink": "file",
+			"path": "/var/log/krakend/mirror.log"
+		},
+		...
+	},
+	...
+
+The comparison always runs in background, once both responses are available, so it never affects
+the client response. Every comparison updates the counters mirror.<endpoint>.total, .match,
+.mismatch and .shadow_error of the metrics registry. The "sample_rate" (percentage, 100 by default)
+controls how many mismatches are written to the sink ("log" by default, or "file").
+*/
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/mirror"
+
+// ErrNoConfig is returned when the endpoint has no comparison config
+var ErrNoConfig = errors.New("mirror: no config")
+
+const shadowKey = "shadow"
+
+// Config is the custom config struct containing the comparison options
+type Config struct {
+	Headers      []string `json:"headers"`
+	IgnorePaths  []string `json:"ignore_paths"`
+	IgnoreStatus bool     `json:"ignore_status"`
+	SampleRate   *float64 `json:"sample_rate"`
+	MaxDiffs     int      `json:"max_diffs"`
+	Sink         string   `json:"sink"`
+	Path         string   `json:"path"`
+}
+
+// ConfigGetter parses the comparison config of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxDiffs <= 0 {
+		cfg.MaxDiffs = 20
+	}
+	return cfg, nil
+}
+
+// Validate checks the comparison config of every endpoint of the service config, returning the first
+// error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		c, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil && c.SampleRate != nil && (*c.SampleRate < 0 || *c.SampleRate > 100) {
+			err = errors.New("the sample rate must be between 0 and 100")
+		}
+		if err == nil {
+			err = validateSink(c)
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: mirror: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// NewShadowFactory returns a proxy factory splitting the backends of the endpoint into regular and
+// shadow ones. The responses of the shadow backends are compared with the regular ones if the
+// endpoint has a comparison config and discarded otherwise.
+func NewShadowFactory(f proxy.Factory, logger logging.Logger, registry gometrics.Registry) proxy.Factory {
+	if registry == nil {
+		registry = gometrics.NewRegistry()
+	}
+	return shadowFactory{f: f, logger: logger, registry: registry}
+}
+
+type shadowFactory struct {
+	f        proxy.Factory
+	logger   logging.Logger
+	registry gometrics.Registry
+}
+
+func (s shadowFactory) New(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+	if len(cfg.Backend) == 0 {
+		return proxy.NoopProxy, proxy.ErrNoBackends
+	}
+
+	shadow := []*config.Backend{}
+	regular := []*config.Backend{}
+	for _, b := range cfg.Backend {
+		if isShadowBackend(b) {
+			shadow = append(shadow, b)
+			continue
+		}
+		regular = append(regular, b)
+	}
+
+	cfg.Backend = regular
+	p, err := s.f.New(cfg)
+	if len(shadow) == 0 {
+		return p, err
+	}
+
+	cfg.Backend = shadow
+	pShadow, _ := s.f.New(cfg)
+
+	mirrorCfg, cfgErr := ConfigGetter(cfg.ExtraConfig)
+	if cfgErr != nil {
+		if cfgErr != ErrNoConfig {
+			s.logger.Error(fmt.Sprintf("[ENDPOINT: %s] mirror: %s", cfg.Endpoint, cfgErr.Error()))
+		}
+		return proxy.ShadowMiddleware(p, pShadow), err
+	}
+
+	sink, sinkErr := newSink(mirrorCfg, s.logger)
+	if sinkErr != nil {
+		s.logger.Error(fmt.Sprintf("[ENDPOINT: %s] mirror: %s", cfg.Endpoint, sinkErr.Error()))
+		return proxy.ShadowMiddleware(p, pShadow), err
+	}
+
+	c := &comparator{
+		endpoint: cfg.Endpoint,
+		cfg:      mirrorCfg,
+		ignore:   newPathMatcher(mirrorCfg.IgnorePaths),
+		sink:     sink,
+		metrics:  newCounters(s.registry, cfg.Endpoint),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	return NewComparingProxy(p, pShadow, c.Compare, cfg.Timeout), err
+}
+
+// CompareFunc receives the results of the primary and shadow proxies
+type CompareFunc func(primary, shadow Result)
+
+// Result groups the response and the error returned by a proxy
+type Result struct {
+	Response *proxy.Response
+	Err      error
+}
+
+// NewComparingProxy returns a proxy that sends requests to p1 and p2 and returns the response of p1.
+// Once both responses are available, they are passed to the compare function in background.
+func NewComparingProxy(p1, p2 proxy.Proxy, compare CompareFunc, timeout time.Duration) proxy.Proxy {
+	return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+		shadowCh := make(chan Result, 1)
+		shadowReq := proxy.CloneRequest(request)
+		go func() {
+			sctx, cancel := newDetachedContext(ctx, timeout)
+			defer cancel()
+			resp, err := p2(sctx, shadowReq)
+			shadowCh <- Result{Response: snapshot(resp), Err: err}
+		}()
+
+		resp, err := p1(ctx, request)
+		primary := Result{Response: snapshot(resp), Err: err}
+		go func() {
+			compare(primary, <-shadowCh)
+		}()
+		return resp, err
+	}
+}
+
+// snapshot copies the response so the comparison is not affected by the proxy layers modifying the
+// data of the primary response after its return
+func snapshot(r *proxy.Response) *proxy.Response {
+	if r == nil {
+		return nil
+	}
+	headers := make(map[string][]string, len(r.Metadata.Headers))
+	for k, vs := range r.Metadata.Headers {
+		headers[k] = append([]string{}, vs...)
+	}
+	data, _ := deepCopy(r.Data).(map[string]interface{})
+	return &proxy.Response{
+		Data:       data,
+		IsComplete: r.IsComplete,
+		Metadata:   proxy.Metadata{Headers: headers, StatusCode: r.Metadata.StatusCode},
+	}
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			res[k] = deepCopy(e)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, e := range t {
+			res[i] = deepCopy(e)
+		}
+		return res
+	}
+	return v
+}
+
+// detachedContext keeps the values of the request context but it is not canceled with it
+type detachedContext struct {
+	context.Context
+	data context.Context
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.data.Value(key)
+}
+
+func newDetachedContext(data context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := detachedContext{Context: context.Background(), data: data}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func isShadowBackend(c *config.Backend) bool {
+	v, ok := c.ExtraConfig[proxy.Namespace]
+	if !ok {
+		return false
+	}
+	e, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	b, ok := e[shadowKey].(bool)
+	return ok && b
+}
+
+type counters struct {
+	total, match, mismatch, shadowError gometrics.Counter
+}
+
+func newCounters(r gometrics.Registry, endpoint string) counters {
+	prefix := "mirror." + endpoint + "."
+	return counters{
+		total:       gometrics.GetOrRegisterCounter(prefix+"total", r),
+		match:       gometrics.GetOrRegisterCounter(prefix+"match", r),
+		mismatch:    gometrics.GetOrRegisterCounter(prefix+"mismatch", r),
+		shadowError: gometrics.GetOrRegisterCounter(prefix+"shadow_error", r),
+	}
+}
+
+type comparator struct {
+	endpoint string
+	cfg      Config
+	ignore   pathMatcher
+	sink     Sink
+	metrics  counters
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// Compare diffs the received results and records the outcome
+func (c *comparator) Compare(primary, shadow Result) {
+	c.metrics.total.Inc(1)
+	if shadow.Err != nil && primary.Err == nil {
+		c.metrics.shadowError.Inc(1)
+	}
+
+	diffs := c.diff(primary, shadow)
+	if len(diffs) == 0 {
+		c.metrics.match.Inc(1)
+		return
+	}
+	c.metrics.mismatch.Inc(1)
+
+	if !c.sampled() {
+		return
+	}
+	if len(diffs) > c.cfg.MaxDiffs {
+		diffs = diffs[:c.cfg.MaxDiffs]
+	}
+	c.sink.Write(Record{
+		Time:     time.Now(),
+		Endpoint: c.endpoint,
+		Diffs:    diffs,
+	})
+}
+
+func (c *comparator) sampled() bool {
+	if c.cfg.SampleRate == nil {
+		return true
+	}
+	c.mu.Lock()
+	v := c.rand.Float64() * 100
+	c.mu.Unlock()
+	return v < *c.cfg.SampleRate
+}
+
+func (c *comparator) diff(primary, shadow Result) []string {
+	diffs := []string{}
+	if (primary.Err == nil) != (shadow.Err == nil) {
+		diffs = append(diffs, fmt.Sprintf("error: %s != %s", errString(primary.Err), errString(shadow.Err)))
+	}
+
+	p, s := primary.Response, shadow.Response
+	if p == nil || s == nil {
+		if (p == nil) != (s == nil) {
+			diffs = append(diffs, fmt.Sprintf("response: %s != %s", nilString(p), nilString(s)))
+		}
+		return diffs
+	}
+
+	if !c.cfg.IgnoreStatus && p.Metadata.StatusCode != s.Metadata.StatusCode {
+		diffs = append(diffs, fmt.Sprintf("status: %d != %d", p.Metadata.StatusCode, s.Metadata.StatusCode))
+	}
+	for _, h := range c.cfg.Headers {
+		pv, sv := header(p.Metadata.Headers, h), header(s.Metadata.Headers, h)
+		if pv != sv {
+			diffs = append(diffs, fmt.Sprintf("header %s: %q != %q", h, pv, sv))
+		}
+	}
+	return append(diffs, diffData("", p.Data, s.Data, c.ignore)...)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return "<nil>"
+	}
+	return err.Error()
+}
+
+func nilString(r *proxy.Response) string {
+	if r == nil {
+		return "<nil>"
+	}
+	return "<response>"
+}
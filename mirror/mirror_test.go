@@ -0,0 +1,170 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func TestDiffData(t *testing.T) {
+	a := map[string]interface{}{
+		"id":   1.0,
+		"meta": map[string]interface{}{"generated_at": "now"},
+		"items": []interface{}{
+			map[string]interface{}{"name": "a", "updated_at": "1"},
+			map[string]interface{}{"name": "b", "updated_at": "2"},
+		},
+		"only_primary": true,
+	}
+	b := map[string]interface{}{
+		"id":   1.0,
+		"meta": map[string]interface{}{"generated_at": "later"},
+		"items": []interface{}{
+			map[string]interface{}{"name": "a", "updated_at": "3"},
+			map[string]interface{}{"name": "c", "updated_at": "4"},
+		},
+	}
+	diffs := diffData("", a, b, newPathMatcher([]string{"meta.generated_at", "items.*.updated_at"}))
+	expected := []string{
+		`items.1.name: "b" != "c"`,
+		`only_primary: missing in shadow`,
+	}
+	if strings.Join(diffs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected diffs: %v", diffs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg   map[string]interface{}
+		valid bool
+	}{
+		"log":               {cfg: map[string]interface{}{"sample_rate": 50}, valid: true},
+		"file":              {cfg: map[string]interface{}{"sink": "file", "path": "/tmp/mirror.log"}, valid: true},
+		"file without path": {cfg: map[string]interface{}{"sink": "file"}},
+		"unknown sink":      {cfg: map[string]interface{}{"sink": "kafka"}},
+		"sample rate":       {cfg: map[string]interface{}{"sample_rate": 150}},
+	} {
+		err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint:    "/foo",
+			ExtraConfig: config.ExtraConfig{Namespace: tc.cfg},
+		}}})
+		if tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
+
+type recordingSink chan Record
+
+func (s recordingSink) Write(r Record) { s <- r }
+
+func TestNewShadowFactory(t *testing.T) {
+	pf := proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		name := cfg.Backend[0].URLPattern
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if name == "/v2" {
+				return &proxy.Response{
+					Data:     map[string]interface{}{"version": 2.0},
+					Metadata: proxy.Metadata{StatusCode: 201},
+				}, nil
+			}
+			return &proxy.Response{
+				Data:     map[string]interface{}{"version": 1.0},
+				Metadata: proxy.Metadata{StatusCode: 200},
+			}, nil
+		}, nil
+	})
+
+	p, err := NewShadowFactory(pf, logging.NoOp, gometrics.NewRegistry()).New(&config.EndpointConfig{
+		Endpoint: "/foo",
+		Timeout:  time.Second,
+		Backend: []*config.Backend{
+			{URLPattern: "/v1"},
+			{URLPattern: "/v2", ExtraConfig: config.ExtraConfig{proxy.Namespace: map[string]interface{}{"shadow": true}}},
+		},
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"sink": "log"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := p(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["version"] != 1.0 {
+		t.Errorf("unexpected response: %v", resp.Data)
+	}
+}
+
+func TestComparator(t *testing.T) {
+	registry := gometrics.NewRegistry()
+	sink := make(recordingSink, 1)
+	c := &comparator{endpoint: "/foo", cfg: Config{MaxDiffs: 10}, sink: sink, metrics: newCounters(registry, "/foo")}
+	p := NewComparingProxy(
+		func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{
+				Data:     map[string]interface{}{"version": 1.0},
+				Metadata: proxy.Metadata{StatusCode: 200},
+			}, nil
+		},
+		func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{
+				Data:     map[string]interface{}{"version": 2.0},
+				Metadata: proxy.Metadata{StatusCode: 201},
+			}, nil
+		},
+		c.Compare,
+		time.Second,
+	)
+
+	resp, err := p(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["version"] != 1.0 {
+		t.Errorf("unexpected response: %v", resp.Data)
+	}
+
+	select {
+	case r := <-sink:
+		if len(r.Diffs) != 2 || r.Diffs[0] != "status: 200 != 201" || r.Diffs[1] != "version: 1 != 2" {
+			t.Errorf("unexpected diffs: %v", r.Diffs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the comparison")
+	}
+
+	if v := gometrics.GetOrRegisterCounter("mirror./foo.mismatch", registry).Count(); v != 1 {
+		t.Errorf("unexpected mismatch count: %d", v)
+	}
+}
+
+func TestNewComparingProxy_shadowError(t *testing.T) {
+	done := make(chan []string, 1)
+	c := &comparator{cfg: Config{MaxDiffs: 10}, metrics: newCounters(gometrics.NewRegistry(), "/bar")}
+	p := NewComparingProxy(
+		func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: map[string]interface{}{"a": 1}}, nil
+		},
+		func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return nil, errors.New("boom")
+		},
+		func(primary, shadow Result) { done <- c.diff(primary, shadow) },
+		time.Second,
+	)
+	if _, err := p(context.Background(), &proxy.Request{}); err != nil {
+		t.Fatal(err)
+	}
+	diffs := <-done
+	if len(diffs) != 2 || diffs[0] != "error: <nil> != boom" {
+		t.Errorf("unexpected diffs: %v", diffs)
+	}
+}
@@ -0,0 +1,98 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+)
+
+// Record is a sampled mismatch between a primary and a shadow response
+type Record struct {
+	Time     time.Time `json:"time"`
+	Endpoint string    `json:"endpoint"`
+	Diffs    []string  `json:"diffs"`
+}
+
+// Sink stores the sampled mismatches
+type Sink interface {
+	Write(Record)
+}
+
+func newSink(cfg Config, logger logging.Logger) (Sink, error) {
+	if err := validateSink(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Sink == "file" {
+		return openFileSink(cfg.Path, logger)
+	}
+	return logSink{logger}, nil
+}
+
+func validateSink(cfg Config) error {
+	switch cfg.Sink {
+	case "", "log":
+		return nil
+	case "file":
+		if cfg.Path == "" {
+			return errors.New("file sink without path")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown sink %q", cfg.Sink)
+}
+
+type logSink struct {
+	logger logging.Logger
+}
+
+func (l logSink) Write(r Record) {
+	b, _ := json.Marshal(r)
+	l.logger.Warning(fmt.Sprintf("[ENDPOINT: %s] mirror mismatch: %s", r.Endpoint, string(b)))
+}
+
+var (
+	fileSinksMu sync.Mutex
+	fileSinks   = map[string]*fileSink{}
+)
+
+// openFileSink returns the sink for the received path, sharing the file between all the endpoints
+// writing to it
+func openFileSink(path string, logger logging.Logger) (*fileSink, error) {
+	fileSinksMu.Lock()
+	defer fileSinksMu.Unlock()
+
+	if s, ok := fileSinks[path]; ok {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{f: f, logger: logger}
+	fileSinks[path] = s
+	return s, nil
+}
+
+type fileSink struct {
+	mu     sync.Mutex
+	f      *os.File
+	logger logging.Logger
+}
+
+func (s *fileSink) Write(r Record) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	_, err = s.f.Write(append(b, '\n'))
+	s.mu.Unlock()
+	if err != nil {
+		s.logger.Error("mirror: writing to the file sink:", err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+package mtls
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// HandlerFactory returns a handler factory allowing only the client certificates matching the rules
+// of the endpoints with a mtls config
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return handlerFunc
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			// the endpoint can not be exposed without its authentication
+			return func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] mtls: %d rules", remote.Endpoint, len(cfg.Allow)))
+		return func(c *gin.Context) {
+			cert := Certificate(c.Request)
+			if cert == nil {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			if !cfg.Allows(NewIdentity(cert)) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			handlerFunc(c)
+		}
+	}
+}
+
+// Allows tells if any rule matches the identity. An empty list allows every verified certificate.
+func (c Config) Allows(id Identity) bool {
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, r := range c.Allow {
+		if r.matches(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) matches(id Identity) bool {
+	if !match(r.Subject, id.Subject) || !match(r.CommonName, id.CommonName) || !match(r.SPIFFEID, id.SPIFFEID) {
+		return false
+	}
+	if r.SAN == "" {
+		return true
+	}
+	for _, san := range id.SANs {
+		if match(r.SAN, san) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
@@ -0,0 +1,341 @@
+/*
+Package mtls authenticates the callers with client certificates, verified against the declared CAs,
+and propagates their identity to the endpoints and the backends.
+
+The client authentication is declared at service level:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/mtls": {
+			"client_auth": "request",
+			"ca_certs": [ "./certs/internal-ca.pem" ],
+			"port": 8443,
+			"cert": "./certs/gateway.pem",
+			"key": "./certs/gateway-key.pem"
+		}
+	}
+
+With "require" (default) the handshakes without a valid client certificate fail, while with "request"
+the certificates are verified if sent, leaving the decision to the endpoint rules. When a port other
+than the service one is declared, a dedicated listener with the client authentication is started
+next to the regular one, so the rest of the callers can keep using tokens. Otherwise the service
+listener gets the client authentication. Both listeners are started by the run server of the gateway,
+so its options (such as the limits) apply to them alike. The server certificate and key default to the public_key
+and private_key of the tls section, whose versions and cipher suites are honoured as well.
+
+The identity of every verified certificate is sent to the handlers (and to the backends declaring
+them in the headers_to_pass list) in the following headers, removed from the requests without a
+verified certificate:
+
+  - X-Client-Cert-Subject: the subject distinguished name
+  - X-Client-Cert-SPIFFE-ID: the SPIFFE ID (the spiffe:// URI SAN), if any
+  - X-Client-Cert-SAN: the DNS, URI, email and IP SANs, comma separated
+  - X-Client-Cert-Fingerprint: the hex encoded SHA-256 of the certificate
+
+The identity is available to the middlewares reading the JWT claims as well, as the claims sub (the
+SPIFFE ID or, if missing, the common name), subject, spiffe_id and san of the gateway claims, unless
+the endpoint validates a bearer token, whose claims take precedence.
+
+The endpoints restricted to some certificates declare the rules allowing them (any of them):
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/mtls": {
+			"allow": [
+				{ "spiffe_id": "spiffe://acme.org/ns/prod/sa/*" },
+				{ "common_name": "billing", "san": "billing.internal" }
+			]
+		}
+	}
+
+A rule matches when every declared field matches the certificate: subject (the distinguished name),
+common_name, san (any SAN) and spiffe_id, with the path.Match patterns. The requests without a
+verified certificate are rejected with a 401 and the ones not matching any rule with a 403.
+*/
+package mtls
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/internal/httpserver"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	router "github.com/luraproject/lura/router/gin"
+	"github.com/luraproject/lura/transport/http/server"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/mtls"
+
+// The supported client authentication modes
+const (
+	ClientAuthRequire = "require"
+	ClientAuthRequest = "request"
+)
+
+// The headers with the identity of the client certificate
+const (
+	HeaderSubject     = "X-Client-Cert-Subject"
+	HeaderSPIFFEID    = "X-Client-Cert-SPIFFE-ID"
+	HeaderSAN         = "X-Client-Cert-SAN"
+	HeaderFingerprint = "X-Client-Cert-Fingerprint"
+)
+
+var identityHeaders = []string{HeaderSubject, HeaderSPIFFEID, HeaderSAN, HeaderFingerprint}
+
+// ErrNoConfig is returned when there is no mtls config
+var ErrNoConfig = errors.New("mtls: no config")
+
+// ServiceConfig is the custom config struct of the client authentication
+type ServiceConfig struct {
+	ClientAuth string   `json:"client_auth"`
+	CACerts    []string `json:"ca_certs"`
+	Port       int      `json:"port"`
+	Cert       string   `json:"cert"`
+	Key        string   `json:"key"`
+}
+
+// Config is the custom config struct of the endpoints restricted to some certificates
+type Config struct {
+	Allow []Rule `json:"allow"`
+}
+
+// Rule defines the certificates allowed by an endpoint
+type Rule struct {
+	Subject    string `json:"subject"`
+	CommonName string `json:"common_name"`
+	SAN        string `json:"san"`
+	SPIFFEID   string `json:"spiffe_id"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the client authentication config of the service
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	switch cfg.ClientAuth {
+	case "":
+		cfg.ClientAuth = ClientAuthRequire
+	case ClientAuthRequire, ClientAuthRequest:
+	default:
+		return cfg, fmt.Errorf("mtls: unknown client_auth %q", cfg.ClientAuth)
+	}
+	if len(cfg.CACerts) == 0 {
+		return cfg, errors.New("mtls: no ca_certs declared")
+	}
+	return cfg, nil
+}
+
+// ConfigGetter parses the rules of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	for i, r := range cfg.Allow {
+		if r == (Rule{}) {
+			return cfg, fmt.Errorf("mtls: rule #%d is empty", i)
+		}
+		for _, pattern := range []string{r.Subject, r.CommonName, r.SAN, r.SPIFFEID} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return cfg, fmt.Errorf("mtls: rule #%d: invalid pattern %q", i, pattern)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Validate checks the client authentication config of the service and the rules of every endpoint
+func Validate(cfg config.ServiceConfig) error {
+	_, err := ServiceConfigGetter(cfg.ExtraConfig)
+	hasService := err == nil
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	for _, e := range cfg.Endpoints {
+		_, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil && !hasService {
+			err = errors.New("mtls: no client authentication declared at service level")
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// TLSConfig returns the tls config of the listener with the client authentication, based on the tls
+// section of the service (if any)
+func (c ServiceConfig) TLSConfig(base *config.TLS) (*tls.Config, error) {
+	tlsCfg := server.ParseTLSConfig(base)
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	pool := x509.NewCertPool()
+	for _, file := range c.CACerts {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("mtls: %s", err.Error())
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("mtls: no certificates found in %s", file)
+		}
+	}
+	tlsCfg.ClientCAs = pool
+	tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	if c.ClientAuth == ClientAuthRequest {
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	cert, key := c.Cert, c.Key
+	if cert == "" && base != nil {
+		cert, key = base.PublicKey, base.PrivateKey
+	}
+	if cert == "" || key == "" {
+		return nil, errors.New("mtls: no server certificate and key declared")
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("mtls: %s", err.Error())
+	}
+	tlsCfg.Certificates = []tls.Certificate{pair}
+	return tlsCfg, nil
+}
+
+// NewRunServer returns a RunServerFunc starting the listener with the client authentication, if
+// declared, and delegating the rest to the injected one. Every listener is started by the injected
+// RunServerFunc, with the tls config and the address as httpserver options, so it must be the
+// httpserver RunServer (or wrap it) and the wrappers between them apply to all the listeners.
+func NewRunServer(l logging.Logger, next router.RunServerFunc) router.RunServerFunc {
+	return func(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+		mcfg, err := ServiceConfigGetter(cfg.ExtraConfig)
+		if err == ErrNoConfig {
+			return next(ctx, cfg, handler)
+		}
+		if err != nil {
+			return err
+		}
+		tlsCfg, err := mcfg.TLSConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		handler = IdentityHandler(handler)
+
+		if mcfg.Port == 0 || mcfg.Port == cfg.Port {
+			l.Info("mtls: client authentication", mcfg.ClientAuth, "enabled in the service listener")
+			return next(httpserver.WithOptions(ctx, httpserver.TLSConfig(tlsCfg)), cfg, handler)
+		}
+
+		l.Info(fmt.Sprintf("mtls: listening on port %d with client authentication %s", mcfg.Port, mcfg.ClientAuth))
+		mtlsCtx := httpserver.WithOptions(ctx, httpserver.Addr(fmt.Sprintf(":%d", mcfg.Port)), httpserver.TLSConfig(tlsCfg))
+		done := make(chan error, 2)
+		go func() { done <- next(mtlsCtx, cfg, handler) }()
+		go func() { done <- next(ctx, cfg, handler) }()
+		return <-done
+	}
+}
+
+// IdentityHandler replaces the identity headers of the requests with the ones of their verified
+// client certificate, if any
+func IdentityHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range identityHeaders {
+			r.Header.Del(h)
+		}
+		if cert := Certificate(r); cert != nil {
+			id := NewIdentity(cert)
+			r.Header.Set(HeaderSubject, id.Subject)
+			if id.SPIFFEID != "" {
+				r.Header.Set(HeaderSPIFFEID, id.SPIFFEID)
+			}
+			if len(id.SANs) > 0 {
+				r.Header.Set(HeaderSAN, strings.Join(id.SANs, ","))
+			}
+			r.Header.Set(HeaderFingerprint, id.Fingerprint)
+			r = claims.Authenticate(r, id.Claims())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Certificate returns the verified client certificate of the request, or nil
+func Certificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Identity is the identity of a client certificate
+type Identity struct {
+	Subject     string
+	CommonName  string
+	SPIFFEID    string
+	SANs        []string
+	Fingerprint string
+}
+
+// NewIdentity returns the identity of the certificate
+func NewIdentity(cert *x509.Certificate) Identity {
+	sum := sha256.Sum256(cert.Raw)
+	id := Identity{
+		Subject:     cert.Subject.String(),
+		CommonName:  cert.Subject.CommonName,
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	id.SANs = append(id.SANs, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" && id.SPIFFEID == "" {
+			id.SPIFFEID = u.String()
+		}
+		id.SANs = append(id.SANs, u.String())
+	}
+	id.SANs = append(id.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		id.SANs = append(id.SANs, ip.String())
+	}
+	return id
+}
+
+// Claims returns the identity as claims
+func (i Identity) Claims() map[string]interface{} {
+	sub := i.SPIFFEID
+	if sub == "" {
+		sub = i.CommonName
+	}
+	sans := make([]interface{}, len(i.SANs))
+	for j, s := range i.SANs {
+		sans[j] = s
+	}
+	c := map[string]interface{}{"sub": sub, "subject": i.Subject, "san": sans}
+	if i.SPIFFEID != "" {
+		c["spiffe_id"] = i.SPIFFEID
+	}
+	return c
+}
@@ -0,0 +1,265 @@
+package mtls
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/internal/httpserver"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	b, _ := x509.MarshalECPrivateKey(c.key)
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	srv := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "gateway"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	spiffe, _ := url.Parse("spiffe://acme.org/ns/prod/sa/orders")
+	orders := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "orders", Organization: []string{"Acme"}},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	billing := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing"},
+		DNSNames:    []string{"billing.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := srv.write(t, dir, "server")
+	tlsCfg, err := ServiceConfig{ClientAuth: ClientAuthRequest, CACerts: []string{caPath}}.TLSConfig(&config.TLS{
+		PublicKey:  certPath,
+		PrivateKey: keyPath,
+		MinVersion: "TLS12",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{
+				"spiffe": c.GetHeader(HeaderSPIFFEID),
+				"sub":    claims.FromHTTPRequest(c.Request)["sub"],
+			})
+		}
+	}, logging.NoOp)
+	engine := gin.New()
+	engine.GET("/orders", hf(&config.EndpointConfig{
+		Endpoint: "/orders",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"allow": []interface{}{map[string]interface{}{"spiffe_id": "spiffe://acme.org/ns/prod/sa/*"}},
+		}},
+	}, proxy.NoopProxy))
+
+	s := httptest.NewUnstartedServer(IdentityHandler(engine))
+	s.TLS = tlsCfg
+	s.StartTLS()
+	defer s.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	for name, tc := range map[string]struct {
+		cert   *testCert
+		status int
+		body   string
+	}{
+		"spiffe":  {cert: orders, status: http.StatusOK, body: `{"spiffe":"spiffe://acme.org/ns/prod/sa/orders","sub":"spiffe://acme.org/ns/prod/sa/orders"}`},
+		"no_rule": {cert: billing, status: http.StatusForbidden},
+		"no_cert": {status: http.StatusUnauthorized},
+	} {
+		clientTLS := &tls.Config{RootCAs: roots}
+		if tc.cert != nil {
+			clientTLS.Certificates = []tls.Certificate{tc.cert.tls()}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		req, _ := http.NewRequest("GET", s.URL+"/orders", nil)
+		req.Header.Set(HeaderSPIFFEID, "spiffe://acme.org/ns/prod/sa/forged")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s: %s", name, err.Error())
+			continue
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: unexpected status code %d", name, resp.StatusCode)
+		}
+		if tc.body != "" && string(b) != tc.body {
+			t.Errorf("%s: unexpected body %s", name, string(b))
+		}
+	}
+}
+
+func TestNewRunServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "gateway"}}, ca).write(t, dir, "server")
+
+	for _, tc := range []struct {
+		port     int
+		expected map[string]bool
+	}{
+		{port: 8080, expected: map[string]bool{":8080": true}},
+		{port: 8443, expected: map[string]bool{":8080": false, ":8443": true}},
+	} {
+		var mu sync.Mutex
+		servers := map[string]bool{}
+		rs := NewRunServer(logging.NoOp, func(ctx context.Context, cfg config.ServiceConfig, _ http.Handler) error {
+			s := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Port)}
+			for _, opt := range httpserver.Options(ctx) {
+				opt(s)
+			}
+			mu.Lock()
+			servers[s.Addr] = s.TLSConfig != nil && s.TLSConfig.ClientCAs != nil && len(s.TLSConfig.Certificates) == 1
+			mu.Unlock()
+			<-ctx.Done()
+			return nil
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := rs(ctx, config.ServiceConfig{Port: 8080, ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"ca_certs": []interface{}{caPath},
+			"port":     tc.port,
+			"cert":     certPath,
+			"key":      keyPath,
+		}}}, http.NotFoundHandler())
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		mu.Lock()
+		if !reflect.DeepEqual(servers, tc.expected) {
+			t.Errorf("port %d: unexpected servers %v", tc.port, servers)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestConfig_Allows(t *testing.T) {
+	id := Identity{
+		Subject:    "CN=billing,O=Acme",
+		CommonName: "billing",
+		SANs:       []string{"billing.internal", "billing@acme.org"},
+	}
+	for i, tc := range []struct {
+		rules   []Rule
+		allowed bool
+	}{
+		{allowed: true},
+		{rules: []Rule{{CommonName: "billing", SAN: "*.internal"}}, allowed: true},
+		{rules: []Rule{{CommonName: "billing", SAN: "*.external"}}},
+		{rules: []Rule{{SPIFFEID: "spiffe://*"}}},
+		{rules: []Rule{{SPIFFEID: "spiffe://*"}, {Subject: "CN=billing,*"}}, allowed: true},
+	} {
+		if got := (Config{Allow: tc.rules}).Allows(id); got != tc.allowed {
+			t.Errorf("#%d: unexpected result %v", i, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{{
+			Method:   "GET",
+			Endpoint: "/a",
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+				"allow": []interface{}{map[string]interface{}{"common_name": "a"}},
+			}},
+		}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("endpoint rules accepted without client authentication")
+	}
+	cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{"client_auth": "maybe", "ca_certs": []interface{}{"ca.pem"}}}
+	if err := Validate(cfg); err == nil {
+		t.Error("unknown client_auth accepted")
+	}
+	cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{"ca_certs": []interface{}{"ca.pem"}}}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Endpoints[0].ExtraConfig[Namespace] = map[string]interface{}{"allow": []interface{}{map[string]interface{}{"san": "[a"}}}
+	if err := Validate(cfg); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
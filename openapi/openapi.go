@@ -0,0 +1,384 @@
+/*
+Package openapi validates the requests of the endpoints against the operations of an OpenAPI 3
+document: path parameter formats, required query strings and their types, header constraints, the
+content type and the JSON bodies.
+
+The document (JSON or YAML) can be declared once at service level, validating every endpoint matching
+one of its operations by path and method:
+
+	{
+		"version": 2,
+		"extra_config": {
+			"github.com/devopsfaith/krakend-ce/openapi": {
+				"spec": "./openapi.yaml"
+			}
+		},
+		...
+	}
+
+or per endpoint, overriding the service one, and optionally pointing to the operation by its id:
+
+	...
+	"endpoint": "/users/{id}",
+	"querystring_params": [ "fields" ],
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/openapi": {
+			"spec": "./users.json",
+			"operation_id": "getUser"
+		}
+	},
+	...
+
+The paths are matched segment by segment, so the path parameters can use different names in the
+document and in the endpoint. Endpoints declaring the config must match an operation, while the service
+document is ignored by the endpoints without a matching one. The endpoints whose document can not be
+loaded, or without their declared operation, fail every request.
+
+The validation runs at the proxy layer, so it checks the request the gateway forwards: the query
+strings and headers must be declared in querystring_params and headers_to_pass to be validated, and
+Validate rejects the configurations not forwarding the required ones. Cookie parameters are ignored.
+
+The rejected requests fail with a ValidationError. It implements StatusCode (400), so the error
+handler renders it as any other client error, listing every violation.
+*/
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/openapi"
+
+var (
+	// ErrNoConfig is returned when there is no openapi config
+	ErrNoConfig = errors.New("openapi: no config")
+	// ErrNoSpec is returned when the config does not declare the document
+	ErrNoSpec = errors.New("openapi: no spec defined")
+	// ErrNoOperation is returned when the document has no operation matching the endpoint
+	ErrNoOperation = errors.New("openapi: no matching operation")
+)
+
+// Config is the custom config struct of the request validation
+type Config struct {
+	Spec        string `json:"spec"`
+	OperationID string `json:"operation_id"`
+}
+
+// ConfigGetter parses the openapi config of the service or the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Spec == "" {
+		return cfg, ErrNoSpec
+	}
+	return cfg, nil
+}
+
+// Violation describes a part of the request not matching the operation
+type Violation struct {
+	In      string `json:"in"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when the request does not match the operation
+type ValidationError struct {
+	Violations []Violation `json:"violations"`
+}
+
+// Error implements the error interface
+func (v ValidationError) Error() string {
+	msgs := make([]string, len(v.Violations))
+	for i, violation := range v.Violations {
+		msgs[i] = strings.TrimSpace(violation.In + " " + violation.Name + ": " + violation.Message)
+	}
+	return "openapi: invalid request: " + strings.Join(msgs, "; ")
+}
+
+// StatusCode returns the status of the response
+func (ValidationError) StatusCode() int { return http.StatusBadRequest }
+
+// ProxyFactory returns a proxy factory validating the requests of the endpoints with an operation,
+// looking for the service document in the received service extra config
+func ProxyFactory(logger logging.Logger, pf proxy.Factory, service config.ExtraConfig) proxy.Factory {
+	docs := map[string]Document{}
+	return proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(cfg)
+		if err != nil {
+			return next, err
+		}
+		op, err := operation(cfg, service, docs)
+		if err == ErrNoConfig {
+			return next, nil
+		}
+		if err != nil {
+			return errorProxy(logger, cfg.Endpoint, err), nil
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] validating the requests with the operation %s %s", cfg.Endpoint, op.Method, op.Path))
+		return NewProxy(op, next), nil
+	})
+}
+
+// errorProxy logs the error and returns a proxy failing with it, as the requests can not be forwarded
+// without their validation
+func errorProxy(logger logging.Logger, endpoint string, err error) proxy.Proxy {
+	logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", endpoint, err.Error()))
+	return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, err
+	}
+}
+
+// Validate checks every endpoint with an operation, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	docs := map[string]Document{}
+	for _, e := range cfg.Endpoints {
+		op, err := operation(e, cfg.ExtraConfig, docs)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil {
+			err = forwarded(e, op)
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// operation returns the operation of the endpoint, or ErrNoConfig when it is not validated
+func operation(e *config.EndpointConfig, service config.ExtraConfig, docs map[string]Document) (*Operation, error) {
+	cfg, err := ConfigGetter(e.ExtraConfig)
+	fromService := false
+	if err == ErrNoConfig {
+		if cfg, err = ConfigGetter(service); err != nil {
+			return nil, err
+		}
+		fromService = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := docs[cfg.Spec]
+	if !ok {
+		if doc, err = LoadDocument(cfg.Spec); err != nil {
+			return nil, err
+		}
+		docs[cfg.Spec] = doc
+	}
+	op, err := doc.Operation(e.Endpoint, e.Method, cfg.OperationID)
+	if err == ErrNoOperation && fromService {
+		return nil, ErrNoConfig
+	}
+	return op, err
+}
+
+// forwarded checks that the required query strings and headers reach the proxy layer
+func forwarded(e *config.EndpointConfig, op *Operation) error {
+	for _, p := range op.Parameters {
+		if !p.Required {
+			continue
+		}
+		switch p.In {
+		case "query":
+			if !contains(e.QueryString, p.Name) {
+				return fmt.Errorf("openapi: the required query string %s is not in querystring_params", p.Name)
+			}
+		case "header":
+			if !contains(e.HeadersToPass, p.Name) {
+				return fmt.Errorf("openapi: the required header %s is not in headers_to_pass", p.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func contains(list []string, name string) bool {
+	for _, v := range list {
+		if v == "*" || strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProxy returns a proxy rejecting the requests not matching the operation
+func NewProxy(op *Operation, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		violations := op.validateParameters(r)
+		bodyViolations, err := op.validateBody(r)
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, bodyViolations...)
+		if len(violations) > 0 {
+			return nil, ValidationError{Violations: violations}
+		}
+		return next(ctx, r)
+	}
+}
+
+func (op *Operation) validateParameters(r *proxy.Request) []Violation {
+	violations := []Violation{}
+	for _, p := range op.Parameters {
+		var values []string
+		switch p.In {
+		case "path":
+			if v, ok := r.Params[p.Param]; ok {
+				values = []string{v}
+			}
+		case "query":
+			values = r.Query[p.Name]
+		case "header":
+			values = header(r.Headers, p.Name)
+		}
+		if len(values) == 0 {
+			if p.Required {
+				violations = append(violations, Violation{In: p.In, Name: p.Name, Message: "required parameter is missing"})
+			}
+			continue
+		}
+		if p.Schema == nil {
+			continue
+		}
+		res, err := p.Schema.Validate(gojsonschema.NewGoLoader(p.coerce(values)))
+		if err != nil {
+			violations = append(violations, Violation{In: p.In, Name: p.Name, Message: err.Error()})
+			continue
+		}
+		for _, e := range res.Errors() {
+			violations = append(violations, Violation{In: p.In, Name: p.Name, Message: e.Description()})
+		}
+	}
+	return violations
+}
+
+func (op *Operation) validateBody(r *proxy.Request) ([]Violation, error) {
+	if op.Body == nil {
+		return nil, nil
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if len(body) == 0 {
+		if op.Body.Required {
+			return []Violation{{In: "body", Message: "required body is missing"}}, nil
+		}
+		return nil, nil
+	}
+
+	contentType := header(r.Headers, "Content-Type")
+	if len(contentType) == 0 {
+		// without the content type, the body is validated with the JSON schema, if any
+		for mediaType, schema := range op.Body.Content {
+			if isJSON(mediaType) {
+				return validateJSON(schema, body), nil
+			}
+		}
+		return nil, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType[0])
+	if err != nil {
+		return []Violation{{In: "header", Name: "Content-Type", Message: err.Error()}}, nil
+	}
+	for _, candidate := range []string{mediaType, mediaType[:strings.Index(mediaType+"/", "/")] + "/*", "*/*"} {
+		if schema, ok := op.Body.Content[candidate]; ok {
+			if !isJSON(mediaType) {
+				return nil, nil
+			}
+			return validateJSON(schema, body), nil
+		}
+	}
+	if len(op.Body.Content) == 0 {
+		return nil, nil
+	}
+	return []Violation{{In: "header", Name: "Content-Type", Message: fmt.Sprintf("unsupported content type %s", mediaType)}}, nil
+}
+
+func validateJSON(schema *gojsonschema.Schema, body []byte) []Violation {
+	if schema == nil {
+		return nil
+	}
+	res, err := schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return []Violation{{In: "body", Message: err.Error()}}
+	}
+	violations := []Violation{}
+	for _, e := range res.Errors() {
+		violations = append(violations, Violation{In: "body", Name: e.Field(), Message: e.Description()})
+	}
+	return violations
+}
+
+// coerce converts the raw values into the type declared by the schema of the parameter
+func (p Parameter) coerce(values []string) interface{} {
+	if p.Type != "array" {
+		return coerce(p.Type, values[0])
+	}
+	if p.In != "query" && len(values) == 1 {
+		values = strings.Split(values[0], ",")
+	}
+	items := make([]interface{}, len(values))
+	for i, v := range values {
+		items[i] = coerce(p.Items, v)
+	}
+	return items
+}
+
+func coerce(t, v string) interface{} {
+	switch t {
+	case "integer":
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+	case "number":
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return v
+}
+
+func header(headers map[string][]string, name string) []string {
+	for k, vs := range headers {
+		if strings.EqualFold(k, name) {
+			return vs
+		}
+	}
+	return nil
+}
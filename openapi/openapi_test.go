@@ -0,0 +1,172 @@
+package openapi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+const spec = `
+openapi: 3.0.1
+info:
+  title: users
+  version: "1"
+paths:
+  /users/{userId}:
+    parameters:
+      - name: userId
+        in: path
+        required: true
+        schema:
+          type: integer
+          minimum: 1
+    put:
+      operationId: updateUser
+      parameters:
+        - name: limit
+          in: query
+          required: true
+          schema:
+            type: integer
+            maximum: 10
+        - name: x-tenant
+          in: header
+          schema:
+            type: string
+            format: uuid
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/User'
+components:
+  schemas:
+    User:
+      type: object
+      required: [name]
+      properties:
+        name:
+          type: string
+`
+
+func TestProxyFactory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "openapi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spec.yaml")
+	if err := ioutil.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := &config.EndpointConfig{
+		Endpoint:      "/users/:id",
+		Method:        http.MethodPut,
+		QueryString:   []string{"limit"},
+		HeadersToPass: []string{"Content-Type", "X-Tenant"},
+	}
+	service := config.ExtraConfig{Namespace: map[string]interface{}{"spec": path}}
+	if err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{endpoint}, ExtraConfig: service}); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			calls++
+			return &proxy.Response{IsComplete: true}, nil
+		}, nil
+	})
+	p, err := ProxyFactory(logging.NoOp, pf, service).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		id         string
+		query      map[string][]string
+		headers    map[string][]string
+		body       string
+		violations []string
+	}{
+		{
+			name:    "valid",
+			id:      "42",
+			query:   map[string][]string{"limit": {"5"}},
+			headers: map[string][]string{"Content-Type": {"application/json; charset=utf-8"}, "X-Tenant": {"6ba7b810-9dad-11d1-80b4-00c04fd430c8"}},
+			body:    `{"name":"foo"}`,
+		},
+		{
+			name:       "invalid_params",
+			id:         "abc",
+			query:      map[string][]string{"limit": {"50"}},
+			headers:    map[string][]string{"Content-Type": {"application/json"}, "X-Tenant": {"foo"}},
+			body:       `{"name":42}`,
+			violations: []string{"path userId", "query limit", "header X-Tenant", "body name"},
+		},
+		{
+			name:       "missing",
+			id:         "1",
+			headers:    map[string][]string{"Content-Type": {"text/plain"}},
+			body:       `name`,
+			violations: []string{"query limit", "header Content-Type"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls = 0
+			_, err := p(context.Background(), &proxy.Request{
+				Params:  map[string]string{"Id": tc.id},
+				Query:   tc.query,
+				Headers: tc.headers,
+				Body:    ioutil.NopCloser(strings.NewReader(tc.body)),
+			})
+			if len(tc.violations) == 0 {
+				if err != nil || calls != 1 {
+					t.Errorf("unexpected result: %v", err)
+				}
+				return
+			}
+			verr, ok := err.(ValidationError)
+			if !ok || calls != 0 || verr.StatusCode() != http.StatusBadRequest {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			if len(verr.Violations) != len(tc.violations) {
+				t.Errorf("unexpected violations: %v", verr.Violations)
+			}
+			for i, v := range verr.Violations {
+				if i < len(tc.violations) && v.In+" "+v.Name != tc.violations[i] {
+					t.Errorf("unexpected violation #%d: %v", i, v)
+				}
+			}
+		})
+	}
+
+	endpoint.QueryString = nil
+	if err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{endpoint}, ExtraConfig: service}); err == nil {
+		t.Error("expecting an error for the required query string not forwarded")
+	}
+	endpoint.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{"spec": path, "operation_id": "unknown"}}
+	if err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{endpoint}}); err == nil {
+		t.Error("expecting an error for the unknown operation")
+	}
+
+	p, err = ProxyFactory(logging.NoOp, pf, service).New(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	if _, err := p(context.Background(), &proxy.Request{}); err == nil || calls != 0 {
+		t.Errorf("unexpected result for the unknown operation: %v (%d calls)", err, calls)
+	}
+}
@@ -0,0 +1,291 @@
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+)
+
+// Document is a parsed OpenAPI 3 document
+type Document map[string]interface{}
+
+// LoadDocument reads and parses the OpenAPI document stored in the path, in JSON or YAML format
+func LoadDocument(path string) (Document, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var raw interface{}
+		if err := yaml.Unmarshal(b, &raw); err != nil {
+			return nil, err
+		}
+		doc, _ = fromYAML(raw).(map[string]interface{})
+	default:
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+	}
+	if v, _ := doc["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		return nil, fmt.Errorf("openapi: %s is not an OpenAPI 3 document", path)
+	}
+	return Document(doc), nil
+}
+
+// fromYAML converts the generic maps of the yaml decoder into JSON compatible ones
+func fromYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprintf("%v", k)] = fromYAML(v)
+		}
+		return m
+	case []interface{}:
+		for i := range t {
+			t[i] = fromYAML(t[i])
+		}
+	}
+	return v
+}
+
+// Operation is a compiled OpenAPI operation, ready to validate requests
+type Operation struct {
+	Path       string
+	Method     string
+	Parameters []Parameter
+	Body       *RequestBody
+}
+
+// Parameter is a compiled operation parameter
+type Parameter struct {
+	Name     string
+	In       string
+	Required bool
+	// Param is the name of the endpoint param holding the value of the path parameters
+	Param  string
+	Type   string
+	Items  string
+	Schema *gojsonschema.Schema
+}
+
+// RequestBody is a compiled operation request body
+type RequestBody struct {
+	Required bool
+	Content  map[string]*gojsonschema.Schema
+}
+
+// Operation looks for the operation matching the endpoint and method, or the operationId when
+// defined, and compiles it
+func (d Document) Operation(endpoint, method, operationID string) (*Operation, error) {
+	paths, _ := d["paths"].(map[string]interface{})
+	for path, v := range paths {
+		item, _ := d.resolve(v).(map[string]interface{})
+		for m, op := range item {
+			operation, ok := op.(map[string]interface{})
+			if !ok || !isMethod(m) {
+				continue
+			}
+			if operationID != "" {
+				if id, _ := operation["operationId"].(string); id != operationID {
+					continue
+				}
+			} else if !strings.EqualFold(m, method) {
+				continue
+			}
+			names, ok := matchPath(path, endpoint)
+			if !ok {
+				if operationID == "" {
+					continue
+				}
+				return nil, fmt.Errorf("openapi: the path of the operation %s does not match the endpoint %s", operationID, endpoint)
+			}
+			return d.compile(path, strings.ToUpper(m), names, item, operation)
+		}
+	}
+	if operationID != "" {
+		return nil, fmt.Errorf("openapi: unknown operation %s", operationID)
+	}
+	return nil, ErrNoOperation
+}
+
+func (d Document) compile(path, method string, names map[string]string, item, operation map[string]interface{}) (*Operation, error) {
+	op := &Operation{Path: path, Method: method}
+
+	params := map[string]Parameter{}
+	order := []string{}
+	for _, list := range []interface{}{item["parameters"], operation["parameters"]} {
+		values, _ := list.([]interface{})
+		for _, v := range values {
+			p, err := d.parameter(v, names)
+			if err != nil {
+				return nil, fmt.Errorf("openapi: %s %s: %s", method, path, err.Error())
+			}
+			if p.In == "cookie" {
+				continue
+			}
+			key := p.In + ":" + p.Name
+			if _, ok := params[key]; !ok {
+				order = append(order, key)
+			}
+			// the operation parameters override the ones defined at path level
+			params[key] = p
+		}
+	}
+	for _, key := range order {
+		op.Parameters = append(op.Parameters, params[key])
+	}
+
+	if v, ok := operation["requestBody"]; ok {
+		body, _ := d.resolve(v).(map[string]interface{})
+		required, _ := body["required"].(bool)
+		op.Body = &RequestBody{Required: required, Content: map[string]*gojsonschema.Schema{}}
+		content, _ := body["content"].(map[string]interface{})
+		for mediaType, v := range content {
+			media, _ := v.(map[string]interface{})
+			var schema *gojsonschema.Schema
+			if s, ok := media["schema"]; ok && isJSON(mediaType) {
+				var err error
+				if schema, err = d.schema(s); err != nil {
+					return nil, fmt.Errorf("openapi: %s %s: request body %s: %s", method, path, mediaType, err.Error())
+				}
+			}
+			op.Body.Content[strings.ToLower(mediaType)] = schema
+		}
+	}
+	return op, nil
+}
+
+func (d Document) parameter(v interface{}, names map[string]string) (Parameter, error) {
+	def, _ := d.resolve(v).(map[string]interface{})
+	p := Parameter{}
+	p.Name, _ = def["name"].(string)
+	p.In, _ = def["in"].(string)
+	p.Required, _ = def["required"].(bool)
+	if p.Name == "" {
+		return p, fmt.Errorf("parameter without name")
+	}
+	switch p.In {
+	case "path":
+		p.Required = true
+		p.Param = names[p.Name]
+		if p.Param == "" {
+			return p, fmt.Errorf("unknown path parameter %s", p.Name)
+		}
+	case "header":
+		p.Name = textproto.CanonicalMIMEHeaderKey(p.Name)
+	case "query", "cookie":
+	default:
+		return p, fmt.Errorf("parameter %s in unknown location %q", p.Name, p.In)
+	}
+
+	s, ok := def["schema"]
+	if !ok {
+		return p, nil
+	}
+	schema, _ := d.resolve(s).(map[string]interface{})
+	p.Type, _ = schema["type"].(string)
+	if items, ok := schema["items"]; ok {
+		itemsSchema, _ := d.resolve(items).(map[string]interface{})
+		p.Items, _ = itemsSchema["type"].(string)
+	}
+	var err error
+	if p.Schema, err = d.schema(s); err != nil {
+		return p, fmt.Errorf("parameter %s: %s", p.Name, err.Error())
+	}
+	return p, nil
+}
+
+// schema compiles the schema, embedding the components so the local references are resolved
+func (d Document) schema(s interface{}) (*gojsonschema.Schema, error) {
+	root := map[string]interface{}{}
+	if m, ok := s.(map[string]interface{}); ok {
+		for k, v := range m {
+			root[k] = v
+		}
+	}
+	if components, ok := d["components"]; ok {
+		root["components"] = components
+	}
+	return gojsonschema.NewSchema(gojsonschema.NewGoLoader(root))
+}
+
+// resolve follows the local references of the document
+func (d Document) resolve(v interface{}) interface{} {
+	for i := 0; i < 10; i++ {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		ref, ok := m["$ref"].(string)
+		if !ok || !strings.HasPrefix(ref, "#/") {
+			return v
+		}
+		var current interface{} = map[string]interface{}(d)
+		for _, k := range strings.Split(ref[2:], "/") {
+			k = strings.Replace(strings.Replace(k, "~1", "/", -1), "~0", "~", -1)
+			node, _ := current.(map[string]interface{})
+			current = node[k]
+		}
+		v = current
+	}
+	return v
+}
+
+// matchPath checks if the OpenAPI path matches the endpoint, returning the name of the endpoint param
+// matching every path parameter
+func matchPath(path, endpoint string) (map[string]string, bool) {
+	a := strings.Split(strings.Trim(path, "/"), "/")
+	b := strings.Split(strings.Trim(endpoint, "/"), "/")
+	if len(a) != len(b) {
+		return nil, false
+	}
+	names := map[string]string{}
+	for i := range a {
+		pa, pb := paramName(a[i]), paramName(b[i])
+		switch {
+		case pa != "" && pb != "":
+			names[pa] = strings.Title(pb[:1]) + pb[1:]
+		case pa != "" || pb != "" || a[i] != b[i]:
+			return nil, false
+		}
+	}
+	return names, true
+}
+
+// paramName returns the name of the param declared by the segment, either as {name} or, as the
+// endpoints are stored once the config is initialized, as :name
+func paramName(segment string) string {
+	if len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}' {
+		return segment[1 : len(segment)-1]
+	}
+	if len(segment) > 1 && segment[0] == ':' {
+		return segment[1:]
+	}
+	return ""
+}
+
+func isMethod(m string) bool {
+	switch strings.ToLower(m) {
+	case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+		return true
+	}
+	return false
+}
+
+func isJSON(mediaType string) bool {
+	t, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return false
+	}
+	return t == "application/json" || strings.HasSuffix(t, "+json")
+}
@@ -0,0 +1,305 @@
+/*
+Package pagination follows the pagination of the backends returning paged results and concatenates the
+pages into a single response.
+
+Sample backend config:
+
+	...
+	"is_collection": false,
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/pagination": {
+			"strategy": "cursor",
+			"collection": "items",
+			"cursor_path": "meta.next_cursor",
+			"cursor_param": "cursor",
+			"max_pages": 10,
+			"max_items": 1000
+		}
+	},
+	...
+
+The supported strategies are:
+
+  - cursor: the cursor found at cursor_path is sent in the cursor_param query string parameter of the
+    next request, until it is missing or empty.
+  - page: the page_param query string parameter is incremented from start_page (1 by default), sending
+    size in size_param when defined, until a page returns less than size items or no items at all.
+  - next_url: the next request goes to the URL found at next_path, resolved against the current one.
+  - link: the next request goes to the rel="next" URL of the Link header.
+
+The collection (the "collection" key by default) is concatenated, and the rest of the response is the
+one of the first page. The paths refer to the data after the backend formatting, so the deny, allow,
+mapping and target options must keep the cursors and collections reachable.
+
+The layer wraps the rest of the backend chain, so every page goes through the http cache, the rate
+limit and the circuit breaker. A failure in the first page is returned as is, while failures in the next
+pages return the items collected so far as an incomplete response. The max_pages (10 by default) and
+max_items caps stop the iteration silently.
+*/
+package pagination
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/pagination"
+
+// The supported strategies
+const (
+	StrategyCursor  = "cursor"
+	StrategyPage    = "page"
+	StrategyNextURL = "next_url"
+	StrategyLink    = "link"
+)
+
+const defaultMaxPages = 10
+
+// ErrNoConfig is returned when the backend has no pagination config
+var ErrNoConfig = errors.New("pagination: no config")
+
+// Config is the custom config struct of the paginated backends
+type Config struct {
+	Strategy    string `json:"strategy"`
+	Collection  string `json:"collection"`
+	CursorPath  string `json:"cursor_path"`
+	CursorParam string `json:"cursor_param"`
+	NextPath    string `json:"next_path"`
+	PageParam   string `json:"page_param"`
+	StartPage   int    `json:"start_page"`
+	SizeParam   string `json:"size_param"`
+	Size        int    `json:"size"`
+	MaxPages    int    `json:"max_pages"`
+	MaxItems    int    `json:"max_items"`
+}
+
+// ConfigGetter parses the pagination config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Collection == "" {
+		cfg.Collection = "collection"
+	}
+	if cfg.MaxPages <= 0 {
+		cfg.MaxPages = defaultMaxPages
+	}
+	switch cfg.Strategy {
+	case StrategyCursor:
+		if cfg.CursorPath == "" || cfg.CursorParam == "" {
+			return cfg, errors.New("pagination: the cursor strategy requires cursor_path and cursor_param")
+		}
+	case StrategyPage:
+		if cfg.PageParam == "" {
+			cfg.PageParam = "page"
+		}
+		if cfg.StartPage == 0 {
+			cfg.StartPage = 1
+		}
+	case StrategyNextURL:
+		if cfg.NextPath == "" {
+			return cfg, errors.New("pagination: the next_url strategy requires next_path")
+		}
+	case StrategyLink:
+	default:
+		return cfg, fmt.Errorf("pagination: unknown strategy %q", cfg.Strategy)
+	}
+	return cfg, nil
+}
+
+// BackendFactory returns a backend factory following the pagination of the backends with a
+// pagination config
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return next
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] following the %s pagination", remote.URLPattern, cfg.Strategy))
+		return NewProxy(cfg, next)
+	}
+}
+
+// NewProxy returns a proxy requesting the pages to the next one and concatenating their collections
+func NewProxy(cfg Config, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		page := *r
+		if r.URL != nil {
+			u := *r.URL
+			page.URL = &u
+		}
+		pageNumber := cfg.StartPage
+		if cfg.Strategy == StrategyPage {
+			setQuery(&page, cfg.PageParam, strconv.Itoa(pageNumber))
+			if cfg.SizeParam != "" && cfg.Size > 0 {
+				setQuery(&page, cfg.SizeParam, strconv.Itoa(cfg.Size))
+			}
+		}
+
+		first, err := next(ctx, &page)
+		if err != nil || first == nil {
+			return first, err
+		}
+		items, _ := lookup(first.Data, cfg.Collection).([]interface{})
+		last := first
+
+		for pages := 1; pages < cfg.MaxPages; pages++ {
+			if cfg.MaxItems > 0 && len(items) >= cfg.MaxItems {
+				break
+			}
+			current, _ := lookup(last.Data, cfg.Collection).([]interface{})
+			if !nextPage(cfg, &page, last, len(current), &pageNumber) {
+				break
+			}
+			page.Body = nil
+
+			resp, err := next(ctx, &page)
+			if err != nil || resp == nil {
+				first.IsComplete = false
+				break
+			}
+			more, _ := lookup(resp.Data, cfg.Collection).([]interface{})
+			items = append(items, more...)
+			first.IsComplete = first.IsComplete && resp.IsComplete
+			last = resp
+		}
+
+		if cfg.MaxItems > 0 && len(items) > cfg.MaxItems {
+			items = items[:cfg.MaxItems]
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		if first.Data == nil {
+			first.Data = map[string]interface{}{}
+		}
+		set(first.Data, cfg.Collection, items)
+		return first, nil
+	}
+}
+
+// nextPage updates the request to point to the next page, returning false if there are no more pages
+func nextPage(cfg Config, page *proxy.Request, last *proxy.Response, count int, pageNumber *int) bool {
+	switch cfg.Strategy {
+	case StrategyCursor:
+		cursor := stringify(lookup(last.Data, cfg.CursorPath))
+		if cursor == "" {
+			return false
+		}
+		setQuery(page, cfg.CursorParam, cursor)
+	case StrategyPage:
+		if count == 0 || (cfg.Size > 0 && count < cfg.Size) {
+			return false
+		}
+		*pageNumber++
+		setQuery(page, cfg.PageParam, strconv.Itoa(*pageNumber))
+	case StrategyNextURL:
+		return setURL(page, stringify(lookup(last.Data, cfg.NextPath)))
+	case StrategyLink:
+		return setURL(page, nextLink(last.Metadata.Headers))
+	}
+	return true
+}
+
+func setQuery(r *proxy.Request, key, value string) {
+	if r.URL == nil {
+		return
+	}
+	q := r.URL.Query()
+	q.Set(key, value)
+	r.URL.RawQuery = q.Encode()
+}
+
+func setURL(r *proxy.Request, next string) bool {
+	if next == "" || r.URL == nil {
+		return false
+	}
+	u, err := r.URL.Parse(next)
+	if err != nil || u.String() == r.URL.String() {
+		return false
+	}
+	r.URL = u
+	return true
+}
+
+var linkNext = regexp.MustCompile(`<([^>]*)>\s*;[^,]*rel="?next"?`)
+
+// nextLink extracts the rel="next" URL of the Link headers
+func nextLink(headers map[string][]string) string {
+	for k, vs := range headers {
+		if !strings.EqualFold(k, "Link") {
+			continue
+		}
+		for _, v := range vs {
+			for _, part := range strings.Split(v, ",") {
+				if m := linkNext.FindStringSubmatch(part); m != nil {
+					return m[1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func lookup(data map[string]interface{}, path string) interface{} {
+	var current interface{} = data
+	for _, k := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[k]
+	}
+	return current
+}
+
+func set(data map[string]interface{}, path string, v interface{}) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		m, ok := data[k].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+			data[k] = m
+		}
+		data = m
+	}
+	data[keys[len(keys)-1]] = v
+}
+
+func stringify(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
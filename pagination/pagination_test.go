@@ -0,0 +1,114 @@
+package pagination
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestBackendFactory(t *testing.T) {
+	// the upstream has 7 items, returned in pages of up to 3 items
+	all := []interface{}{1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0}
+	pageOf := func(offset int) []interface{} {
+		end := offset + 3
+		if end > len(all) {
+			end = len(all)
+		}
+		if offset >= len(all) {
+			return []interface{}{}
+		}
+		return append([]interface{}{}, all[offset:end]...)
+	}
+
+	upstream := func(_ context.Context, r *proxy.Request) (*proxy.Response, error) {
+		q := r.URL.Query()
+		offset := 0
+		switch {
+		case q.Get("cursor") != "":
+			offset, _ = strconv.Atoi(q.Get("cursor"))
+		case q.Get("page") != "":
+			p, _ := strconv.Atoi(q.Get("page"))
+			offset = (p - 1) * 3
+		case q.Get("offset") != "":
+			offset, _ = strconv.Atoi(q.Get("offset"))
+		}
+		if q.Get("fail") == strconv.Itoa(offset) {
+			return nil, errors.New("boom")
+		}
+		data := map[string]interface{}{"items": pageOf(offset), "meta": map[string]interface{}{"total": 7.0}}
+		headers := map[string][]string{}
+		if offset+3 < len(all) {
+			next := strconv.Itoa(offset + 3)
+			data["meta"].(map[string]interface{})["next_cursor"] = next
+			data["next"] = "/items?offset=" + next
+			headers["Link"] = []string{`</items?offset=` + next + `>; rel="next", </items?offset=0>; rel="first"`}
+		}
+		return &proxy.Response{Data: data, IsComplete: true, Metadata: proxy.Metadata{Headers: headers}}, nil
+	}
+
+	for _, tc := range []struct {
+		name     string
+		cfg      map[string]interface{}
+		query    string
+		expected []interface{}
+		complete bool
+	}{
+		{
+			name:     "cursor",
+			cfg:      map[string]interface{}{"strategy": "cursor", "collection": "items", "cursor_path": "meta.next_cursor", "cursor_param": "cursor"},
+			expected: all,
+			complete: true,
+		},
+		{
+			name:     "page",
+			cfg:      map[string]interface{}{"strategy": "page", "collection": "items", "size": 3, "size_param": "limit"},
+			expected: all,
+			complete: true,
+		},
+		{
+			name:     "next_url",
+			cfg:      map[string]interface{}{"strategy": "next_url", "collection": "items", "next_path": "next", "max_items": 5},
+			expected: all[:5],
+			complete: true,
+		},
+		{
+			name:     "link",
+			cfg:      map[string]interface{}{"strategy": "link", "collection": "items", "max_pages": 2},
+			expected: all[:6],
+			complete: true,
+		},
+		{
+			name:     "failed_page",
+			cfg:      map[string]interface{}{"strategy": "cursor", "collection": "items", "cursor_path": "meta.next_cursor", "cursor_param": "cursor"},
+			query:    "fail=6",
+			expected: all[:6],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy { return upstream })(&config.Backend{
+				ExtraConfig: config.ExtraConfig{Namespace: tc.cfg},
+			})
+			u, _ := url.Parse("http://upstream.local/items?" + tc.query)
+			resp, err := p(context.Background(), &proxy.Request{URL: u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Data["items"], tc.expected) {
+				t.Errorf("unexpected items: %v", resp.Data["items"])
+			}
+			if resp.IsComplete != tc.complete {
+				t.Errorf("unexpected completion flag: %v", resp.IsComplete)
+			}
+			if resp.Data["meta"].(map[string]interface{})["total"] != 7.0 {
+				t.Errorf("unexpected data: %v", resp.Data)
+			}
+		})
+	}
+}
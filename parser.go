@@ -0,0 +1,68 @@
+package krakend
+
+import (
+	"github.com/devopsfaith/krakend-ce/apikey"
+	"github.com/devopsfaith/krakend-ce/bodytransform"
+	"github.com/devopsfaith/krakend-ce/canary"
+	"github.com/devopsfaith/krakend-ce/compression"
+	"github.com/devopsfaith/krakend-ce/conditional"
+	"github.com/devopsfaith/krakend-ce/faultinjection"
+	"github.com/devopsfaith/krakend-ce/fieldauth"
+	"github.com/devopsfaith/krakend-ce/ipfilter"
+	"github.com/devopsfaith/krakend-ce/kafka"
+	"github.com/devopsfaith/krakend-ce/limits"
+	"github.com/devopsfaith/krakend-ce/mirror"
+	"github.com/devopsfaith/krakend-ce/mtls"
+	"github.com/devopsfaith/krakend-ce/openapi"
+	"github.com/devopsfaith/krakend-ce/policy"
+	"github.com/devopsfaith/krakend-ce/quota"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/devopsfaith/krakend-ce/redact"
+	"github.com/devopsfaith/krakend-ce/redis"
+	"github.com/devopsfaith/krakend-ce/responseschema"
+	"github.com/devopsfaith/krakend-ce/stub"
+	"github.com/devopsfaith/krakend-ce/transform"
+	"github.com/luraproject/lura/config"
+)
+
+// ConfigValidators are the checks applied to every parsed configuration
+var ConfigValidators = []func(config.ServiceConfig) error{
+	faultinjection.Validate,
+	mirror.Validate,
+	canary.Validate,
+	redis.Validate,
+	kafka.Validate,
+	stub.Validate,
+	transform.Validate,
+	bodytransform.Validate,
+	conditional.Validate,
+	responseschema.Validate,
+	openapi.Validate,
+	redact.Validate,
+	compression.Validate,
+	fieldauth.Validate,
+	ratelimit.Validate,
+	quota.Validate,
+	apikey.Validate,
+	mtls.Validate,
+	policy.Validate,
+	ipfilter.Validate,
+	limits.Validate,
+}
+
+// NewConfigParser wraps the received parser so the configurations rejected by any of the
+// ConfigValidators fail to load, both with the check and the run commands
+func NewConfigParser(p config.Parser) config.Parser {
+	return config.ParserFunc(func(path string) (config.ServiceConfig, error) {
+		cfg, err := p.Parse(path)
+		if err != nil {
+			return cfg, err
+		}
+		for _, validate := range ConfigValidators {
+			if err := validate(cfg); err != nil {
+				return cfg, err
+			}
+		}
+		return cfg, nil
+	})
+}
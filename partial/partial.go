@@ -0,0 +1,318 @@
+/*
+Package partial adds a policy for the partial responses of the aggregated endpoints.
+
+Every backend of the endpoint can be flagged as required, or declare the static data to use when it
+fails. Optional backends (the default) keep the lura behaviour. Sample backend config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/partial": {
+			"required": true
+		}
+	},
+	...
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/partial": {
+			"fallback": { "recommendations": [] }
+		}
+	},
+	...
+
+The endpoint config maps the states of the response to status codes. Sample endpoint config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/partial": {
+			"status_codes": {
+				"partial": 206,
+				"degraded": 200,
+				"failed": 503
+			}
+		}
+	},
+	...
+
+The states are:
+
+  - failed: a required backend failed. The whole call fails with the configured status (502 by
+    default) and no data. The error implements StatusCode, so it is surfaced by the error handler proxy
+    layer and the router.
+  - partial: an optional backend without fallback failed and its data is missing.
+  - degraded: every failed backend was replaced by its fallback data.
+
+The responses in the partial and degraded states keep their status unless a code is configured for them.
+The fallback data goes through the backend formatter, so group, target and mapping apply to it, and the
+responses using it are always flagged as incomplete.
+*/
+package partial
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/partial"
+
+// The states of the aggregated responses
+const (
+	StatePartial  = "partial"
+	StateDegraded = "degraded"
+	StateFailed   = "failed"
+)
+
+// statusHeader carries the status decided by the proxy layer to the handler
+const statusHeader = "X-Krakend-Partial-Status"
+
+// ErrNoConfig is returned when there is no partial config
+var ErrNoConfig = errors.New("partial: no config")
+
+// BackendConfig is the custom config struct of the backends
+type BackendConfig struct {
+	Required bool                   `json:"required"`
+	Fallback map[string]interface{} `json:"fallback"`
+}
+
+// EndpointConfig is the custom config struct of the endpoints
+type EndpointConfig struct {
+	StatusCodes map[string]int `json:"status_codes"`
+}
+
+// BackendConfigGetter parses the partial config of a backend
+func BackendConfigGetter(e config.ExtraConfig) (BackendConfig, error) {
+	cfg := BackendConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Required && cfg.Fallback != nil {
+		return cfg, errors.New("partial: a required backend can not declare a fallback")
+	}
+	return cfg, nil
+}
+
+// EndpointConfigGetter parses the partial config of an endpoint. The status of the failed state
+// defaults to 502.
+func EndpointConfigGetter(e config.ExtraConfig) (EndpointConfig, error) {
+	cfg := EndpointConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.StatusCodes == nil {
+		cfg.StatusCodes = map[string]int{}
+	}
+	for state, code := range cfg.StatusCodes {
+		if state != StatePartial && state != StateDegraded && state != StateFailed {
+			return cfg, fmt.Errorf("partial: unknown state %q", state)
+		}
+		if code < 100 || code > 599 {
+			return cfg, fmt.Errorf("partial: invalid status code %d for the %s state", code, state)
+		}
+	}
+	if _, ok := cfg.StatusCodes[StateFailed]; !ok {
+		cfg.StatusCodes[StateFailed] = http.StatusBadGateway
+	}
+	return cfg, nil
+}
+
+func parse(e config.ExtraConfig, cfg interface{}) error {
+	v, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	return json.NewDecoder(buf).Decode(cfg)
+}
+
+// FailedError is returned when a required backend fails
+type FailedError struct {
+	Backend string
+	Code    int
+	Err     error
+}
+
+// Error implements the error interface
+func (f FailedError) Error() string {
+	return fmt.Sprintf("partial: required backend %s failed: %v", f.Backend, f.Err)
+}
+
+// StatusCode returns the status configured for the failed state
+func (f FailedError) StatusCode() int { return f.Code }
+
+// BackendFactory returns a backend factory applying the policy of the backends with a partial config
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := BackendConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return next
+		}
+		if cfg.Required {
+			return requiredProxy(remote.URLPattern, next)
+		}
+		if cfg.Fallback != nil {
+			return fallbackProxy(cfg.Fallback, proxy.NewEntityFormatter(remote), next)
+		}
+		return next
+	}
+}
+
+func requiredProxy(name string, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if err != nil || resp == nil {
+			if t, ok := ctx.Value(trackerKey{}).(*tracker); ok {
+				t.fail(name, err)
+			}
+		}
+		return resp, err
+	}
+}
+
+func fallbackProxy(data map[string]interface{}, ef proxy.EntityFormatter, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if err == nil && resp != nil {
+			return resp, nil
+		}
+		if t, ok := ctx.Value(trackerKey{}).(*tracker); ok {
+			t.fallback()
+		}
+		formatted := ef.Format(proxy.Response{Data: copyMap(data), Metadata: proxy.Metadata{Headers: map[string][]string{}}})
+		formatted.IsComplete = false
+		return &formatted, nil
+	}
+}
+
+// ProxyFactory returns a proxy factory applying the policy to the endpoints with a partial config or
+// with backends declaring one
+func ProxyFactory(logger logging.Logger, pf proxy.Factory) proxy.Factory {
+	return proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(remote)
+		if err != nil {
+			return next, err
+		}
+		cfg, err := EndpointConfigGetter(remote.ExtraConfig)
+		if err != nil && err != ErrNoConfig {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			return next, err
+		}
+		if err == ErrNoConfig {
+			if !hasBackendConfig(remote) {
+				return next, nil
+			}
+			cfg, _ = EndpointConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{}})
+		}
+		return NewProxy(cfg, next), nil
+	})
+}
+
+func hasBackendConfig(remote *config.EndpointConfig) bool {
+	for _, b := range remote.Backend {
+		if _, ok := b.ExtraConfig[Namespace]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProxy returns a proxy tracking the failures of the backends and mapping the state of the
+// responses to the configured status codes
+func NewProxy(cfg EndpointConfig, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		t := &tracker{}
+		resp, err := next(context.WithValue(ctx, trackerKey{}, t), r)
+
+		if backend, failed, cause := t.failure(); failed {
+			return nil, FailedError{Backend: backend, Code: cfg.StatusCodes[StateFailed], Err: cause}
+		}
+		if resp == nil || resp.IsComplete {
+			return resp, err
+		}
+
+		state := StatePartial
+		if err == nil && t.fallbacks() > 0 {
+			state = StateDegraded
+		}
+		code, ok := cfg.StatusCodes[state]
+		if !ok {
+			return resp, err
+		}
+
+		headers := make(map[string][]string, len(resp.Metadata.Headers)+1)
+		for k, vs := range resp.Metadata.Headers {
+			headers[k] = vs
+		}
+		headers[statusHeader] = []string{strconv.Itoa(code)}
+		resp.Metadata.Headers = headers
+		resp.Metadata.StatusCode = code
+		return resp, err
+	}
+}
+
+type trackerKey struct{}
+
+type tracker struct {
+	mu       sync.Mutex
+	backend  string
+	err      error
+	failed   bool
+	replaced int
+}
+
+func (t *tracker) fail(backend string, err error) {
+	t.mu.Lock()
+	if !t.failed {
+		t.failed = true
+		t.backend = backend
+		t.err = err
+	}
+	t.mu.Unlock()
+}
+
+func (t *tracker) fallback() {
+	t.mu.Lock()
+	t.replaced++
+	t.mu.Unlock()
+}
+
+func (t *tracker) failure() (string, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.backend, t.failed, t.err
+}
+
+func (t *tracker) fallbacks() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.replaced
+}
+
+func copyMap(in map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(in))
+	for k, v := range in {
+		if m, ok := v.(map[string]interface{}); ok {
+			v = copyMap(m)
+		}
+		out[k] = v
+	}
+	return out
+}
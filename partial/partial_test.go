@@ -0,0 +1,133 @@
+package partial
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	krakendgin "github.com/luraproject/lura/router/gin"
+)
+
+func TestProxyFactory(t *testing.T) {
+	errBackend := errors.New("boom")
+	bf := BackendFactory(logging.NoOp, func(remote *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if remote.URLPattern == "/fail" {
+				return nil, errBackend
+			}
+			return &proxy.Response{Data: map[string]interface{}{"a": 1}, IsComplete: true}, nil
+		}
+	})
+
+	for _, tc := range []struct {
+		name     string
+		backends []*config.Backend
+		data     map[string]interface{}
+		status   int
+		err      error
+	}{
+		{
+			name: "complete",
+			backends: []*config.Backend{
+				{URLPattern: "/ok", ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"required": true}}},
+				{URLPattern: "/ok"},
+			},
+			data: map[string]interface{}{"a": 1},
+		},
+		{
+			name: "failed",
+			backends: []*config.Backend{
+				{URLPattern: "/fail", ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"required": true}}},
+				{URLPattern: "/ok"},
+			},
+			err: FailedError{Backend: "/fail", Code: http.StatusServiceUnavailable, Err: errBackend},
+		},
+		{
+			name: "degraded",
+			backends: []*config.Backend{
+				{URLPattern: "/ok"},
+				{URLPattern: "/fail", Group: "b", ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"fallback": map[string]interface{}{"items": []interface{}{}},
+				}}},
+			},
+			data:   map[string]interface{}{"a": 1, "b": map[string]interface{}{"items": []interface{}{}}},
+			status: http.StatusOK,
+		},
+		{
+			name: "partial",
+			backends: []*config.Backend{
+				{URLPattern: "/ok"},
+				{URLPattern: "/fail"},
+			},
+			data:   map[string]interface{}{"a": 1},
+			status: http.StatusPartialContent,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, b := range tc.backends {
+				b.Host = []string{"http://backend.local"}
+			}
+			endpoint := &config.EndpointConfig{
+				Endpoint: "/" + tc.name,
+				Timeout:  time.Second,
+				Backend:  tc.backends,
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"status_codes": map[string]interface{}{"partial": 206, "degraded": 200, "failed": 503},
+				}},
+			}
+			pf := ProxyFactory(logging.NoOp, proxy.NewDefaultFactory(bf, logging.NoOp))
+			p, err := pf.New(endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := p(context.Background(), &proxy.Request{Params: map[string]string{}})
+			if tc.err != nil {
+				if !reflect.DeepEqual(err, tc.err) || resp != nil {
+					t.Errorf("unexpected result: %v %v", resp, err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(resp.Data, tc.data) || resp.Metadata.StatusCode != tc.status {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	endpoint := &config.EndpointConfig{
+		Endpoint: "/",
+		Method:   "GET",
+		Timeout:  time.Second,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"status_codes": map[string]interface{}{"partial": 206},
+		}},
+	}
+	p := NewProxy(EndpointConfig{StatusCodes: map[string]int{StatePartial: 206}}, func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return &proxy.Response{Data: map[string]interface{}{"a": 1}}, errors.New("missing backend")
+	})
+
+	engine := gin.New()
+	engine.GET("/", HandlerFactory(krakendgin.EndpointHandler, logging.NoOp)(endpoint, p))
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("unexpected status: %d", w.Code)
+	}
+	if w.Header().Get(statusHeader) != "" {
+		t.Error("the internal header was not removed")
+	}
+	if w.Body.String() != `{"a":1}` {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+}
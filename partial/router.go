@@ -0,0 +1,78 @@
+package partial
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	krakendgin "github.com/luraproject/lura/router/gin"
+)
+
+// HandlerFactory returns a handler factory applying the status codes decided by the proxy layer to
+// the endpoints with a partial config. The lura renders only honour the status of the response
+// metadata with the no-op encoding, so the handler rewrites the status of the other encodings.
+func HandlerFactory(next krakendgin.HandlerFactory, logger logging.Logger) krakendgin.HandlerFactory {
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(cfg, p)
+		if _, err := EndpointConfigGetter(cfg.ExtraConfig); err != nil {
+			return handler
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] partial response policy enabled", cfg.Endpoint))
+		return NewHandler(handler)
+	}
+}
+
+// NewHandler returns a gin handler replacing the status of the responses flagged by the proxy layer
+func NewHandler(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = &statusWriter{ResponseWriter: c.Writer}
+		next(c)
+	}
+}
+
+type statusWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if status, ok := w.flagged(); ok {
+		code = status
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) WriteString(s string) (int, error) {
+	w.apply()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *statusWriter) apply() {
+	if status, ok := w.flagged(); ok {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// flagged returns the status set by the proxy layer, removing the internal header
+func (w *statusWriter) flagged() (int, bool) {
+	h := w.ResponseWriter.Header()
+	v := h.Get(statusHeader)
+	if v == "" {
+		return 0, false
+	}
+	h.Del(statusHeader)
+	status, err := strconv.Atoi(v)
+	return status, err == nil
+}
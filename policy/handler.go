@@ -0,0 +1,204 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/ipfilter"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+var current = struct {
+	mu       sync.RWMutex
+	set      *Set
+	resolver ipfilter.Resolver
+}{}
+
+func setPolicies(s *Set) {
+	current.mu.Lock()
+	current.set = s
+	current.mu.Unlock()
+}
+
+func setResolver(r ipfilter.Resolver) {
+	current.mu.Lock()
+	current.resolver = r
+	current.mu.Unlock()
+}
+
+func clientIP(r *http.Request) string {
+	current.mu.RLock()
+	resolver := current.resolver
+	current.mu.RUnlock()
+	if ip := resolver.ClientIP(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func policies() *Set {
+	current.mu.RLock()
+	s := current.set
+	current.mu.RUnlock()
+	return s
+}
+
+// Register loads the policy files of the service config and reloads them on change until the context
+// is cancelled. The watcher starts even if the first load fails, so fixing the files recovers the
+// endpoints.
+func Register(ctx context.Context, cfg config.ServiceConfig, l logging.Logger) {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil {
+		if err != ErrNoConfig {
+			l.Warning(err.Error())
+		}
+		return
+	}
+	setResolver(service.resolver)
+	fp := fingerprint(service.Files)
+	if set, err := Load(service.Files); err != nil {
+		l.Error(err.Error(), "(denying the requests until the policies are loaded)")
+		// no fingerprint is empty, so the watcher retries on its first check
+		fp = ""
+	} else {
+		setPolicies(set)
+		l.Debug(fmt.Sprintf("policy: %d policies loaded", len(set.policies)))
+	}
+	go watch(ctx, service, fp, l)
+}
+
+func watch(ctx context.Context, cfg ServiceConfig, last string, l logging.Logger) {
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		fp := fingerprint(cfg.Files)
+		if fp == last {
+			continue
+		}
+		last = fp
+		set, err := Load(cfg.Files)
+		if err != nil {
+			l.Error(err.Error(), "(keeping the previous policies)")
+			continue
+		}
+		setPolicies(set)
+		l.Info(fmt.Sprintf("policy: %d policies reloaded", len(set.policies)))
+	}
+}
+
+// fingerprint summarizes the names, sizes and modification times of the files matching the patterns
+func fingerprint(patterns []string) string {
+	files, err := expand(patterns)
+	if err != nil {
+		return err.Error()
+	}
+	b := strings.Builder{}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			b.WriteString(err.Error())
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// HandlerFactory returns a handler factory rejecting the requests denied by the policies required by
+// the endpoints with a policy config
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return handlerFunc
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			// the endpoint can not be exposed without its authorization
+			return func(c *gin.Context) {
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] policy: %s", remote.Endpoint, strings.Join(cfg.Policies, ", ")))
+		validated := claims.ValidatesTokens(remote.ExtraConfig)
+		return func(c *gin.Context) {
+			set := policies()
+			if set == nil {
+				set = &Set{}
+			}
+			vars := Activation(c, validated)
+			for _, name := range cfg.Policies {
+				d := set.Evaluate(name, vars)
+				if d.Allowed {
+					continue
+				}
+				logger.Debug(fmt.Sprintf("[ENDPOINT: %s] policy: %s denied by the rule %q: %s", remote.Endpoint, d.Policy, d.Rule, d.Reason))
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"error":  "forbidden",
+					"policy": d.Policy,
+					"rule":   d.Rule,
+					"reason": d.Reason,
+				})
+				return
+			}
+			handlerFunc(c)
+		}
+	}
+}
+
+// Activation returns the values of the variables available to the policies for the request. The
+// claims of the bearer token are only exposed when the endpoint validates it (validated), and the
+// identity is the one set by the gateway authenticators for this request, so forged tokens and
+// headers are ignored.
+func Activation(c *gin.Context, validated bool) map[string]interface{} {
+	params := make(map[string]string, len(c.Params))
+	for _, p := range c.Params {
+		// same naming as the params of the proxy requests
+		params[strings.Title(p.Key[:1])+p.Key[1:]] = p.Value
+	}
+	var jwt map[string]interface{}
+	if validated {
+		jwt = claims.Decode(c.GetHeader(claims.AuthHeader))
+	}
+	if jwt == nil {
+		jwt = map[string]interface{}{}
+	}
+	identity := claims.FromContext(c.Request.Context())
+	if identity == nil {
+		identity = map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"now":             time.Now().Format(time.RFC3339),
+		"req_method":      c.Request.Method,
+		"req_path":        c.Request.URL.Path,
+		"req_params":      params,
+		"req_headers":     nonNil(c.Request.Header),
+		"req_querystring": nonNil(c.Request.URL.Query()),
+		"req_ip":          clientIP(c.Request),
+		"JWT":             jwt,
+		"identity":        identity,
+	}
+}
+
+func nonNil(v map[string][]string) map[string][]string {
+	if v == nil {
+		return map[string][]string{}
+	}
+	return v
+}
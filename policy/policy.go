@@ -0,0 +1,366 @@
+/*
+Package policy authorizes the requests with policies written as CEL rules over the full request
+context, loaded from files and reloaded when they change.
+
+The policy files are declared at service level, with glob patterns allowed:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/policy": {
+			"files": [ "./policies/*.yaml" ],
+			"reload_interval": "5s",
+			"trusted_proxies": [ "10.0.0.0/8" ],
+			"client_ip_header": "X-Forwarded-For"
+		}
+	}
+
+Every file, in JSON or YAML (.yaml and .yml extensions), contains a list of policies:
+
+	policies:
+	  - name: orders
+	    default: deny
+	    reason: only the admins and the gold partners can access the orders
+	    rules:
+	      - id: block-suspended
+	        effect: deny
+	        when: "has(JWT.status) && JWT.status == 'suspended'"
+	        reason: the account is suspended
+	      - id: admins
+	        effect: allow
+	        when: "has(JWT.roles) && 'admin' in JWT.roles"
+	      - id: partners-read
+	        effect: allow
+	        when: "req_method == 'GET' && has(identity.tier) && identity.tier == 'gold'"
+
+The rules of a policy are evaluated in order and the first one whose "when" expression returns true
+decides; when none matches, the default effect (deny by default) applies, with the reason of the
+policy. Expressions failing at runtime, like the ones accessing missing claims without the has()
+macro, deny the request.
+
+The endpoints declare the policies they require (all of them must allow the request):
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/policy": {
+			"policies": [ "orders" ]
+		}
+	}
+
+The expressions have access to the same request variables as the krakend-cel checks (req_method,
+req_path, req_params, req_headers, req_querystring and now), to req_ip (the client IP), to the JWT
+claims (JWT) and to the identity authenticated by the gateway itself (identity), i.e. the claims and
+metadata of an API key or the identity of a client certificate. The JWT claims are empty on the
+endpoints not validating the tokens with krakend-jose or krakend-auth, so the unsigned tokens grant
+nothing. The denied requests are rejected with
+a 403 and a body with the policy, the rule and the reason of the decision.
+
+The req_ip is the address of the connection, unless it comes from one of the trusted_proxies. Then
+the client_ip_header (X-Forwarded-For by default) is read from right to left and the first address not
+belonging to a trusted proxy is the client IP, as in the ipfilter package, so the clients can not
+spoof it.
+
+The files are checked every reload_interval (5s by default) and reloaded when any of them changes. If
+the new policies can not be loaded, the previous ones are kept. If not even the first ones can be
+loaded, the endpoints deny every request until the files are fixed.
+*/
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/celexpr"
+	"github.com/devopsfaith/krakend-ce/ipfilter"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	"github.com/luraproject/lura/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/policy"
+
+// The supported effects
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+const (
+	defaultHeader         = "X-Forwarded-For"
+	defaultReloadInterval = 5 * time.Second
+)
+
+// ErrNoConfig is returned when there is no policy config
+var ErrNoConfig = errors.New("policy: no config")
+
+// ServiceConfig is the custom config struct of the policy files
+type ServiceConfig struct {
+	Files          []string `json:"files"`
+	ReloadInterval string   `json:"reload_interval"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	ClientIPHeader string   `json:"client_ip_header"`
+
+	interval time.Duration
+	resolver ipfilter.Resolver
+}
+
+// Config is the custom config struct of the endpoints requiring policies
+type Config struct {
+	Policies []string `json:"policies"`
+}
+
+// File is the content of a policy file
+type File struct {
+	Policies []Policy `json:"policies" yaml:"policies"`
+}
+
+// Policy is an ordered set of rules
+type Policy struct {
+	Name    string `json:"name" yaml:"name"`
+	Default string `json:"default" yaml:"default"`
+	Reason  string `json:"reason" yaml:"reason"`
+	Rules   []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule applies its effect when its expression returns true
+type Rule struct {
+	ID     string `json:"id" yaml:"id"`
+	Effect string `json:"effect" yaml:"effect"`
+	When   string `json:"when" yaml:"when"`
+	Reason string `json:"reason" yaml:"reason"`
+}
+
+// Decision is the result of the evaluation of a policy
+type Decision struct {
+	Allowed bool   `json:"-"`
+	Policy  string `json:"policy"`
+	Rule    string `json:"rule,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the policy files config of the service
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{ClientIPHeader: defaultHeader, interval: defaultReloadInterval}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if len(cfg.Files) == 0 {
+		return cfg, errors.New("policy: no files declared")
+	}
+	if cfg.ReloadInterval != "" {
+		d, err := time.ParseDuration(cfg.ReloadInterval)
+		if err != nil {
+			return cfg, fmt.Errorf("policy: %s", err.Error())
+		}
+		if d <= 0 {
+			return cfg, fmt.Errorf("policy: non-positive reload_interval %s", cfg.ReloadInterval)
+		}
+		cfg.interval = d
+	}
+	trusted, err := ipfilter.ParseNets(cfg.TrustedProxies)
+	if err != nil {
+		return cfg, fmt.Errorf("policy: trusted_proxies: %s", err.Error())
+	}
+	cfg.resolver = ipfilter.Resolver{Trusted: trusted, Header: cfg.ClientIPHeader}
+	return cfg, nil
+}
+
+// ConfigGetter parses the policies required by the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if len(cfg.Policies) == 0 {
+		return cfg, errors.New("policy: no policies declared")
+	}
+	return cfg, nil
+}
+
+// Validate loads the policy files and checks the policies required by every endpoint exist
+func Validate(cfg config.ServiceConfig) error {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	hasService := err == nil
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	var set *Set
+	if hasService {
+		if set, err = Load(service.Files); err != nil {
+			return err
+		}
+	}
+	for _, e := range cfg.Endpoints {
+		c, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil && !hasService {
+			err = errors.New("policy: no policy files declared at service level")
+		}
+		if err == nil {
+			for _, name := range c.Policies {
+				if _, ok := set.policies[name]; !ok {
+					err = fmt.Errorf("policy: unknown policy %q", name)
+					break
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// Set is a set of compiled policies
+type Set struct {
+	policies map[string]*compiled
+}
+
+type compiled struct {
+	name   string
+	allow  bool
+	reason string
+	rules  []compiledRule
+}
+
+type compiledRule struct {
+	id      string
+	allow   bool
+	reason  string
+	program cel.Program
+}
+
+// Load reads and compiles the policies of the files matching the patterns
+func Load(patterns []string) (*Set, error) {
+	files, err := expand(patterns)
+	if err != nil {
+		return nil, err
+	}
+	set := &Set{policies: map[string]*compiled{}}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("policy: %s", err.Error())
+		}
+		f := File{}
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(b, &f)
+		default:
+			err = json.Unmarshal(b, &f)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("policy: %s: %s", file, err.Error())
+		}
+		for _, p := range f.Policies {
+			if _, ok := set.policies[p.Name]; ok {
+				return nil, fmt.Errorf("policy: %s: duplicated policy %q", file, p.Name)
+			}
+			c, err := compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("policy: %s: %s", file, err.Error())
+			}
+			set.policies[p.Name] = c
+		}
+	}
+	return set, nil
+}
+
+func expand(patterns []string) ([]string, error) {
+	files := []string{}
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("policy: %s", err.Error())
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("policy: no files matching %s", pattern)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func declarations() cel.EnvOption {
+	return cel.Declarations(
+		decls.NewIdent("req_ip", decls.String, nil),
+		decls.NewIdent("identity", decls.NewMapType(decls.String, decls.Dyn), nil),
+	)
+}
+
+func compile(p Policy) (*compiled, error) {
+	if p.Name == "" {
+		return nil, errors.New("policy without name")
+	}
+	c := &compiled{name: p.Name, reason: p.Reason}
+	switch p.Default {
+	case "", EffectDeny:
+	case EffectAllow:
+		c.allow = true
+	default:
+		return nil, fmt.Errorf("policy %q has an unknown default effect %q", p.Name, p.Default)
+	}
+	for i, r := range p.Rules {
+		id := r.ID
+		if id == "" {
+			id = fmt.Sprintf("#%d", i)
+		}
+		rule := compiledRule{id: id, reason: r.Reason}
+		switch r.Effect {
+		case EffectAllow:
+			rule.allow = true
+		case EffectDeny:
+		default:
+			return nil, fmt.Errorf("policy %q, rule %s has an unknown effect %q", p.Name, id, r.Effect)
+		}
+		program, err := celexpr.Compile(r.When, declarations())
+		if err != nil {
+			return nil, fmt.Errorf("policy %q, rule %s: %s", p.Name, id, err.Error())
+		}
+		rule.program = program
+		c.rules = append(c.rules, rule)
+	}
+	return c, nil
+}
+
+// Evaluate returns the decision of the named policy over the request variables
+func (s *Set) Evaluate(name string, vars map[string]interface{}) Decision {
+	p, ok := s.policies[name]
+	if !ok {
+		return Decision{Policy: name, Reason: "unknown policy"}
+	}
+	for _, r := range p.rules {
+		matched, err := celexpr.Eval(r.program, vars)
+		if err != nil {
+			return Decision{Policy: name, Rule: r.id, Reason: "evaluation error"}
+		}
+		if matched {
+			return Decision{Allowed: r.allow, Policy: name, Rule: r.id, Reason: r.reason}
+		}
+	}
+	d := Decision{Allowed: p.allow, Policy: name}
+	if !p.allow {
+		d.Reason = p.reason
+	}
+	return d
+}
@@ -0,0 +1,245 @@
+package policy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/ipfilter"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+const ordersPolicy = `
+policies:
+  - name: orders
+    reason: not allowed
+    rules:
+      - id: suspended
+        effect: deny
+        when: "has(JWT.status) && JWT.status == 'suspended'"
+        reason: the account is suspended
+      - id: admins
+        effect: allow
+        when: "has(JWT.roles) && 'admin' in JWT.roles"
+      - id: partners-read
+        effect: allow
+        when: "req_method == 'GET' && identity.tier == 'gold' && req_params.Id != '0'"
+      - id: internal
+        effect: allow
+        when: "req_ip.startsWith('10.')"
+`
+
+func writeFile(t *testing.T, file, content string) {
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func token(c map[string]interface{}) string {
+	return "Bearer e30." + claims.Encode(c) + ".sig"
+}
+
+func TestHandlerFactory(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "orders.yaml"), ordersPolicy)
+	set, err := Load([]string{filepath.Join(dir, "*.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPolicies(set)
+	defer setPolicies(nil)
+	trusted, _ := ipfilter.ParseNets([]string{"172.16.0.0/12"})
+	setResolver(ipfilter.Resolver{Trusted: trusted, Header: defaultHeader})
+	defer setResolver(ipfilter.Resolver{})
+
+	gin.SetMode(gin.TestMode)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	}, logging.NoOp)
+	engine := gin.New()
+	engine.Any("/orders/:id", hf(&config.EndpointConfig{
+		Endpoint: "/orders/:id",
+		ExtraConfig: config.ExtraConfig{
+			Namespace:                           map[string]interface{}{"policies": []interface{}{"orders"}},
+			"github.com/unacademy/krakend-auth": map[string]interface{}{"enable": true, "abort_if_unauthorized": true},
+		},
+	}, proxy.NoopProxy))
+	engine.Any("/public/orders/:id", hf(&config.EndpointConfig{
+		Endpoint:    "/public/orders/:id",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"policies": []interface{}{"orders"}}},
+	}, proxy.NoopProxy))
+
+	for i, tc := range []struct {
+		method   string
+		path     string
+		jwt      map[string]interface{}
+		identity map[string]interface{}
+		forged   map[string]interface{}
+		ip       string
+		xff      string
+		status   int
+		body     string
+	}{
+		{method: "DELETE", path: "/orders/1", jwt: map[string]interface{}{"roles": []interface{}{"admin"}}, status: http.StatusOK},
+		{method: "DELETE", path: "/orders/1", jwt: map[string]interface{}{"roles": []interface{}{"admin"}, "status": "suspended"}, status: http.StatusForbidden,
+			body: `{"error":"forbidden","policy":"orders","reason":"the account is suspended","rule":"suspended"}`},
+		{method: "GET", path: "/orders/1", identity: map[string]interface{}{"tier": "gold"}, status: http.StatusOK},
+		{method: "GET", path: "/orders/0", identity: map[string]interface{}{"tier": "gold"}, status: http.StatusForbidden,
+			body: `{"error":"forbidden","policy":"orders","reason":"not allowed","rule":""}`},
+		{method: "POST", path: "/orders/1", identity: map[string]interface{}{"tier": "gold"}, status: http.StatusForbidden},
+		{method: "POST", path: "/orders/1", ip: "10.0.0.1", status: http.StatusOK},
+		{method: "POST", path: "/orders/1", ip: "172.16.0.1", xff: "10.0.0.1", status: http.StatusOK},
+		// the forwarding header is only trusted when sent by the trusted proxies
+		{method: "POST", path: "/orders/1", xff: "10.0.0.1", status: http.StatusForbidden},
+		{method: "POST", path: "/orders/1", ip: "172.16.0.1", xff: "10.0.0.1, 192.168.1.1", status: http.StatusForbidden},
+		// the tier is missing, so the evaluation fails and the request is denied
+		{method: "GET", path: "/orders/1", jwt: map[string]interface{}{"sub": "a"}, status: http.StatusForbidden,
+			body: `{"error":"forbidden","policy":"orders","reason":"evaluation error","rule":"partners-read"}`},
+		// the endpoint does not validate the tokens, so their claims are ignored
+		{method: "DELETE", path: "/public/orders/1", jwt: map[string]interface{}{"roles": []interface{}{"admin"}}, status: http.StatusForbidden},
+		// the identity is only set by the gateway authenticators
+		{method: "GET", path: "/orders/1", forged: map[string]interface{}{"tier": "gold"}, status: http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.identity != nil {
+			req = claims.Authenticate(req, tc.identity)
+		}
+		if tc.jwt != nil {
+			req.Header.Set(claims.AuthHeader, token(tc.jwt))
+		}
+		if tc.forged != nil {
+			req.Header.Set(claims.GatewayHeader, claims.Encode(tc.forged))
+		}
+		req.RemoteAddr = "192.168.1.1:1234"
+		if tc.ip != "" {
+			req.RemoteAddr = tc.ip + ":1234"
+		}
+		if tc.xff != "" {
+			req.Header.Set(defaultHeader, tc.xff)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code %d (%s)", i, w.Code, w.Body.String())
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("#%d: unexpected body %s", i, w.Body.String())
+		}
+	}
+}
+
+func TestRegister_reload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "policies.json")
+	writeFile(t, file, `{"policies":[{"name":"p","rules":[{"effect":"allow","when":"req_method == 'GET'"}]}]}`)
+	defer setPolicies(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Register(ctx, config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"files":           []interface{}{file},
+		"reload_interval": "10ms",
+	}}}, logging.NoOp)
+
+	get := map[string]interface{}{"req_method": "GET"}
+	if !policies().Evaluate("p", get).Allowed {
+		t.Fatal("policy not loaded")
+	}
+
+	// invalid policies are discarded
+	writeFile(t, file, `{"policies":[{"name":"p","rules":[{"effect":"allow","when":"req_method +"}]}]}`)
+	touch(t, file, time.Now().Add(time.Second))
+	time.Sleep(50 * time.Millisecond)
+	if !policies().Evaluate("p", get).Allowed {
+		t.Error("previous policies not kept")
+	}
+
+	writeFile(t, file, `{"policies":[{"name":"p","rules":[{"effect":"deny","when":"req_method == 'GET'","reason":"read only"}]}]}`)
+	touch(t, file, time.Now().Add(2*time.Second))
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if d := policies().Evaluate("p", get); !d.Allowed && d.Reason == "read only" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("policies not reloaded")
+}
+
+func TestRegister_invalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "policies.json")
+	writeFile(t, file, `{"policies":[{"name":"p","rules":[{"effect":"allow","when":"req_method +"}]}]}`)
+	defer setPolicies(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	Register(ctx, config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"files":           []interface{}{file},
+		"reload_interval": "10ms",
+	}}}, logging.NoOp)
+	if policies() != nil {
+		t.Fatal("invalid policies loaded")
+	}
+
+	writeFile(t, file, `{"policies":[{"name":"p","rules":[{"effect":"allow","when":"req_method == 'GET'"}]}]}`)
+	touch(t, file, time.Now().Add(time.Second))
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if set := policies(); set != nil && set.Evaluate("p", map[string]interface{}{"req_method": "GET"}).Allowed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("fixed policies not loaded")
+}
+
+func touch(t *testing.T, file string, mtime time.Time) {
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "orders.yml")
+	writeFile(t, file, ordersPolicy)
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{{
+			Method:      "GET",
+			Endpoint:    "/a",
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"policies": []interface{}{"orders"}}},
+		}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("endpoint policies accepted without files")
+	}
+	cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{"files": []interface{}{file}}}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	for _, interval := range []string{"0s", "-1s"} {
+		cfg.ExtraConfig[Namespace].(map[string]interface{})["reload_interval"] = interval
+		if err := Validate(cfg); err == nil {
+			t.Errorf("reload interval %s accepted", interval)
+		}
+	}
+	delete(cfg.ExtraConfig[Namespace].(map[string]interface{}), "reload_interval")
+	cfg.Endpoints[0].ExtraConfig[Namespace] = map[string]interface{}{"policies": []interface{}{"billing"}}
+	if err := Validate(cfg); err == nil {
+		t.Error("unknown policy accepted")
+	}
+	writeFile(t, file, `policies: [{name: x, rules: [{effect: allow, when: "req_method"}]}]`)
+	if err := Validate(cfg); err == nil {
+		t.Error("non boolean expression accepted")
+	}
+}
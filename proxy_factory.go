@@ -2,30 +2,53 @@ package krakend
 
 import (
 	errorHandler "github.com/Unacademy/krakend-error-handler"
+	"github.com/devopsfaith/krakend-ce/canary"
+	"github.com/devopsfaith/krakend-ce/conditional"
+	"github.com/devopsfaith/krakend-ce/fanout"
+	"github.com/devopsfaith/krakend-ce/mirror"
+	"github.com/devopsfaith/krakend-ce/openapi"
+	"github.com/devopsfaith/krakend-ce/partial"
+	"github.com/devopsfaith/krakend-ce/redact"
+	"github.com/devopsfaith/krakend-ce/transform"
 	cel "github.com/devopsfaith/krakend-cel"
 	jsonschema "github.com/devopsfaith/krakend-jsonschema"
 	lua "github.com/devopsfaith/krakend-lua/proxy"
 	metrics "github.com/devopsfaith/krakend-metrics/gin"
 	opencensus "github.com/devopsfaith/krakend-opencensus"
+	"github.com/luraproject/lura/config"
 	"github.com/luraproject/lura/logging"
 	"github.com/luraproject/lura/proxy"
 )
 
 // NewProxyFactory returns a new ProxyFactory wrapping the injected BackendFactory with the default proxy stack and a metrics collector
 func NewProxyFactory(logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
+	return NewProxyFactoryWithConfig(logger, backendFactory, metricCollector, config.ServiceConfig{})
+}
+
+// NewProxyFactoryWithConfig returns a ProxyFactory with service configuration for the OpenAPI request validation and the redaction rules
+func NewProxyFactoryWithConfig(logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics, serviceConfig config.ServiceConfig) proxy.Factory {
 	proxyFactory := proxy.NewDefaultFactory(backendFactory, logger)
-	proxyFactory = proxy.NewShadowFactory(proxyFactory)
+	proxyFactory = conditional.ProxyFactory(logger, proxyFactory)
+	proxyFactory = fanout.ProxyFactory(logger, proxyFactory)
+	proxyFactory = canary.NewFactory(proxyFactory, logger, *metricCollector.Registry)
+	proxyFactory = mirror.NewShadowFactory(proxyFactory, logger, *metricCollector.Registry)
+	proxyFactory = partial.ProxyFactory(logger, proxyFactory)
+	proxyFactory = openapi.ProxyFactory(logger, proxyFactory, serviceConfig.ExtraConfig)
 	proxyFactory = errorHandler.ProxyFactory(proxyFactory)
 	proxyFactory = jsonschema.ProxyFactory(proxyFactory)
 	proxyFactory = cel.ProxyFactory(logger, proxyFactory)
 	proxyFactory = lua.ProxyFactory(logger, proxyFactory)
+	proxyFactory = transform.ProxyFactory(logger, proxyFactory)
+	proxyFactory = redact.ProxyFactory(logger, proxyFactory, serviceConfig.ExtraConfig)
 	proxyFactory = metricCollector.ProxyFactory("pipe", proxyFactory)
 	proxyFactory = opencensus.ProxyFactory(proxyFactory)
 	return proxyFactory
 }
 
-type proxyFactory struct{}
+type proxyFactory struct {
+	serviceConfig config.ServiceConfig
+}
 
 func (p proxyFactory) NewProxyFactory(logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
-	return NewProxyFactory(logger, backendFactory, metricCollector)
+	return NewProxyFactoryWithConfig(logger, backendFactory, metricCollector, p.serviceConfig)
 }
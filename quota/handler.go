@@ -0,0 +1,155 @@
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/admin"
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+var current = struct {
+	mu        sync.RWMutex
+	manager   *Manager
+	planClaim string
+}{}
+
+// Register loads the plans of the service config, to be used by the handlers created from then on,
+// and registers the admin endpoint if declared. The counters are kept in the ratelimit store.
+func Register(cfg config.ServiceConfig, l logging.Logger, engine *gin.Engine) {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil {
+		if err != ErrNoConfig {
+			l.Warning("quota:", err.Error())
+		}
+		return
+	}
+	m := NewManager(ratelimit.DefaultStore(), service)
+	current.mu.Lock()
+	current.manager, current.planClaim = m, service.PlanClaim
+	current.mu.Unlock()
+
+	if service.AdminPath == "" {
+		return
+	}
+	group := engine.Group(service.AdminPath, admin.Middleware(service.AdminToken))
+	group.GET("/:consumer", func(c *gin.Context) {
+		consumer := c.Param("consumer")
+		plan, ok := m.Plan(consumer, c.Query("plan"))
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "no plan for the consumer"})
+			return
+		}
+		u, err := m.Usage(c.Request.Context(), consumer, plan)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, u)
+	})
+	group.DELETE("/:consumer", func(c *gin.Context) {
+		consumer := c.Param("consumer")
+		if err := m.Reset(c.Request.Context(), consumer); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		l.Info("quota admin: usage reset for", consumer)
+		c.Status(http.StatusNoContent)
+	})
+	l.Debug("quota admin: registered at", service.AdminPath)
+}
+
+// HandlerFactory returns a handler factory counting the requests of the endpoints with a quota config
+// against the plans of their consumers
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err != nil {
+			if err != ErrNoConfig {
+				logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			}
+			return handlerFunc
+		}
+		current.mu.RLock()
+		m, planClaim := current.manager, current.planClaim
+		current.mu.RUnlock()
+		if m == nil {
+			logger.Warning(fmt.Sprintf("[ENDPOINT: %s] quota: no plans declared at service level", remote.Endpoint))
+			return handlerFunc
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] quota: consumers identified by the claim %s", remote.Endpoint, cfg.Key))
+		return newHandler(m, cfg, planClaim, logger, remote.Endpoint, handlerFunc)
+	}
+}
+
+func newHandler(m *Manager, cfg Config, planClaim string, logger logging.Logger, name string, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cs := claims.FromHTTPRequest(c.Request)
+		consumer, _ := claims.LookupString(cs, cfg.Key)
+		var claimed string
+		if planClaim != "" {
+			claimed, _ = claims.LookupString(cs, planClaim)
+		}
+		if consumer == "" {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "unknown consumer"})
+			return
+		}
+		plan, ok := m.Plan(consumer, claimed)
+		if !ok {
+			next(c)
+			return
+		}
+
+		u, allowed, err := m.Consume(c.Request.Context(), consumer, plan, cfg.Cost)
+		if err != nil {
+			logger.Warning(fmt.Sprintf("[ENDPOINT: %s] quota: %s", name, err.Error()))
+			next(c)
+			return
+		}
+		w, ok := u.Tightest()
+		if !ok {
+			next(c)
+			return
+		}
+		setHeaders(c, w)
+		if !allowed {
+			c.Header("Retry-After", strconv.FormatInt(secondsUntil(w.Reset), 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":  "quota exceeded",
+				"window": w.Window,
+				"reset":  w.Reset.Format(time.RFC3339),
+			})
+			return
+		}
+		next(c)
+	}
+}
+
+func setHeaders(c *gin.Context, w WindowUsage) {
+	limit := strconv.FormatInt(w.Limit, 10)
+	remaining := strconv.FormatInt(w.Remaining, 10)
+	c.Header("X-RateLimit-Limit", limit)
+	c.Header("X-RateLimit-Remaining", remaining)
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(w.Reset.Unix(), 10))
+	c.Header("RateLimit-Limit", limit)
+	c.Header("RateLimit-Remaining", remaining)
+	c.Header("RateLimit-Reset", strconv.FormatInt(secondsUntil(w.Reset), 10))
+}
+
+func secondsUntil(t time.Time) int64 {
+	d := time.Until(t)
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,353 @@
+/*
+Package quota enforces daily and monthly quotas per consumer, identified by a claim of the identity
+authenticated by the gateway (a validated JWT, an API key or a client certificate), with the counters kept in the store of the ratelimit package (a redis-compatible server to keep them
+across restarts and instances).
+
+The plans, the consumers with a non-default plan and the admin endpoint are declared at service level:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/quota": {
+			"plans": {
+				"free": { "daily": 1000 },
+				"partner": { "daily": 50000, "monthly": 1000000 }
+			},
+			"default_plan": "free",
+			"consumers": { "key-4f2a": "partner" },
+			"plan_claim": "plan",
+			"admin_path": "/__quota",
+			"admin_token": "s3cr3t"
+		}
+	}
+
+The plan of a consumer is the one assigned in the consumers map or, if missing, the one found in the
+plan_claim of the JWT, falling back to the default_plan. Consumers without plan are not limited.
+The daily and monthly windows follow the UTC calendar and a zero (or missing) limit means no limit.
+
+The endpoints counting against the quotas declare the claim identifying the consumer (sub by default,
+the id of an API key), and the cost of every request (1 by default):
+
+	...
+	"endpoint": "/partners/orders",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/quota": {
+			"key": "client_id",
+			"cost": 1
+		}
+	},
+	...
+
+The endpoints must authenticate the requests (with krakend-jose, krakend-auth, an API key or a client
+certificate), so the consumers can not be forged. Every response gets the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset (epoch seconds)
+headers, and the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset (seconds) ones, describing the
+most restrictive window. The requests without consumer or over the quota are rejected with a 429,
+carrying a Retry-After header and the reset time in the body. The requests are allowed if the store
+fails.
+
+The admin endpoint returns the usage of a consumer with GET {admin_path}/{consumer} and resets it with
+DELETE {admin_path}/{consumer}. The plan can be set with the "plan" query string for the consumers
+getting it from their tokens. Both require the admin_token as bearer token (Authorization: Bearer
+s3cr3t).
+*/
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/admin"
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/luraproject/lura/config"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/quota"
+
+// The supported windows
+const (
+	Daily   = "daily"
+	Monthly = "monthly"
+)
+
+const (
+	defaultPrefix = "krakend:quota:"
+	defaultClaim  = "sub"
+	// retention keeps the counters of a window for a while after its end
+	retention = 24 * time.Hour
+)
+
+// ErrNoConfig is returned when there is no quota config
+var ErrNoConfig = errors.New("quota: no config")
+
+// ServiceConfig is the custom config struct of the quota plans
+type ServiceConfig struct {
+	Plans       map[string]Plan   `json:"plans"`
+	DefaultPlan string            `json:"default_plan"`
+	Consumers   map[string]string `json:"consumers"`
+	PlanClaim   string            `json:"plan_claim"`
+	AdminPath   string            `json:"admin_path"`
+	AdminToken  string            `json:"admin_token"`
+	Prefix      string            `json:"prefix"`
+}
+
+// Plan contains the limits of every window
+type Plan struct {
+	Daily   int64 `json:"daily"`
+	Monthly int64 `json:"monthly"`
+}
+
+// Config is the custom config struct of the endpoints counting against the quotas
+type Config struct {
+	Key  string `json:"key"`
+	Cost int64  `json:"cost"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the quota plans of the service
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.DefaultPlan != "" {
+		if _, ok := cfg.Plans[cfg.DefaultPlan]; !ok {
+			return cfg, fmt.Errorf("quota: unknown default plan %q", cfg.DefaultPlan)
+		}
+	}
+	for consumer, plan := range cfg.Consumers {
+		if _, ok := cfg.Plans[plan]; !ok {
+			return cfg, fmt.Errorf("quota: unknown plan %q for the consumer %q", plan, consumer)
+		}
+	}
+	if cfg.AdminPath != "" && !strings.HasPrefix(cfg.AdminPath, "/") {
+		return cfg, fmt.Errorf("quota: invalid admin path %q", cfg.AdminPath)
+	}
+	if cfg.AdminPath != "" && cfg.AdminToken == "" {
+		return cfg, fmt.Errorf("quota: %s", admin.ErrNoToken.Error())
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	return cfg, nil
+}
+
+// ConfigGetter parses the quota config of the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Key == "" {
+		cfg.Key = defaultClaim
+	}
+	if cfg.Cost < 0 {
+		return cfg, fmt.Errorf("quota: invalid cost %d", cfg.Cost)
+	}
+	if cfg.Cost == 0 {
+		cfg.Cost = 1
+	}
+	return cfg, nil
+}
+
+// Validate checks the plans of the service and the quota config of every endpoint, which must
+// authenticate the requests
+func Validate(cfg config.ServiceConfig) error {
+	_, err := ServiceConfigGetter(cfg.ExtraConfig)
+	hasService := err == nil
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	for _, e := range cfg.Endpoints {
+		_, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			continue
+		}
+		if err == nil && !hasService {
+			err = errors.New("quota: no plans declared at service level")
+		}
+		if err == nil && !claims.Authenticates(e.ExtraConfig) {
+			err = errors.New("quota: the endpoint does not authenticate the consumers")
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+// WindowUsage is the usage of a consumer in a window
+type WindowUsage struct {
+	Window    string    `json:"window"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// Usage is the usage of a consumer in every limited window of its plan
+type Usage struct {
+	Consumer string        `json:"consumer"`
+	Plan     string        `json:"plan"`
+	Windows  []WindowUsage `json:"windows"`
+}
+
+// Tightest returns the window with less requests remaining, or false if no window is limited
+func (u Usage) Tightest() (WindowUsage, bool) {
+	if len(u.Windows) == 0 {
+		return WindowUsage{}, false
+	}
+	w := u.Windows[0]
+	for _, c := range u.Windows[1:] {
+		if c.Remaining < w.Remaining {
+			w = c
+		}
+	}
+	return w, true
+}
+
+// Manager keeps the usage of the consumers in a store
+type Manager struct {
+	store ratelimit.Store
+	cfg   ServiceConfig
+	now   func() time.Time
+}
+
+// NewManager returns a Manager with the plans of the config, keeping the counters in the store
+func NewManager(store ratelimit.Store, cfg ServiceConfig) *Manager {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	return &Manager{store: store, cfg: cfg, now: time.Now}
+}
+
+// Plan returns the name of the plan of the consumer, looking for it in the consumers map, the plan
+// claimed by its token (if any) and the default plan, in order
+func (m *Manager) Plan(consumer, claimed string) (string, bool) {
+	if p, ok := m.cfg.Consumers[consumer]; ok {
+		return p, true
+	}
+	if _, ok := m.cfg.Plans[claimed]; ok {
+		return claimed, true
+	}
+	if m.cfg.DefaultPlan != "" {
+		return m.cfg.DefaultPlan, true
+	}
+	return "", false
+}
+
+type window struct {
+	name  string
+	limit int64
+	key   string
+	reset time.Time
+}
+
+func (m *Manager) windows(consumer string, plan Plan) []window {
+	now := m.now().UTC()
+	year, month, day := now.Date()
+	ws := []window{}
+	if plan.Daily > 0 {
+		ws = append(ws, window{
+			name:  Daily,
+			limit: plan.Daily,
+			key:   m.cfg.Prefix + consumer + ":d:" + now.Format("20060102"),
+			reset: time.Date(year, month, day+1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	if plan.Monthly > 0 {
+		ws = append(ws, window{
+			name:  Monthly,
+			limit: plan.Monthly,
+			key:   m.cfg.Prefix + consumer + ":m:" + now.Format("200601"),
+			reset: time.Date(year, month+1, 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	return ws
+}
+
+// Consume adds the cost to every window of the plan, unless any of them would exceed its limit, and
+// returns the resulting usage and whether the cost was accepted
+func (m *Manager) Consume(ctx context.Context, consumer, plan string, cost int64) (Usage, bool, error) {
+	u := Usage{Consumer: consumer, Plan: plan}
+	ws := m.windows(consumer, m.cfg.Plans[plan])
+	now := m.now()
+	values := make([]int64, len(ws))
+	exceeded := false
+	for i, w := range ws {
+		v, err := m.store.Incr(ctx, w.key, cost, w.reset.Sub(now)+retention)
+		if err != nil {
+			m.rollback(ctx, ws[:i], cost)
+			return u, false, err
+		}
+		values[i] = v
+		exceeded = exceeded || v > w.limit
+	}
+	if exceeded {
+		// the rejected requests do not count
+		if err := m.rollback(ctx, ws, cost); err != nil {
+			return u, false, err
+		}
+		for i := range values {
+			values[i] -= cost
+		}
+	}
+	for i, w := range ws {
+		u.Windows = append(u.Windows, newWindowUsage(w, values[i]))
+	}
+	return u, !exceeded, nil
+}
+
+func (m *Manager) rollback(ctx context.Context, ws []window, cost int64) error {
+	now := m.now()
+	for _, w := range ws {
+		if _, err := m.store.Incr(ctx, w.key, -cost, w.reset.Sub(now)+retention); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Usage returns the current usage of the consumer
+func (m *Manager) Usage(ctx context.Context, consumer, plan string) (Usage, error) {
+	u := Usage{Consumer: consumer, Plan: plan}
+	for _, w := range m.windows(consumer, m.cfg.Plans[plan]) {
+		v, err := m.store.Get(ctx, w.key)
+		if err != nil {
+			return u, err
+		}
+		u.Windows = append(u.Windows, newWindowUsage(w, v))
+	}
+	return u, nil
+}
+
+// Reset removes the counters of the current windows of the consumer
+func (m *Manager) Reset(ctx context.Context, consumer string) error {
+	keys := []string{}
+	for _, w := range m.windows(consumer, Plan{Daily: 1, Monthly: 1}) {
+		keys = append(keys, w.key)
+	}
+	return m.store.Del(ctx, keys...)
+}
+
+func newWindowUsage(w window, used int64) WindowUsage {
+	remaining := w.limit - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return WindowUsage{Window: w.name, Limit: w.limit, Used: used, Remaining: remaining, Reset: w.reset}
+}
@@ -0,0 +1,174 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestManager(t *testing.T) {
+	m := NewManager(ratelimit.NewMemoryStore(), ServiceConfig{
+		Plans:       map[string]Plan{"free": {Daily: 2, Monthly: 3}},
+		DefaultPlan: "free",
+	})
+	m.now = func() time.Time { return time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+
+	for i, allowed := range []bool{true, true, false} {
+		u, ok, err := m.Consume(ctx, "abc", "free", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != allowed {
+			t.Errorf("#%d: unexpected result %v", i, ok)
+		}
+		if w, _ := u.Tightest(); w.Window != Daily || w.Reset != time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC) {
+			t.Errorf("#%d: unexpected tightest window %+v", i, w)
+		}
+	}
+
+	// the windows of a new month start empty
+	m.now = func() time.Time { return time.Date(2026, 2, 1, 1, 0, 0, 0, time.UTC) }
+	if _, ok, _ := m.Consume(ctx, "abc", "free", 1); !ok {
+		t.Error("request rejected in a new month")
+	}
+	m.now = func() time.Time { return time.Date(2026, 1, 31, 23, 30, 0, 0, time.UTC) }
+	u, err := m.Usage(ctx, "abc", "free")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Windows[0].Used != 2 || u.Windows[1].Used != 2 || u.Windows[1].Remaining != 1 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+	if _, ok, _ := m.Consume(ctx, "abc", "free", 2); ok {
+		t.Error("cost over the limit accepted")
+	}
+
+	if err := m.Reset(ctx, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := m.Usage(ctx, "abc", "free"); u.Windows[0].Used != 0 || u.Windows[1].Used != 0 {
+		t.Errorf("unexpected usage after the reset %+v", u)
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	Register(config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"plans": map[string]interface{}{
+			"free":    map[string]interface{}{"daily": 1},
+			"partner": map[string]interface{}{"daily": 5, "monthly": 100},
+		},
+		"consumers":   map[string]interface{}{"key-partner": "partner"},
+		"admin_path":  "/__quota",
+		"admin_token": "s3cr3t",
+	}}}, logging.NoOp, engine)
+	current.manager.store = ratelimit.NewMemoryStore()
+
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	}, logging.NoOp)
+	engine.GET("/orders", hf(&config.EndpointConfig{
+		Endpoint:    "/orders",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"cost": 2}},
+	}, proxy.NoopProxy))
+
+	do := func(method, path, sub string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if sub != "" {
+			req.Header.Set(claims.GatewayHeader, claims.Encode(map[string]interface{}{"sub": sub}))
+		}
+		req.Header.Set("Authorization", "Bearer s3cr3t")
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, tc := range []struct {
+		key       string
+		status    int
+		remaining string
+	}{
+		{key: "key-partner", status: http.StatusOK, remaining: "3"},
+		{key: "key-partner", status: http.StatusOK, remaining: "1"},
+		{key: "key-partner", status: http.StatusTooManyRequests, remaining: "1"},
+		{key: "key-unknown", status: http.StatusOK},
+		{status: http.StatusTooManyRequests},
+	} {
+		w := do("GET", "/orders", tc.key)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code %d", i, w.Code)
+		}
+		if r := w.Header().Get("X-RateLimit-Remaining"); r != tc.remaining {
+			t.Errorf("#%d: unexpected remaining header %q", i, r)
+		}
+		if tc.status == http.StatusTooManyRequests && tc.key != "" && w.Header().Get("Retry-After") == "" {
+			t.Errorf("#%d: no Retry-After header", i)
+		}
+	}
+
+	req := httptest.NewRequest("DELETE", "/__quota/key-partner", nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code without the admin token: %d", w.Code)
+	}
+
+	w = do("GET", "/__quota/key-partner", "")
+	u := Usage{}
+	if err := json.Unmarshal(w.Body.Bytes(), &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Plan != "partner" || len(u.Windows) != 2 || u.Windows[0].Used != 4 {
+		t.Errorf("unexpected usage %+v", u)
+	}
+	if w := do("DELETE", "/__quota/key-partner", ""); w.Code != http.StatusNoContent {
+		t.Errorf("unexpected status code resetting the usage: %d", w.Code)
+	}
+	if w := do("GET", "/orders", "key-partner"); w.Code != http.StatusOK {
+		t.Errorf("unexpected status code after the reset: %d", w.Code)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		Endpoints: []*config.EndpointConfig{{
+			Method:      "GET",
+			Endpoint:    "/a",
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"key": "client_id"}},
+		}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("endpoint quota accepted without plans")
+	}
+	cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{
+		"plans":     map[string]interface{}{"free": map[string]interface{}{"daily": 10}},
+		"consumers": map[string]interface{}{"abc": "gold"},
+	}}
+	if err := Validate(cfg); err == nil {
+		t.Error("unknown plan accepted")
+	}
+	delete(cfg.ExtraConfig[Namespace].(map[string]interface{}), "consumers")
+	if err := Validate(cfg); err == nil {
+		t.Error("endpoint quota accepted without authentication")
+	}
+	cfg.Endpoints[0].ExtraConfig["github.com/devopsfaith/krakend-ce/apikey"] = map[string]interface{}{}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.ExtraConfig[Namespace].(map[string]interface{})["admin_path"] = "/__quota"
+	if err := Validate(cfg); err == nil {
+		t.Error("admin path accepted without admin token")
+	}
+}
@@ -0,0 +1,215 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+)
+
+// The supported algorithms
+const (
+	SlidingWindow = "sliding_window"
+	GCRA          = "gcra"
+)
+
+const maxReservations = 4096
+
+// Limiter decides if the requests identified by a key are allowed
+type Limiter interface {
+	Allow(ctx context.Context, key string) (bool, error)
+}
+
+// Rate defines the limit of a Limiter
+type Rate struct {
+	// Max is the number of requests allowed every period
+	Max   int64
+	Every time.Duration
+	// Burst is the number of requests the GCRA algorithm allows at once. It defaults to Max.
+	Burst int64
+	// Batch is the number of tokens reserved at once from the store, served locally until the end of
+	// the window. It defaults to 1 (no batching).
+	Batch int64
+}
+
+type algorithm interface {
+	// reserve takes up to n tokens from the store, returning the tokens granted and their expiration
+	reserve(ctx context.Context, store Store, key string, n int64, now time.Time) (int64, time.Time, error)
+}
+
+// NewLimiter returns a Limiter with the algorithm and rate, keeping the counters in the store
+func NewLimiter(algorithm string, rate Rate, store Store) (Limiter, error) {
+	if rate.Max <= 0 || rate.Every <= 0 {
+		return nil, fmt.Errorf("ratelimit: invalid rate %d every %s", rate.Max, rate.Every)
+	}
+	if rate.Batch <= 0 {
+		rate.Batch = 1
+	}
+	l := &limiter{store: store, batch: rate.Batch, local: map[string]*reservation{}}
+	switch algorithm {
+	case "", SlidingWindow:
+		l.algorithm = slidingWindow{max: rate.Max, every: rate.Every}
+	case GCRA:
+		burst := rate.Burst
+		if burst <= 0 {
+			burst = rate.Max
+		}
+		interval := int64(rate.Every/time.Microsecond) / rate.Max
+		if interval <= 0 {
+			interval = 1
+		}
+		l.algorithm = gcra{interval: interval, capacity: burst * interval, every: rate.Every}
+	default:
+		return nil, fmt.Errorf("ratelimit: unknown algorithm %q", algorithm)
+	}
+	return l, nil
+}
+
+type reservation struct {
+	tokens int64
+	until  time.Time
+}
+
+type limiter struct {
+	store     Store
+	algorithm algorithm
+	batch     int64
+
+	mu    sync.Mutex
+	local map[string]*reservation
+}
+
+// Allow implements the Limiter interface
+func (l *limiter) Allow(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	if l.batch > 1 {
+		l.mu.Lock()
+		if r, ok := l.local[key]; ok && r.tokens > 0 && now.Before(r.until) {
+			r.tokens--
+			l.mu.Unlock()
+			return true, nil
+		}
+		l.mu.Unlock()
+	}
+
+	granted, until, err := l.algorithm.reserve(ctx, l.store, key, l.batch, now)
+	if err != nil || granted == 0 {
+		return false, err
+	}
+	if granted > 1 {
+		l.mu.Lock()
+		if len(l.local) >= maxReservations {
+			for k, r := range l.local {
+				if r.tokens == 0 || now.After(r.until) {
+					delete(l.local, k)
+				}
+			}
+		}
+		l.local[key] = &reservation{tokens: granted - 1, until: until}
+		l.mu.Unlock()
+	}
+	return true, nil
+}
+
+// slidingWindow weights the counter of the previous window by the part of it still covered by the
+// sliding one
+type slidingWindow struct {
+	max   int64
+	every time.Duration
+}
+
+func (s slidingWindow) reserve(ctx context.Context, store Store, key string, n int64, now time.Time) (int64, time.Time, error) {
+	window := now.UnixNano() / int64(s.every)
+	current := key + ":" + strconv.FormatInt(window, 10)
+	count, err := store.Incr(ctx, current, n, 2*s.every)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	previous, err := store.Get(ctx, key+":"+strconv.FormatInt(window-1, 10))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	elapsed := float64(now.UnixNano()%int64(s.every)) / float64(s.every)
+	used := int64(float64(previous)*(1-elapsed)) + count
+
+	granted := n
+	if used > s.max {
+		if granted = n - (used - s.max); granted < 0 {
+			granted = 0
+		}
+		// the tokens not granted are given back
+		if _, err := store.Incr(ctx, current, granted-n, 2*s.every); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	return granted, time.Unix(0, (window+1)*int64(s.every)), nil
+}
+
+// gcra stores the theoretical arrival time of the next request, in microseconds
+type gcra struct {
+	interval int64
+	capacity int64
+	every    time.Duration
+}
+
+func (g gcra) reserve(ctx context.Context, store Store, key string, n int64, now time.Time) (int64, time.Time, error) {
+	ttl := 2*g.every + time.Duration(g.capacity)*time.Microsecond
+	nowUs := now.UnixNano() / int64(time.Microsecond)
+	cost := n * g.interval
+	// the arrival time of an idle bucket is moved to now in the same operation, so the concurrent
+	// reservations do not reset it twice
+	tat, err := store.IncrFrom(ctx, key, nowUs, cost, ttl)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	granted := n
+	if excess := tat - nowUs - g.capacity; excess > 0 {
+		if granted = n - (excess+g.interval-1)/g.interval; granted < 0 {
+			granted = 0
+		}
+		if _, err := store.Incr(ctx, key, (granted-n)*g.interval, ttl); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	return granted, now.Add(g.every), nil
+}
+
+// fallbackLimiter uses the local limiter while the store of the primary one is failing
+type fallbackLimiter struct {
+	primary Limiter
+	local   Limiter
+	retry   time.Duration
+	logger  logging.Logger
+	name    string
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+// NewFallbackLimiter returns a Limiter using the local one when the primary fails, skipping the
+// primary during the retry period after every failure
+func NewFallbackLimiter(primary, local Limiter, retry time.Duration, logger logging.Logger, name string) Limiter {
+	return &fallbackLimiter{primary: primary, local: local, retry: retry, logger: logger, name: name}
+}
+
+// Allow implements the Limiter interface
+func (f *fallbackLimiter) Allow(ctx context.Context, key string) (bool, error) {
+	f.mu.Lock()
+	down := time.Now().Before(f.downUntil)
+	f.mu.Unlock()
+	if !down {
+		ok, err := f.primary.Allow(ctx, key)
+		if err == nil {
+			return ok, nil
+		}
+		f.mu.Lock()
+		f.downUntil = time.Now().Add(f.retry)
+		f.mu.Unlock()
+		f.logger.Warning(fmt.Sprintf("%s ratelimit: store unavailable, using the local limits: %s", f.name, err.Error()))
+	}
+	return f.local.Allow(ctx, key)
+}
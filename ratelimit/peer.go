@@ -0,0 +1,248 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+)
+
+// SyncPath is the path where the peers receive the counters of the rest of the cluster
+const SyncPath = "/__ratelimit/sync"
+
+const (
+	secretHeader = "X-Ratelimit-Secret"
+	// maxSyncSize is the max size of the messages received from the peers
+	maxSyncSize = 4 << 20
+)
+
+// PeerConfig contains the options of a PeerStore
+type PeerConfig struct {
+	// NodeID identifies the instance in the messages sent to the peers
+	NodeID string
+	// Peers are the addresses (host:port or URLs) of the rest of the instances
+	Peers []string
+	// SyncInterval is the period between the messages sent to the peers
+	SyncInterval time.Duration
+	// Secret is required in the messages received from the peers. An empty secret rejects them all.
+	Secret string
+}
+
+type syncMessage struct {
+	From     string                 `json:"from"`
+	Counters map[string]syncCounter `json:"counters"`
+}
+
+type syncCounter struct {
+	Value int64 `json:"value"`
+	TTL   int64 `json:"ttl_ms"`
+}
+
+// PeerStore is a Store keeping the counters in memory and sharing them periodically with the peers, so
+// every instance counts the requests received by the whole cluster with the delay of a sync interval.
+// The counters of the instance and the ones received from the peers are kept apart and added up on
+// every read.
+type PeerStore struct {
+	cfg    PeerConfig
+	local  *MemoryStore
+	client *http.Client
+	logger logging.Logger
+
+	mu     sync.Mutex
+	remote map[string]map[string]memoryValue
+	dirty  map[string]struct{}
+}
+
+// NewPeerStore returns a PeerStore sending the changed counters to the peers every sync interval
+// until the context is done. The store is an http.Handler to register at the SyncPath of a listener
+// reachable by the peers.
+func NewPeerStore(ctx context.Context, cfg PeerConfig, logger logging.Logger) *PeerStore {
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = 100 * time.Millisecond
+	}
+	for i, p := range cfg.Peers {
+		if !strings.HasPrefix(p, "http://") && !strings.HasPrefix(p, "https://") {
+			p = "http://" + p
+		}
+		cfg.Peers[i] = strings.TrimSuffix(p, "/") + SyncPath
+	}
+	s := &PeerStore{
+		cfg:    cfg,
+		local:  NewMemoryStore(),
+		client: &http.Client{Timeout: cfg.SyncInterval * 5},
+		logger: logger,
+		remote: map[string]map[string]memoryValue{},
+		dirty:  map[string]struct{}{},
+	}
+	go s.run(ctx)
+	return s
+}
+
+// Incr implements the Store interface
+func (s *PeerStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	v, _ := s.local.Incr(ctx, key, delta, ttl)
+	s.mu.Lock()
+	s.dirty[key] = struct{}{}
+	v += s.remoteValue(key)
+	s.mu.Unlock()
+	return v, nil
+}
+
+// IncrFrom implements the Store interface. The min applies to the sum of the local and remote counters.
+func (s *PeerStore) IncrFrom(ctx context.Context, key string, min, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remote := s.remoteValue(key)
+	v, _ := s.local.IncrFrom(ctx, key, min-remote, delta, ttl)
+	s.dirty[key] = struct{}{}
+	return v + remote, nil
+}
+
+// Get implements the Store interface
+func (s *PeerStore) Get(ctx context.Context, key string) (int64, error) {
+	v, _ := s.local.Get(ctx, key)
+	s.mu.Lock()
+	v += s.remoteValue(key)
+	s.mu.Unlock()
+	return v, nil
+}
+
+// Del implements the Store interface. The counters of the peers are reset as well.
+func (s *PeerStore) Del(ctx context.Context, keys ...string) error {
+	s.local.Del(ctx, keys...)
+	s.mu.Lock()
+	for _, k := range keys {
+		for _, counters := range s.remote {
+			delete(counters, k)
+		}
+		s.dirty[k] = struct{}{}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *PeerStore) remoteValue(key string) int64 {
+	now := time.Now()
+	var total int64
+	for _, counters := range s.remote {
+		if v, ok := counters[key]; ok && now.Before(v.expires) {
+			total += v.value
+		}
+	}
+	return total
+}
+
+// ServeHTTP merges the counters sent by a peer
+func (s *PeerStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	secret := []byte(r.Header.Get(secretHeader))
+	if s.cfg.Secret == "" || subtle.ConstantTimeCompare(secret, []byte(s.cfg.Secret)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	msg := syncMessage{}
+	body := http.MaxBytesReader(w, r.Body, maxSyncSize)
+	if err := json.NewDecoder(body).Decode(&msg); err != nil || msg.From == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	counters, ok := s.remote[msg.From]
+	if !ok {
+		counters = map[string]memoryValue{}
+		s.remote[msg.From] = counters
+	}
+	for k, c := range msg.Counters {
+		if c.Value == 0 || c.TTL <= 0 {
+			delete(counters, k)
+			continue
+		}
+		counters[k] = memoryValue{value: c.Value, expires: now.Add(time.Duration(c.TTL) * time.Millisecond)}
+	}
+	for k, v := range counters {
+		if now.After(v.expires) {
+			delete(counters, k)
+		}
+	}
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *PeerStore) run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sync(ctx)
+		}
+	}
+}
+
+// sync sends the counters changed since the last sync to every peer
+func (s *PeerStore) sync(ctx context.Context) {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = map[string]struct{}{}
+	s.mu.Unlock()
+	if len(dirty) == 0 || len(s.cfg.Peers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	msg := syncMessage{From: s.cfg.NodeID, Counters: make(map[string]syncCounter, len(dirty))}
+	for k := range dirty {
+		c := syncCounter{}
+		if v, ok := s.local.lookup(k); ok {
+			c = syncCounter{Value: v.value, TTL: int64(v.expires.Sub(now) / time.Millisecond)}
+		}
+		msg.Counters[k] = c
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	for _, peer := range s.cfg.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := s.send(ctx, peer, body); err != nil {
+				s.logger.Debug(fmt.Sprintf("ratelimit: sync with %s: %s", peer, err.Error()))
+			}
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (s *PeerStore) send(ctx context.Context, peer string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(secretHeader, s.cfg.Secret)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
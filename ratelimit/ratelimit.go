@@ -0,0 +1,467 @@
+/*
+Package ratelimit provides cluster-aware rate limits for the endpoints and the backends, keeping the
+counters in a store shared by every instance of the gateway instead of in the memory of each one.
+
+The store is declared at service level:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/ratelimit": {
+			"store": "redis",
+			"address": "redis://ratelimit.internal:6379",
+			"db": 1,
+			"timeout": "50ms",
+			"fallback_retry": "5s"
+		}
+	}
+
+The supported stores are:
+
+  - memory (default): the counters are local to the instance, as with the juju limiters
+  - redis: the counters are kept in a redis-compatible server
+  - peer: the instances keep their counters in memory and share them with the peers
+
+When the redis server fails or does not answer within the timeout (100ms by default), the limiters use
+their local counters (i.e. the limits apply per instance) and retry the server after fallback_retry
+(5s by default).
+
+The peer instances send their changed counters to the peers every sync_interval (100ms by default),
+with the node_id as the sender, and receive the counters of the peers in a dedicated listener at the
+SyncPath, requiring the secret in every message (up to 4MB). Only the sliding_window algorithm is
+supported by the peer store:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/ratelimit": {
+			"store": "peer",
+			"listen": ":9099",
+			"peers": [ "gw-2.internal:9099", "gw-3.internal:9099" ],
+			"node_id": "gw-1",
+			"secret": "s3cr3t"
+		}
+	}
+
+The limits are declared at endpoint level, with the same fields of the juju limiters:
+
+	...
+	"endpoint": "/users/{id}",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/ratelimit": {
+			"max_rate": 1000,
+			"every": "1s",
+			"client_max_rate": 10,
+			"strategy": "header",
+			"key": "X-Api-Key",
+			"algorithm": "gcra",
+			"burst": 20,
+			"batch": 10
+		}
+	},
+	...
+
+Exceeding max_rate is answered with a 503 and exceeding client_max_rate (or missing the client token)
+with a 429. The backends accept max_rate, every, algorithm, burst and batch, returning an error when
+the limit is exceeded; their counters are shared by every endpoint using the same backend.
+
+The algorithms are sliding_window (default), weighting the counter of the previous window by the part
+still covered by the sliding one, and gcra, spacing the requests evenly and allowing bursts of up to
+"burst" requests (max_rate by default). With a batch greater than one, every instance reserves that
+many requests from the store at once and serves them locally until the window ends, trading some
+precision for fewer round trips to the store.
+*/
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/redispool"
+	krakendrate "github.com/devopsfaith/krakend-ratelimit"
+	juju "github.com/devopsfaith/krakend-ratelimit/juju/router/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/ratelimit"
+
+// The supported stores
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+	StorePeer   = "peer"
+)
+
+const (
+	defaultPrefix  = "krakend:rl:"
+	defaultTimeout = 100 * time.Millisecond
+	defaultRetry   = 5 * time.Second
+)
+
+// ErrNoConfig is returned when there is no ratelimit config
+var ErrNoConfig = errors.New("ratelimit: no config")
+
+// ServiceConfig is the custom config struct of the shared store
+type ServiceConfig struct {
+	Store         string   `json:"store"`
+	Prefix        string   `json:"prefix"`
+	Address       string   `json:"address"`
+	Password      string   `json:"password"`
+	DB            int      `json:"db"`
+	MaxIdle       int      `json:"max_idle"`
+	MaxActive     int      `json:"max_active"`
+	Timeout       string   `json:"timeout"`
+	FallbackRetry string   `json:"fallback_retry"`
+	Listen        string   `json:"listen"`
+	Peers         []string `json:"peers"`
+	SyncInterval  string   `json:"sync_interval"`
+	NodeID        string   `json:"node_id"`
+	Secret        string   `json:"secret"`
+}
+
+// Config is the custom config struct of the endpoint and backend limits
+type Config struct {
+	MaxRate       int64  `json:"max_rate"`
+	Every         string `json:"every"`
+	ClientMaxRate int64  `json:"client_max_rate"`
+	Strategy      string `json:"strategy"`
+	Key           string `json:"key"`
+	Algorithm     string `json:"algorithm"`
+	Burst         int64  `json:"burst"`
+	Batch         int64  `json:"batch"`
+
+	every time.Duration
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	data, ok := e[Namespace]
+	if !ok {
+		return ErrNoConfig
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// ServiceConfigGetter parses the store config of the service
+func ServiceConfigGetter(e config.ExtraConfig) (ServiceConfig, error) {
+	cfg := ServiceConfig{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	switch cfg.Store {
+	case "", StoreMemory:
+	case StoreRedis:
+		if cfg.Address == "" {
+			return cfg, errors.New("ratelimit: the redis store requires an address")
+		}
+	case StorePeer:
+		if cfg.Listen == "" || cfg.NodeID == "" || cfg.Secret == "" {
+			return cfg, errors.New("ratelimit: the peer store requires listen, node_id and secret")
+		}
+	default:
+		return cfg, fmt.Errorf("ratelimit: unknown store %q", cfg.Store)
+	}
+	for _, d := range []string{cfg.Timeout, cfg.FallbackRetry, cfg.SyncInterval} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(d); err != nil {
+			return cfg, fmt.Errorf("ratelimit: %s", err.Error())
+		}
+	}
+	return cfg, nil
+}
+
+// ConfigGetter parses the limits of the endpoint or the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		return cfg, err
+	}
+	cfg.every = time.Second
+	if cfg.Every != "" {
+		d, err := time.ParseDuration(cfg.Every)
+		if err != nil {
+			return cfg, fmt.Errorf("ratelimit: %s", err.Error())
+		}
+		if d <= 0 {
+			return cfg, fmt.Errorf("ratelimit: invalid period %s", cfg.Every)
+		}
+		cfg.every = d
+	}
+	switch cfg.Algorithm {
+	case "", SlidingWindow, GCRA:
+	default:
+		return cfg, fmt.Errorf("ratelimit: unknown algorithm %q", cfg.Algorithm)
+	}
+	switch strings.ToLower(cfg.Strategy) {
+	case "", "ip", "header":
+	default:
+		return cfg, fmt.Errorf("ratelimit: unknown strategy %q", cfg.Strategy)
+	}
+	if cfg.ClientMaxRate > 0 && strings.EqualFold(cfg.Strategy, "header") && cfg.Key == "" {
+		return cfg, errors.New("ratelimit: the header strategy requires a key")
+	}
+	return cfg, nil
+}
+
+func (c Config) rate(max int64) Rate {
+	return Rate{Max: max, Every: c.every, Burst: c.Burst, Batch: c.Batch}
+}
+
+// Validate checks the store config and the limits of every endpoint and backend
+func Validate(cfg config.ServiceConfig) error {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	check := func(e config.ExtraConfig) error {
+		c, err := ConfigGetter(e)
+		if err == ErrNoConfig {
+			return nil
+		}
+		if err == nil && service.Store == StorePeer && c.Algorithm == GCRA {
+			err = errors.New("ratelimit: the peer store does not support the gcra algorithm")
+		}
+		return err
+	}
+	for _, e := range cfg.Endpoints {
+		if err := check(e.ExtraConfig); err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+		for _, b := range e.Backend {
+			if err := check(b.ExtraConfig); err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// registry holds the store shared by the limiters of the instance
+type registry struct {
+	mu     sync.RWMutex
+	store  Store
+	shared bool
+	prefix string
+	retry  time.Duration
+	local  *MemoryStore
+}
+
+var current = &registry{store: NewMemoryStore(), prefix: defaultPrefix, retry: defaultRetry, local: NewMemoryStore()}
+
+// DefaultStore returns the store registered for the instance, so other subsystems can keep their
+// counters next to the ones of the limiters
+func DefaultStore() Store {
+	current.mu.RLock()
+	defer current.mu.RUnlock()
+	return current.store
+}
+
+func (r *registry) set(store Store, shared bool, prefix string, retry time.Duration) {
+	r.mu.Lock()
+	r.store, r.shared, r.prefix, r.retry = store, shared, prefix, retry
+	r.mu.Unlock()
+}
+
+// newLimiter returns a limiter over the registered store, falling back to local counters if the store
+// is a remote one
+func (r *registry) newLimiter(algorithm string, rate Rate, logger logging.Logger, name string) (Limiter, error) {
+	r.mu.RLock()
+	store, shared, retry := r.store, r.shared, r.retry
+	r.mu.RUnlock()
+
+	l, err := NewLimiter(algorithm, rate, store)
+	if err != nil || !shared {
+		return l, err
+	}
+	rate.Batch = 1
+	local, err := NewLimiter(algorithm, rate, r.local)
+	if err != nil {
+		return nil, err
+	}
+	return NewFallbackLimiter(l, local, retry, logger, name), nil
+}
+
+func (r *registry) key(parts ...string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.prefix + strings.Join(parts, ":")
+}
+
+// Register creates the store declared in the service config, to be used by the limiters created from
+// then on. The store is closed when the context is done.
+func Register(ctx context.Context, cfg config.ServiceConfig, logger logging.Logger) {
+	service, err := ServiceConfigGetter(cfg.ExtraConfig)
+	if err != nil {
+		if err != ErrNoConfig {
+			logger.Warning("ratelimit:", err.Error())
+		}
+		return
+	}
+	prefix := service.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	retry := defaultRetry
+	if service.FallbackRetry != "" {
+		retry, _ = time.ParseDuration(service.FallbackRetry)
+	}
+
+	switch service.Store {
+	case StoreRedis:
+		timeout := defaultTimeout
+		if service.Timeout != "" {
+			timeout, _ = time.ParseDuration(service.Timeout)
+		}
+		pool := redispool.New(redispool.Config{
+			Address:     service.Address,
+			Password:    service.Password,
+			DB:          service.DB,
+			MaxIdle:     service.MaxIdle,
+			MaxActive:   service.MaxActive,
+			DialTimeout: timeout,
+		})
+		go func() {
+			<-ctx.Done()
+			pool.Close()
+		}()
+		current.set(NewRedisStore(pool, timeout), true, prefix, retry)
+		logger.Debug("ratelimit: using the redis store at", service.Address)
+
+	case StorePeer:
+		var interval time.Duration
+		if service.SyncInterval != "" {
+			interval, _ = time.ParseDuration(service.SyncInterval)
+		}
+		store := NewPeerStore(ctx, PeerConfig{
+			NodeID:       service.NodeID,
+			Peers:        service.Peers,
+			SyncInterval: interval,
+			Secret:       service.Secret,
+		}, logger)
+		mux := http.NewServeMux()
+		mux.Handle(SyncPath, store)
+		s := &http.Server{Addr: service.Listen, Handler: mux}
+		go func() {
+			if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("ratelimit: peer listener:", err.Error())
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			s.Shutdown(context.Background())
+		}()
+		current.set(store, false, prefix, retry)
+		logger.Debug("ratelimit: using the peer store at", service.Listen, "with peers", service.Peers)
+
+	default:
+		current.set(NewMemoryStore(), false, prefix, retry)
+	}
+}
+
+// HandlerFactory returns a handler factory enforcing the limits of the endpoints with a ratelimit
+// config
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handlerFunc := next(remote, p)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err != nil {
+			if err != ErrNoConfig {
+				logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			}
+			return handlerFunc
+		}
+		name := fmt.Sprintf("[ENDPOINT: %s]", remote.Endpoint)
+		route := remote.Method + " " + remote.Endpoint
+
+		if cfg.ClientMaxRate > 0 {
+			l, err := current.newLimiter(cfg.Algorithm, cfg.rate(cfg.ClientMaxRate), logger, name)
+			if err != nil {
+				logger.Error(name, err.Error())
+				return handlerFunc
+			}
+			extractor := juju.IPTokenExtractor
+			if strings.EqualFold(cfg.Strategy, "header") {
+				extractor = juju.HeaderTokenExtractor(cfg.Key)
+			} else if cfg.Key != "" {
+				extractor = juju.NewIPTokenExtractor(cfg.Key)
+			}
+			handlerFunc = newClientMw(l, current.key("client", route), extractor, handlerFunc)
+		}
+		if cfg.MaxRate > 0 {
+			l, err := current.newLimiter(cfg.Algorithm, cfg.rate(cfg.MaxRate), logger, name)
+			if err != nil {
+				logger.Error(name, err.Error())
+				return handlerFunc
+			}
+			handlerFunc = newEndpointMw(l, current.key("endpoint", route), handlerFunc)
+		}
+		logger.Debug(name, "ratelimit: max_rate", cfg.MaxRate, "client_max_rate", cfg.ClientMaxRate, "every", cfg.every)
+		return handlerFunc
+	}
+}
+
+func newEndpointMw(l Limiter, key string, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ok, _ := l.Allow(c.Request.Context(), key); !ok {
+			c.AbortWithError(http.StatusServiceUnavailable, krakendrate.ErrLimited)
+			return
+		}
+		next(c)
+	}
+}
+
+func newClientMw(l Limiter, prefix string, extractor juju.TokenExtractor, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := extractor(c)
+		if token == "" {
+			c.AbortWithError(http.StatusTooManyRequests, krakendrate.ErrLimited)
+			return
+		}
+		if ok, _ := l.Allow(c.Request.Context(), prefix+":"+token); !ok {
+			c.AbortWithError(http.StatusTooManyRequests, krakendrate.ErrLimited)
+			return
+		}
+		next(c)
+	}
+}
+
+// BackendFactory returns a backend factory enforcing the limits of the backends with a ratelimit
+// config
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err != nil || cfg.MaxRate <= 0 {
+			if err != nil && err != ErrNoConfig {
+				logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			}
+			return next
+		}
+		name := fmt.Sprintf("[BACKEND: %s]", remote.URLPattern)
+		l, err := current.newLimiter(cfg.Algorithm, cfg.rate(cfg.MaxRate), logger, name)
+		if err != nil {
+			logger.Error(name, err.Error())
+			return next
+		}
+		key := current.key("backend", remote.Method, strings.Join(remote.Host, ","), remote.URLPattern)
+		logger.Debug(name, "ratelimit: max_rate", cfg.MaxRate, "every", cfg.every)
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			if ok, _ := l.Allow(ctx, key); !ok {
+				return nil, krakendrate.ErrLimited
+			}
+			return next(ctx, r)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/redispool"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// fakeServer replies to the commands and scripts of the RedisStore as redigo would, ignoring the
+// expirations
+type fakeServer struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func (f *fakeServer) Do(_ context.Context, args ...string) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch args[0] {
+	case "EVAL":
+		delta, _ := strconv.ParseInt(args[4], 10, 64)
+		if args[1] == incrFromScript {
+			min, _ := strconv.ParseInt(args[4], 10, 64)
+			if delta, _ = strconv.ParseInt(args[5], 10, 64); f.values[args[3]] < min {
+				f.values[args[3]] = min
+			}
+		}
+		f.values[args[3]] += delta
+		return f.values[args[3]], nil
+	case "INCRBY":
+		delta, _ := strconv.ParseInt(args[2], 10, 64)
+		f.values[args[1]] += delta
+		return f.values[args[1]], nil
+	case "GET":
+		if v, ok := f.values[args[1]]; ok {
+			return []byte(strconv.FormatInt(v, 10)), nil
+		}
+		return nil, nil
+	case "DEL":
+		for _, k := range args[1:] {
+			delete(f.values, k)
+		}
+	}
+	return int64(1), nil
+}
+
+func TestLimiter(t *testing.T) {
+	server := &fakeServer{values: map[string]int64{}}
+
+	for _, tc := range []struct {
+		name      string
+		algorithm string
+		rate      Rate
+		allowed   int
+	}{
+		{name: "sliding_window", algorithm: SlidingWindow, rate: Rate{Max: 5, Every: time.Hour}, allowed: 5},
+		{name: "gcra", algorithm: GCRA, rate: Rate{Max: 5, Every: time.Hour}, allowed: 5},
+		{name: "gcra_burst", algorithm: GCRA, rate: Rate{Max: 5, Every: time.Hour, Burst: 3}, allowed: 3},
+		{name: "batch", algorithm: SlidingWindow, rate: Rate{Max: 10, Every: time.Hour, Batch: 4}, allowed: 10},
+	} {
+		for storeName, store := range map[string]Store{"memory": NewMemoryStore(), "redis": NewRedisStore(server, time.Second)} {
+			l, err := NewLimiter(tc.algorithm, tc.rate, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := tc.name + ":" + storeName
+			for i := 0; i < tc.allowed; i++ {
+				if ok, err := l.Allow(context.Background(), key); !ok || err != nil {
+					t.Errorf("%s %s: request #%d rejected: %v", tc.name, storeName, i, err)
+				}
+			}
+			if ok, err := l.Allow(context.Background(), key); ok || err != nil {
+				t.Errorf("%s %s: request over the limit allowed: %v", tc.name, storeName, err)
+			}
+			if ok, _ := l.Allow(context.Background(), key+":other"); !ok {
+				t.Errorf("%s %s: unrelated key rejected", tc.name, storeName)
+			}
+		}
+	}
+}
+
+func TestLimiter_gcraIdle(t *testing.T) {
+	server := &fakeServer{values: map[string]int64{}}
+	for storeName, store := range map[string]Store{"memory": NewMemoryStore(), "redis": NewRedisStore(server, time.Second)} {
+		l, _ := NewLimiter(GCRA, Rate{Max: 10, Every: time.Hour}, slowStore{store})
+		var allowed int64
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _ := l.Allow(context.Background(), "idle"); ok {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if allowed != 10 {
+			t.Errorf("%s: unexpected number of requests allowed from an idle bucket: %d", storeName, allowed)
+		}
+	}
+}
+
+// slowStore delays the replies of the store, so the concurrent reservations interleave
+type slowStore struct {
+	Store
+}
+
+func (s slowStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	v, err := s.Store.Incr(ctx, key, delta, ttl)
+	time.Sleep(time.Millisecond)
+	return v, err
+}
+
+func (s slowStore) IncrFrom(ctx context.Context, key string, min, delta int64, ttl time.Duration) (int64, error) {
+	v, err := s.Store.IncrFrom(ctx, key, min, delta, ttl)
+	time.Sleep(time.Millisecond)
+	return v, err
+}
+
+type countingStore struct {
+	Store
+	calls int64
+}
+
+func (c *countingStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	atomic.AddInt64(&c.calls, 1)
+	return c.Store.Incr(ctx, key, delta, ttl)
+}
+
+func TestLimiter_batch(t *testing.T) {
+	store := &countingStore{Store: NewMemoryStore()}
+	l, _ := NewLimiter(SlidingWindow, Rate{Max: 100, Every: time.Hour, Batch: 10}, store)
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow(context.Background(), "key"); !ok {
+			t.Fatalf("request #%d rejected", i)
+		}
+	}
+	if calls := atomic.LoadInt64(&store.calls); calls != 10 {
+		t.Errorf("unexpected number of store calls: %d", calls)
+	}
+}
+
+func TestFallbackLimiter(t *testing.T) {
+	// nobody listens on the address of a closed listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	pool := redispool.New(redispool.Config{Address: ln.Addr().String(), DialTimeout: 100 * time.Millisecond})
+	defer pool.Close()
+
+	rate := Rate{Max: 2, Every: time.Hour}
+	primary, _ := NewLimiter(SlidingWindow, rate, NewRedisStore(pool, 100*time.Millisecond))
+	local, _ := NewLimiter(SlidingWindow, rate, NewMemoryStore())
+	l := NewFallbackLimiter(primary, local, time.Minute, logging.NoOp, "test")
+
+	for i := 0; i < 2; i++ {
+		if ok, err := l.Allow(context.Background(), "key"); !ok || err != nil {
+			t.Errorf("request #%d rejected: %v", i, err)
+		}
+	}
+	if ok, _ := l.Allow(context.Background(), "key"); ok {
+		t.Error("request over the local limit allowed")
+	}
+}
+
+func TestPeerStore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ma, mb := http.NewServeMux(), http.NewServeMux()
+	sa := httptest.NewServer(ma)
+	defer sa.Close()
+	sb := httptest.NewServer(mb)
+	defer sb.Close()
+
+	interval := 10 * time.Millisecond
+	a := NewPeerStore(ctx, PeerConfig{NodeID: "a", Peers: []string{sb.URL}, SyncInterval: interval, Secret: "s"}, logging.NoOp)
+	b := NewPeerStore(ctx, PeerConfig{NodeID: "b", Peers: []string{sa.URL}, SyncInterval: interval, Secret: "s"}, logging.NoOp)
+	ma.Handle(SyncPath, a)
+	mb.Handle(SyncPath, b)
+
+	a.Incr(ctx, "key", 3, time.Minute)
+	b.Incr(ctx, "key", 2, time.Minute)
+	time.Sleep(10 * interval)
+
+	for name, s := range map[string]*PeerStore{"a": a, "b": b} {
+		if v, _ := s.Get(ctx, "key"); v != 5 {
+			t.Errorf("%s: unexpected value %d", name, v)
+		}
+	}
+
+	a.Del(ctx, "key")
+	time.Sleep(10 * interval)
+	if v, _ := b.Get(ctx, "key"); v != 2 {
+		t.Errorf("unexpected value after the reset: %d", v)
+	}
+
+	for _, secret := range []string{"", "x"} {
+		req := httptest.NewRequest("POST", SyncPath, strings.NewReader(`{"from":"c","counters":{"key":{"value":9,"ttl_ms":60000}}}`))
+		req.Header.Set(secretHeader, secret)
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("unexpected status code with the secret %q: %d", secret, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest("POST", SyncPath, io.MultiReader(strings.NewReader(`{"from":"c","x":"`), strings.NewReader(strings.Repeat("a", maxSyncSize))))
+	req.Header.Set(secretHeader, "s")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code for an oversized message: %d", w.Code)
+	}
+
+	noSecret := NewPeerStore(ctx, PeerConfig{NodeID: "c"}, logging.NoOp)
+	req = httptest.NewRequest("POST", SyncPath, strings.NewReader(`{"from":"a","counters":{}}`))
+	w = httptest.NewRecorder()
+	noSecret.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code for a store without secret: %d", w.Code)
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	current.set(NewMemoryStore(), false, defaultPrefix, defaultRetry)
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.Status(http.StatusOK) }
+	}, logging.NoOp)
+
+	engine := gin.New()
+	engine.GET("/endpoint", hf(&config.EndpointConfig{
+		Method:   "GET",
+		Endpoint: "/endpoint",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"max_rate": 2,
+			"every":    "1h",
+		}},
+	}, proxy.NoopProxy))
+	engine.GET("/client", hf(&config.EndpointConfig{
+		Method:   "GET",
+		Endpoint: "/client",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"client_max_rate": 1,
+			"every":           "1h",
+			"strategy":        "header",
+			"key":             "X-Api-Key",
+		}},
+	}, proxy.NoopProxy))
+
+	for i, tc := range []struct {
+		path   string
+		key    string
+		status int
+	}{
+		{path: "/endpoint", status: http.StatusOK},
+		{path: "/endpoint", status: http.StatusOK},
+		{path: "/endpoint", status: http.StatusServiceUnavailable},
+		{path: "/client", key: "a", status: http.StatusOK},
+		{path: "/client", key: "b", status: http.StatusOK},
+		{path: "/client", key: "a", status: http.StatusTooManyRequests},
+		{path: "/client", status: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.key != "" {
+			req.Header.Set("X-Api-Key", tc.key)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("#%d %s: unexpected status code %d", i, tc.path, w.Code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"store":   "peer",
+			"listen":  ":9099",
+			"node_id": "a",
+			"secret":  "s",
+		}},
+		Endpoints: []*config.EndpointConfig{{
+			Method:   "GET",
+			Endpoint: "/a",
+			ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+				"max_rate":  10,
+				"algorithm": "gcra",
+			}},
+		}},
+	}
+	if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), "gcra") {
+		t.Errorf("gcra accepted with the peer store: %v", err)
+	}
+	delete(cfg.ExtraConfig[Namespace].(map[string]interface{}), "secret")
+	if err := Validate(cfg); err == nil {
+		t.Error("peer store accepted without secret")
+	}
+	cfg.ExtraConfig = config.ExtraConfig{Namespace: map[string]interface{}{"store": "redis", "address": "localhost:6379"}}
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Endpoints[0].ExtraConfig[Namespace].(map[string]interface{})["every"] = "soon"
+	if err := Validate(cfg); err == nil {
+		t.Error("invalid period accepted")
+	}
+}
@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Store keeps the counters shared by the limiters
+type Store interface {
+	// Incr adds delta to the counter of the key, creating it with the ttl, and returns the new value
+	Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+	// IncrFrom raises the counter of the key to min when it is lower, or does not exist, and adds delta
+	// to it as a single operation, returning the new value. The counter is created with the ttl.
+	IncrFrom(ctx context.Context, key string, min, delta int64, ttl time.Duration) (int64, error)
+	// Get returns the value of the counter, or zero if it does not exist
+	Get(ctx context.Context, key string) (int64, error)
+	// Del removes the counters
+	Del(ctx context.Context, keys ...string) error
+}
+
+type memoryValue struct {
+	value   int64
+	expires time.Time
+}
+
+// MemoryStore is a Store local to the instance
+type MemoryStore struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	ops    int
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string]memoryValue{}}
+}
+
+// Incr implements the Store interface
+func (m *MemoryStore) Incr(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+	v, ok := m.values[key]
+	if !ok || now.After(v.expires) {
+		v = memoryValue{expires: now.Add(ttl)}
+	}
+	v.value += delta
+	m.values[key] = v
+	return v.value, nil
+}
+
+// IncrFrom implements the Store interface
+func (m *MemoryStore) IncrFrom(_ context.Context, key string, min, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweep(now)
+	v, ok := m.values[key]
+	if !ok || now.After(v.expires) {
+		v = memoryValue{value: min, expires: now.Add(ttl)}
+	}
+	if v.value < min {
+		v.value = min
+	}
+	v.value += delta
+	m.values[key] = v
+	return v.value, nil
+}
+
+// Get implements the Store interface
+func (m *MemoryStore) Get(_ context.Context, key string) (int64, error) {
+	v, _ := m.lookup(key)
+	return v.value, nil
+}
+
+// Del implements the Store interface
+func (m *MemoryStore) Del(_ context.Context, keys ...string) error {
+	m.mu.Lock()
+	for _, k := range keys {
+		delete(m.values, k)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryStore) lookup(key string) (memoryValue, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	if !ok || time.Now().After(v.expires) {
+		return memoryValue{}, false
+	}
+	return v, true
+}
+
+// sweep removes the expired counters every few operations
+func (m *MemoryStore) sweep(now time.Time) {
+	m.ops++
+	if m.ops < 1024 {
+		return
+	}
+	m.ops = 0
+	for k, v := range m.values {
+		if now.After(v.expires) {
+			delete(m.values, k)
+		}
+	}
+}
+
+// Doer sends a command to a redis-compatible server
+type Doer interface {
+	Do(ctx context.Context, args ...string) (interface{}, error)
+}
+
+// incrScript adds ARGV[1] to the counter, setting the ttl of ARGV[2] milliseconds to the new ones
+const incrScript = `local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return v`
+
+// incrFromScript raises the counter to ARGV[1] before adding ARGV[2] to it, setting the ttl of ARGV[3]
+// milliseconds to the new ones. INCRBY keeps the ttl of the existing counters.
+const incrFromScript = `local cur = tonumber(redis.call('GET', KEYS[1]))
+local v = tonumber(ARGV[1])
+if cur and cur > v then v = cur end
+v = redis.call('INCRBY', KEYS[1], string.format('%d', v - (cur or 0) + tonumber(ARGV[2])))
+if redis.call('PTTL', KEYS[1]) < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[3]) end
+return v`
+
+// RedisStore is a Store backed by a redis-compatible server. The counters are updated with scripts, so
+// every change and its expiration are applied atomically.
+type RedisStore struct {
+	client  Doer
+	timeout time.Duration
+}
+
+// NewRedisStore returns a RedisStore sending the commands with the client. A positive timeout bounds
+// every command.
+func NewRedisStore(client Doer, timeout time.Duration) *RedisStore {
+	return &RedisStore{client: client, timeout: timeout}
+}
+
+// Incr implements the Store interface
+func (r *RedisStore) Incr(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	ctx, cancel := r.context(ctx)
+	defer cancel()
+	return redis.Int64(r.client.Do(ctx, "EVAL", incrScript, "1", key, strconv.FormatInt(delta, 10), milliseconds(ttl)))
+}
+
+// IncrFrom implements the Store interface
+func (r *RedisStore) IncrFrom(ctx context.Context, key string, min, delta int64, ttl time.Duration) (int64, error) {
+	ctx, cancel := r.context(ctx)
+	defer cancel()
+	return redis.Int64(r.client.Do(ctx, "EVAL", incrFromScript, "1", key, strconv.FormatInt(min, 10),
+		strconv.FormatInt(delta, 10), milliseconds(ttl)))
+}
+
+// Get implements the Store interface
+func (r *RedisStore) Get(ctx context.Context, key string) (int64, error) {
+	ctx, cancel := r.context(ctx)
+	defer cancel()
+	v, err := redis.Int64(r.client.Do(ctx, "GET", key))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return v, err
+}
+
+// Del implements the Store interface
+func (r *RedisStore) Del(ctx context.Context, keys ...string) error {
+	ctx, cancel := r.context(ctx)
+	defer cancel()
+	_, err := r.client.Do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
+
+func (r *RedisStore) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.timeout)
+}
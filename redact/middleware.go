@@ -0,0 +1,107 @@
+package redact
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// ProxyFactory returns a proxy factory redacting the responses of the endpoints with the service and
+// endpoint rules. The endpoints with invalid rules fail every request.
+func ProxyFactory(logger logging.Logger, pf proxy.Factory, service config.ExtraConfig) proxy.Factory {
+	return proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(cfg)
+		if err != nil {
+			return next, err
+		}
+		cfgs := []Config{}
+		for _, e := range []config.ExtraConfig{service, cfg.ExtraConfig} {
+			c, err := ConfigGetter(e)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err != nil {
+				return errorProxy(logger, cfg.Endpoint, fmt.Errorf("redact: %s", err.Error())), nil
+			}
+			cfgs = append(cfgs, c)
+		}
+		if len(cfgs) == 0 {
+			return next, nil
+		}
+		r, err := New(cfgs...)
+		if err != nil {
+			return errorProxy(logger, cfg.Endpoint, err), nil
+		}
+		return NewProxy(r, next), nil
+	})
+}
+
+// errorProxy logs the error and returns a proxy failing with it, as the responses can not be exposed
+// without their redaction
+func errorProxy(logger logging.Logger, endpoint string, err error) proxy.Proxy {
+	logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", endpoint, err.Error()))
+	return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		return nil, err
+	}
+}
+
+// NewProxy returns a proxy redacting the responses of the next one. The responses without decoded data
+// (no-op encoding) can not be redacted, so they are discarded and ErrRawResponse is returned instead.
+func NewProxy(r *Redactor, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+		c := claims.FromHeaders(req.Headers)
+		resp, err := next(ctx, req)
+		if resp != nil && resp.Io != nil {
+			if closer, ok := resp.Io.(io.Closer); ok {
+				closer.Close()
+			}
+			return nil, ErrRawResponse
+		}
+		if resp != nil && resp.Data != nil {
+			r.Redact(resp.Data, c)
+		}
+		return resp, err
+	}
+}
+
+// NewWriter wraps the access log writer so the lines are redacted with the service rules. A nil writer
+// stands for gin.DefaultWriter, the one used by the gin logger without output. It returns the received
+// writer if there are no rules, and one discarding every line if the rules are invalid.
+func NewWriter(e config.ExtraConfig, logger logging.Logger, w io.Writer) io.Writer {
+	cfg, err := ConfigGetter(e)
+	if err == ErrNoConfig {
+		return w
+	}
+	var r *Redactor
+	if err == nil {
+		r, err = New(cfg)
+	}
+	if err != nil {
+		logger.Error("redact: discarding the access logs:", err.Error())
+		return ioutil.Discard
+	}
+	if w == nil {
+		w = gin.DefaultWriter
+	}
+	return writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+// Write redacts the line before writing it, reporting the length of the received one
+func (w writer) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(w.r.RedactLine(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
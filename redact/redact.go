@@ -0,0 +1,320 @@
+/*
+Package redact masks, hashes or removes sensitive values (phone numbers, emails, payment tokens...)
+from the responses and the access logs.
+
+The rules can be declared at service level, applying to every endpoint and to the access logs, and
+at endpoint level, adding rules to the service ones:
+
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/redact": {
+			"roles_claim": "roles",
+			"rules": [
+				{ "path": "customer.email", "action": "mask", "keep": 4 },
+				{ "path": "payments.*.token", "action": "remove", "except_roles": [ "billing" ] },
+				{ "pattern": "\\+?[0-9]{10,12}", "action": "hash", "roles": [ "partner" ] }
+			]
+		}
+	}
+
+A rule targets either a dot-separated path of the response, where "*" matches every key of an object
+or every item of a collection (the collections are traversed transparently by the rest of the keys),
+or the regular expression pattern, matched against every string of the response. The actions are:
+
+  - mask: replaces the value (or the match) with asterisks, keeping the last "keep" characters
+  - hash: replaces the value (or the match) with its hex encoded SHA-256
+  - remove: deletes the key (or the match)
+
+The rules with "roles" only apply to the requests with any of them in the roles_claim of the JWT
+("roles" by default), and the ones with "except_roles" skip the requests with any of them. The claims
+are the ones authenticated by the gateway, in the X-Gateway-Claims header, so it must be declared in
+the headers_to_pass list of the endpoints with role-dependent rules.
+
+The access logs are redacted with all the service rules regardless of their roles: the patterns are
+applied to the log lines, and the JSON lines get the path rules applied as well.
+
+The responses of the endpoints with the no-op encoding can not be redacted, so the endpoints with
+rules (the service ones apply to every endpoint) can not use it. Invalid rules fail every request of
+their endpoints and, at service level, discard the access logs.
+*/
+package redact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/devopsfaith/krakend-ce/internal/claims"
+	"github.com/devopsfaith/krakend-ce/internal/datapath"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/encoding"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/redact"
+
+// The supported actions
+const (
+	ActionMask   = "mask"
+	ActionHash   = "hash"
+	ActionRemove = "remove"
+)
+
+const defaultRolesClaim = "roles"
+
+var (
+	// ErrNoConfig is returned when there is no redact config
+	ErrNoConfig = errors.New("redact: no config")
+	// ErrRawResponse is returned instead of the responses without decoded data (no-op encoding), which
+	// can not be redacted
+	ErrRawResponse = errors.New("redact: a raw response can not be redacted")
+)
+
+// Config is the custom config struct of the redaction layer
+type Config struct {
+	RolesClaim string `json:"roles_claim"`
+	Rules      []Rule `json:"rules"`
+}
+
+// Rule defines the values to redact and how
+type Rule struct {
+	Path        string   `json:"path"`
+	Pattern     string   `json:"pattern"`
+	Action      string   `json:"action"`
+	Keep        int      `json:"keep"`
+	Roles       []string `json:"roles"`
+	ExceptRoles []string `json:"except_roles"`
+
+	path []string
+	re   *regexp.Regexp
+}
+
+// ConfigGetter parses the redact config of the service or the endpoint
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(b, &cfg)
+	return cfg, err
+}
+
+// Redactor applies a set of compiled rules
+type Redactor struct {
+	rolesClaim string
+	rules      []Rule
+}
+
+// New compiles the rules of the received configs, in order. The roles claim of the last config
+// declaring one is used.
+func New(cfgs ...Config) (*Redactor, error) {
+	r := &Redactor{rolesClaim: defaultRolesClaim}
+	for _, cfg := range cfgs {
+		if cfg.RolesClaim != "" {
+			r.rolesClaim = cfg.RolesClaim
+		}
+		for i, rule := range cfg.Rules {
+			if (rule.Path == "") == (rule.Pattern == "") {
+				return nil, fmt.Errorf("redact: rule #%d must declare either a path or a pattern", i)
+			}
+			switch rule.Action {
+			case ActionMask, ActionHash, ActionRemove:
+			default:
+				return nil, fmt.Errorf("redact: rule #%d has an unknown action %q", i, rule.Action)
+			}
+			if rule.Path != "" {
+				rule.path = datapath.Split(rule.Path)
+			} else {
+				re, err := regexp.Compile(rule.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("redact: rule #%d: %s", i, err.Error())
+				}
+				rule.re = re
+			}
+			r.rules = append(r.rules, rule)
+		}
+	}
+	return r, nil
+}
+
+// Validate compiles the rules of the service and every endpoint, returning the first error. The
+// endpoints with rules, including the service ones, can not use the no-op encoding.
+func Validate(cfg config.ServiceConfig) error {
+	service, err := ConfigGetter(cfg.ExtraConfig)
+	hasService := err == nil
+	if err != nil && err != ErrNoConfig {
+		return err
+	}
+	if hasService {
+		if _, err := New(service); err != nil {
+			return err
+		}
+	}
+	for _, e := range cfg.Endpoints {
+		c, err := ConfigGetter(e.ExtraConfig)
+		if err == ErrNoConfig {
+			if !hasService {
+				continue
+			}
+			err = nil
+		}
+		if err == nil {
+			_, err = New(c)
+		}
+		if err == nil && noop(e) {
+			err = errors.New("redact: the responses with the no-op encoding can not be redacted")
+		}
+		if err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+	}
+	return nil
+}
+
+func noop(e *config.EndpointConfig) bool {
+	if e.OutputEncoding == encoding.NOOP {
+		return true
+	}
+	for _, b := range e.Backend {
+		if b.Encoding == encoding.NOOP {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact applies the rules matching the roles found in the claims to the data, in place
+func (r *Redactor) Redact(data map[string]interface{}, c map[string]interface{}) {
+	for i := range r.rules {
+		if r.applies(&r.rules[i], c) {
+			r.rules[i].apply(data)
+		}
+	}
+}
+
+// RedactAll applies every rule to the data, in place, regardless of their roles
+func (r *Redactor) RedactAll(data map[string]interface{}) {
+	for i := range r.rules {
+		r.rules[i].apply(data)
+	}
+}
+
+// RedactText applies every pattern rule to the text, regardless of their roles
+func (r *Redactor) RedactText(s string) string {
+	for i := range r.rules {
+		if r.rules[i].re != nil {
+			s = r.rules[i].re.ReplaceAllStringFunc(s, r.rules[i].replace)
+		}
+	}
+	return s
+}
+
+// RedactLine redacts a log line. The lines containing a JSON object get all the rules applied, while
+// the rest just get the patterns replaced.
+func (r *Redactor) RedactLine(line []byte) []byte {
+	trimmed := bytes.TrimSpace(line)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(trimmed, &data); err == nil {
+			r.RedactAll(data)
+			buf := new(bytes.Buffer)
+			enc := json.NewEncoder(buf)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(data); err == nil {
+				if !bytes.HasSuffix(line, []byte("\n")) {
+					return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+				}
+				return buf.Bytes()
+			}
+		}
+	}
+	return []byte(r.RedactText(string(line)))
+}
+
+func (r *Redactor) applies(rule *Rule, c map[string]interface{}) bool {
+	for _, role := range rule.ExceptRoles {
+		if claims.Contains(c, r.rolesClaim, role) {
+			return false
+		}
+	}
+	if len(rule.Roles) == 0 {
+		return true
+	}
+	for _, role := range rule.Roles {
+		if claims.Contains(c, r.rolesClaim, role) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *Rule) apply(data map[string]interface{}) {
+	if rule.re != nil {
+		rule.redactStrings(data)
+		return
+	}
+	datapath.Apply(data, rule.path, func(v interface{}) (interface{}, bool) {
+		if rule.Action == ActionRemove {
+			return nil, false
+		}
+		return rule.replace(stringify(v)), true
+	})
+}
+
+// redactStrings replaces the matches of the pattern in every string of the node
+func (rule *Rule) redactStrings(node interface{}) interface{} {
+	switch t := node.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = rule.redactStrings(v)
+		}
+	case []interface{}:
+		for i := range t {
+			t[i] = rule.redactStrings(t[i])
+		}
+	case string:
+		return rule.re.ReplaceAllStringFunc(t, rule.replace)
+	}
+	return node
+}
+
+func (rule *Rule) replace(s string) string {
+	switch rule.Action {
+	case ActionHash:
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	case ActionRemove:
+		return ""
+	}
+	runes := []rune(s)
+	keep := rule.Keep
+	if keep < 0 || keep >= len(runes) {
+		keep = 0
+	}
+	for i := 0; i < len(runes)-keep; i++ {
+		runes[i] = '*'
+	}
+	return string(runes)
+}
+
+func stringify(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
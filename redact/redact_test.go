@@ -0,0 +1,162 @@
+package redact
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+var sample = map[string]interface{}{
+	"rules": []interface{}{
+		map[string]interface{}{"path": "customer.email", "action": "mask", "keep": 4},
+		map[string]interface{}{"path": "payments.*.token", "action": "remove", "except_roles": []interface{}{"billing"}},
+		map[string]interface{}{"pattern": "[0-9]{10}", "action": "hash", "roles": []interface{}{"partner"}},
+	},
+}
+
+func hash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestProxyFactory(t *testing.T) {
+	data := func() map[string]interface{} {
+		return map[string]interface{}{
+			"customer": map[string]interface{}{"email": "foo@bar.com", "note": "call 5551234567"},
+			"payments": []interface{}{
+				map[string]interface{}{"id": 1.0, "token": "tok_1"},
+				map[string]interface{}{"id": 2.0, "token": "tok_2"},
+			},
+		}
+	}
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: data(), IsComplete: true}, nil
+		}, nil
+	})
+	p, err := ProxyFactory(logging.NoOp, pf, config.ExtraConfig{Namespace: sample}).New(&config.EndpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		roles    string
+		expected map[string]interface{}
+	}{
+		{
+			name: "anonymous",
+			expected: map[string]interface{}{
+				"customer": map[string]interface{}{"email": "*******.com", "note": "call 5551234567"},
+				"payments": []interface{}{map[string]interface{}{"id": 1.0}, map[string]interface{}{"id": 2.0}},
+			},
+		},
+		{
+			name:  "billing_partner",
+			roles: `["billing","partner"]`,
+			expected: map[string]interface{}{
+				"customer": map[string]interface{}{
+					"email": "*******.com",
+					"note":  "call " + hash("5551234567"),
+				},
+				"payments": data()["payments"],
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string][]string{}
+			if tc.roles != "" {
+				payload := base64.RawURLEncoding.EncodeToString([]byte(`{"roles":` + tc.roles + `}`))
+				headers["X-Gateway-Claims"] = []string{payload}
+			}
+			resp, err := p(context.Background(), &proxy.Request{Headers: headers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Data, tc.expected) {
+				t.Errorf("unexpected data: %v", resp.Data)
+			}
+		})
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewWriter(config.ExtraConfig{Namespace: sample}, logging.NoOp, buf)
+
+	line := "[GIN] 200 | GET /users?phone=5551234567\n"
+	if n, err := w.Write([]byte(line)); err != nil || n != len(line) {
+		t.Fatalf("unexpected result: %d %v", n, err)
+	}
+	if _, err := w.Write([]byte(`{"customer":{"email":"foo@bar.com"},"path":"/a"}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[GIN] 200 | GET /users?phone=" + hash("5551234567") + "\n" +
+		`{"customer":{"email":"*******.com"},"path":"/a"}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestNewWriter_defaults(t *testing.T) {
+	buf := new(bytes.Buffer)
+	defer func(w io.Writer) { gin.DefaultWriter = w }(gin.DefaultWriter)
+	gin.DefaultWriter = buf
+
+	NewWriter(config.ExtraConfig{Namespace: sample}, logging.NoOp, nil).Write([]byte("phone=5551234567\n"))
+	if buf.String() != "phone="+hash("5551234567")+"\n" {
+		t.Errorf("unexpected output of the default writer: %s", buf.String())
+	}
+
+	buf.Reset()
+	invalid := map[string]interface{}{"rules": []interface{}{map[string]interface{}{"path": "a", "action": "mangle"}}}
+	NewWriter(config.ExtraConfig{Namespace: invalid}, logging.NoOp, buf).Write([]byte("phone=5551234567\n"))
+	if buf.Len() != 0 {
+		t.Errorf("log line written with invalid rules: %s", buf.String())
+	}
+}
+
+func TestProxyFactory_failClosed(t *testing.T) {
+	pf := proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Io: strings.NewReader(`{"customer":{"email":"foo@bar.com"}}`), IsComplete: true}, nil
+		}, nil
+	})
+	for _, service := range []map[string]interface{}{
+		sample,
+		{"rules": []interface{}{map[string]interface{}{"path": "a", "action": "mangle"}}},
+	} {
+		p, err := ProxyFactory(logging.NoOp, pf, config.ExtraConfig{Namespace: service}).New(&config.EndpointConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := p(context.Background(), &proxy.Request{}); resp != nil || err == nil {
+			t.Errorf("unexpected response %v", resp)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{Namespace: sample},
+		Endpoints:   []*config.EndpointConfig{{Endpoint: "/a", OutputEncoding: "no-op"}},
+	}
+	if err := Validate(cfg); err == nil {
+		t.Error("service rules accepted with a no-op endpoint")
+	}
+	cfg.Endpoints[0].OutputEncoding = "json"
+	if err := Validate(cfg); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Package redis provides a backend reading values straight from a redis-compatible store, without any
+HTTP service in between.
+
+The first host of the backend is used as the address of the server, with or without the redis://
+scheme. The hosts with the scheme must disable their sanitization, which only accepts the http ones
+(the http:// and https:// schemes added by the sanitization are ignored). Sample backend config:
+
+	...
+	"host": [ "cache.internal:6379" ],
+	"url_pattern": "/",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/redis": {
+			"command": "GET",
+			"keys": [ "user:{{.Params.Id}}:profile" ],
+			"db": 2,
+			"max_idle": 10,
+			"max_active": 100,
+			"idle_timeout": "5m"
+		}
+	},
+	...
+
+The keys are Go templates rendered with the request data: .Params, .Query, .Headers and .Claims (see
+the internal tmpl package). The supported commands are:
+
+  - GET: the JSON value of the key is decoded into the response. Arrays are returned under the
+    "collection" key and scalars under the "value" key.
+  - HGETALL: every field of the hash becomes a key of the response, decoding the JSON values.
+  - MGET: every key becomes a key of the response, with its decoded value. Missing keys are skipped.
+
+Missing keys (or empty hashes) are reported with a 404 error. The responses go through the regular
+backend formatter, so allow, deny, mapping, group and target work as with the HTTP backends.
+*/
+package redis
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/redispool"
+	"github.com/devopsfaith/krakend-ce/internal/tmpl"
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/redis"
+
+var (
+	// ErrNoConfig is returned when the backend has no redis config
+	ErrNoConfig = errors.New("redis: no config")
+	// ErrNoHost is returned when the backend has no host
+	ErrNoHost = errors.New("redis: no host defined")
+	// ErrNotFound is returned when the requested keys do not exist
+	ErrNotFound = notFoundError{}
+)
+
+// Config is the custom config struct of the redis backend
+type Config struct {
+	Command     string   `json:"command"`
+	Keys        []string `json:"keys"`
+	Password    string   `json:"password"`
+	DB          int      `json:"db"`
+	MaxIdle     int      `json:"max_idle"`
+	MaxActive   int      `json:"max_active"`
+	IdleTimeout string   `json:"idle_timeout"`
+	DialTimeout string   `json:"dial_timeout"`
+}
+
+// ConfigGetter parses the redis config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	cfg.Command = strings.ToUpper(cfg.Command)
+	if cfg.Command == "" {
+		cfg.Command = "GET"
+	}
+	switch cfg.Command {
+	case "GET", "HGETALL":
+		if len(cfg.Keys) != 1 {
+			return cfg, fmt.Errorf("redis: %s requires a single key", cfg.Command)
+		}
+	case "MGET":
+		if len(cfg.Keys) == 0 {
+			return cfg, errors.New("redis: MGET requires at least one key")
+		}
+	default:
+		return cfg, fmt.Errorf("redis: unsupported command %s", cfg.Command)
+	}
+	return cfg, nil
+}
+
+// NewBackendFactory returns a backend factory creating redis backends for the backends with a redis
+// config and delegating the rest to the injected one. The connection pools are shared by the
+// backends using the same server and database, and closed when the context is done.
+func NewBackendFactory(ctx context.Context, logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	f := &backendFactory{ctx: ctx, logger: logger, bf: bf, pools: map[string]*redispool.Pool{}}
+	return f.New
+}
+
+type backendFactory struct {
+	ctx    context.Context
+	logger logging.Logger
+	bf     proxy.BackendFactory
+	mu     sync.Mutex
+	pools  map[string]*redispool.Pool
+}
+
+func (f *backendFactory) New(remote *config.Backend) proxy.Proxy {
+	cfg, poolCfg, err := backendConfig(remote)
+	if err == ErrNoConfig {
+		return f.bf(remote)
+	}
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+		return f.bf(remote)
+	}
+	p, err := NewProxy(f.pool(poolCfg), cfg, proxy.NewEntityFormatter(remote))
+	if err != nil {
+		f.logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+		return f.bf(remote)
+	}
+	f.logger.Debug(fmt.Sprintf("[BACKEND: %s] redis %s backend at %s", remote.URLPattern, cfg.Command, poolCfg.HostPort()))
+	return p
+}
+
+func (f *backendFactory) pool(cfg redispool.Config) *redispool.Pool {
+	key := fmt.Sprintf("%s/%d/%s", cfg.HostPort(), cfg.DB, cfg.Password)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p, ok := f.pools[key]; ok {
+		return p
+	}
+	p := redispool.New(cfg)
+	f.pools[key] = p
+	go func() {
+		<-f.ctx.Done()
+		p.Close()
+	}()
+	return p
+}
+
+// Validate checks the redis config of every backend of the service config, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, _, err := backendConfig(b)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil {
+				_, err = parseKeys(c)
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func backendConfig(remote *config.Backend) (Config, redispool.Config, error) {
+	cfg, err := ConfigGetter(remote.ExtraConfig)
+	if err != nil {
+		return cfg, redispool.Config{}, err
+	}
+	if len(remote.Host) == 0 {
+		return cfg, redispool.Config{}, ErrNoHost
+	}
+	poolCfg, err := newPoolConfig(remote.Host[0], cfg)
+	return cfg, poolCfg, err
+}
+
+func newPoolConfig(host string, cfg Config) (redispool.Config, error) {
+	poolCfg := redispool.Config{
+		Address:   host,
+		Password:  cfg.Password,
+		DB:        cfg.DB,
+		MaxIdle:   cfg.MaxIdle,
+		MaxActive: cfg.MaxActive,
+	}
+	var err error
+	if cfg.IdleTimeout != "" {
+		if poolCfg.IdleTimeout, err = time.ParseDuration(cfg.IdleTimeout); err != nil {
+			return poolCfg, err
+		}
+	}
+	if cfg.DialTimeout != "" {
+		if poolCfg.DialTimeout, err = time.ParseDuration(cfg.DialTimeout); err != nil {
+			return poolCfg, err
+		}
+	}
+	return poolCfg, nil
+}
+
+// Doer sends a command to the server
+type Doer interface {
+	Do(ctx context.Context, args ...string) (interface{}, error)
+}
+
+func parseKeys(cfg Config) ([]*template.Template, error) {
+	keys := make([]*template.Template, len(cfg.Keys))
+	for i, k := range cfg.Keys {
+		t, err := tmpl.Parse(fmt.Sprintf("key_%d", i), k)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = t
+	}
+	return keys, nil
+}
+
+// NewProxy returns a proxy executing the configured command with the received client
+func NewProxy(client Doer, cfg Config, ef proxy.EntityFormatter) (proxy.Proxy, error) {
+	keys, err := parseKeys(cfg)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		data := tmpl.FromRequest(r)
+		args := make([]string, len(keys)+1)
+		args[0] = cfg.Command
+		for i, t := range keys {
+			k, err := tmpl.Execute(t, data)
+			if err != nil {
+				return nil, err
+			}
+			args[i+1] = k
+		}
+
+		reply, err := client.Do(ctx, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		var res map[string]interface{}
+		switch cfg.Command {
+		case "GET":
+			res, err = decodeGet(reply)
+		case "HGETALL":
+			res, err = decodeHGetAll(reply)
+		case "MGET":
+			res, err = decodeMGet(args[1:], reply)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		formatted := ef.Format(proxy.Response{
+			Data:       res,
+			IsComplete: true,
+			Metadata:   proxy.Metadata{StatusCode: http.StatusOK, Headers: map[string][]string{}},
+		})
+		return &formatted, nil
+	}, nil
+}
+
+func decodeGet(reply interface{}) (map[string]interface{}, error) {
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	switch v := decodeValue(b).(type) {
+	case map[string]interface{}:
+		return v, nil
+	case []interface{}:
+		return map[string]interface{}{"collection": v}, nil
+	default:
+		return map[string]interface{}{"value": v}, nil
+	}
+}
+
+func decodeHGetAll(reply interface{}) (map[string]interface{}, error) {
+	values, err := redigo.Values(reply, nil)
+	if err != nil || len(values) == 0 {
+		return nil, ErrNotFound
+	}
+	res := make(map[string]interface{}, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		k, _ := values[i].([]byte)
+		v, _ := values[i+1].([]byte)
+		res[string(k)] = decodeValue(v)
+	}
+	return res, nil
+}
+
+func decodeMGet(keys []string, reply interface{}) (map[string]interface{}, error) {
+	values, err := redigo.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		b, ok := v.([]byte)
+		if !ok || i >= len(keys) {
+			continue
+		}
+		res[keys[i]] = decodeValue(b)
+	}
+	if len(res) == 0 {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// decodeValue decodes JSON values, returning the raw string if the content is not valid JSON
+func decodeValue(b []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	return v
+}
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string   { return "redis: key not found" }
+func (notFoundError) StatusCode() int { return http.StatusNotFound }
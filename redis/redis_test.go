@@ -0,0 +1,211 @@
+package redis
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// fakeServer replies to the supported commands with the values of a map, as redigo would
+type fakeServer struct {
+	strings map[string]string
+	hashes  map[string]map[string]string
+}
+
+func (f fakeServer) Do(_ context.Context, args ...string) (interface{}, error) {
+	bulk := func(key string) interface{} {
+		if v, ok := f.strings[key]; ok {
+			return []byte(v)
+		}
+		return nil
+	}
+	switch args[0] {
+	case "GET":
+		return bulk(args[1]), nil
+	case "MGET":
+		res := []interface{}{}
+		for _, k := range args[1:] {
+			res = append(res, bulk(k))
+		}
+		return res, nil
+	case "HGETALL":
+		res := []interface{}{}
+		for k, v := range f.hashes[args[1]] {
+			res = append(res, []byte(k), []byte(v))
+		}
+		return res, nil
+	}
+	return nil, nil
+}
+
+func TestNewProxy(t *testing.T) {
+	s := fakeServer{
+		strings: map[string]string{
+			"user:42": `{"id":42,"name":"foo","email":"foo@example.com"}`,
+			"list:42": `[1,2,3]`,
+		},
+		hashes: map[string]map[string]string{
+			"profile:abc": {"name": `"bar"`, "tags": `["a","b"]`, "raw": `not json`},
+		},
+	}
+
+	gatewayClaims := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"abc"}`))
+	req := &proxy.Request{
+		Params:  map[string]string{"Id": "42"},
+		Headers: map[string][]string{"X-Gateway-Claims": {gatewayClaims}},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		backend  *config.Backend
+		expected map[string]interface{}
+		err      error
+	}{
+		{
+			name: "get",
+			backend: &config.Backend{
+				Blacklist: []string{"email"},
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"keys": []interface{}{"user:{{.Params.Id}}"},
+				}},
+			},
+			expected: map[string]interface{}{"id": 42.0, "name": "foo"},
+		},
+		{
+			name: "get_collection",
+			backend: &config.Backend{
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"command": "get",
+					"keys":    []interface{}{"list:{{.Params.Id}}"},
+				}},
+			},
+			expected: map[string]interface{}{"collection": []interface{}{1.0, 2.0, 3.0}},
+		},
+		{
+			name: "hgetall",
+			backend: &config.Backend{
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"command": "HGETALL",
+					"keys":    []interface{}{"profile:{{.Claims.sub}}"},
+				}},
+			},
+			expected: map[string]interface{}{"name": "bar", "tags": []interface{}{"a", "b"}, "raw": "not json"},
+		},
+		{
+			name: "mget",
+			backend: &config.Backend{
+				Group: "data",
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"command": "MGET",
+					"keys":    []interface{}{"list:{{.Params.Id}}", "unknown"},
+				}},
+			},
+			expected: map[string]interface{}{"data": map[string]interface{}{"list:42": []interface{}{1.0, 2.0, 3.0}}},
+		},
+		{
+			name: "not_found",
+			backend: &config.Backend{
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"keys": []interface{}{"user:unknown"},
+				}},
+			},
+			err: ErrNotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := ConfigGetter(tc.backend.ExtraConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewProxy(s, cfg, proxy.NewEntityFormatter(tc.backend))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := p(context.Background(), req)
+			if err != tc.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.err != nil {
+				return
+			}
+			if !resp.IsComplete || !reflect.DeepEqual(resp.Data, tc.expected) {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestNewBackendFactory_sanitizedHosts(t *testing.T) {
+	extra := config.ExtraConfig{Namespace: map[string]interface{}{"keys": []interface{}{"a"}}}
+	cfg := config.ServiceConfig{
+		Version: config.ConfigVersion,
+		Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/a",
+			Method:   "GET",
+			Backend: []*config.Backend{
+				{Host: []string{"cache.internal:6379"}, URLPattern: "/", ExtraConfig: extra},
+				{Host: []string{"redis://cache.internal:6379"}, HostSanitizationDisabled: true, URLPattern: "/", ExtraConfig: extra},
+			},
+		}},
+	}
+	if err := cfg.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bf := NewBackendFactory(ctx, logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		t.Error("fallback backend factory called")
+		return proxy.NoopProxy
+	})
+	for _, b := range cfg.Endpoints[0].Backend {
+		bf(b)
+		rcfg, _ := ConfigGetter(b.ExtraConfig)
+		poolCfg, err := newPoolConfig(b.Host[0], rcfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr := poolCfg.HostPort(); addr != "cache.internal:6379" {
+			t.Errorf("unexpected address %q for the host %q", addr, b.Host[0])
+		}
+	}
+}
+
+func TestConfigGetter(t *testing.T) {
+	for _, cfg := range []map[string]interface{}{
+		{"command": "SET", "keys": []interface{}{"a"}},
+		{"command": "GET", "keys": []interface{}{"a", "b"}},
+		{"command": "MGET"},
+	} {
+		if _, err := ConfigGetter(config.ExtraConfig{Namespace: cfg}); err == nil {
+			t.Errorf("expecting error for %v", cfg)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		host  []string
+		cfg   map[string]interface{}
+		valid bool
+	}{
+		"valid":            {host: []string{"redis:6379"}, cfg: map[string]interface{}{"keys": []interface{}{"user:{{.Params.Id}}"}}, valid: true},
+		"no host":          {cfg: map[string]interface{}{"keys": []interface{}{"a"}}},
+		"invalid template": {host: []string{"redis:6379"}, cfg: map[string]interface{}{"keys": []interface{}{"{{.Params.Id"}}},
+		"invalid timeout":  {host: []string{"redis:6379"}, cfg: map[string]interface{}{"keys": []interface{}{"a"}, "dial_timeout": "soon"}},
+		"invalid command":  {host: []string{"redis:6379"}, cfg: map[string]interface{}{"command": "DEL", "keys": []interface{}{"a"}}},
+	} {
+		err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/foo",
+			Backend:  []*config.Backend{{URLPattern: "/bar", Host: tc.host, ExtraConfig: config.ExtraConfig{Namespace: tc.cfg}}},
+		}}})
+		if tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
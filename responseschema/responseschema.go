@@ -0,0 +1,192 @@
+/*
+Package responseschema validates the responses of the backends against a JSON schema, so the contract
+breaks of the upstream services are detected before the clients see them.
+
+Sample backend config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/responseschema": {
+			"action": "fail",
+			"schema": {
+				"type": "object",
+				"required": [ "id", "name" ],
+				"properties": {
+					"id": { "type": "integer" },
+					"name": { "type": "string" }
+				}
+			}
+		}
+	},
+	...
+
+The schema is applied to the data returned by the backend, after its formatting (group, target,
+mapping, allow and deny). Every violation increments the responseschema.<url_pattern>.violations
+counter of the metrics registry, and the action decides what else happens:
+
+  - metric: nothing else
+  - log (default): the violations are logged as warnings
+  - fail: the violations are logged and the backend fails with a 502 error
+
+The schemas are compiled when the backends are created, and Validate rejects the configurations with
+invalid ones.
+*/
+package responseschema
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/responseschema"
+
+// The supported actions
+const (
+	ActionLog    = "log"
+	ActionMetric = "metric"
+	ActionFail   = "fail"
+)
+
+var (
+	// ErrNoConfig is returned when the backend has no responseschema config
+	ErrNoConfig = errors.New("responseschema: no config")
+	// ErrNoSchema is returned when the config has no schema
+	ErrNoSchema = errors.New("responseschema: no schema defined")
+)
+
+// Config is the custom config struct of the response validation
+type Config struct {
+	Action string                 `json:"action"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// ConfigGetter parses the responseschema config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Schema == nil {
+		return cfg, ErrNoSchema
+	}
+	switch cfg.Action {
+	case "":
+		cfg.Action = ActionLog
+	case ActionLog, ActionMetric, ActionFail:
+	default:
+		return cfg, fmt.Errorf("responseschema: unknown action %q", cfg.Action)
+	}
+	return cfg, nil
+}
+
+// Validate compiles every schema of the service config, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil {
+				_, err = gojsonschema.NewSchema(gojsonschema.NewGoLoader(c.Schema))
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// ViolationError is returned by the backends failing the validation with the fail action
+type ViolationError struct {
+	Backend    string
+	Violations []string
+}
+
+// Error implements the error interface
+func (v ViolationError) Error() string {
+	return fmt.Sprintf("responseschema: invalid response from %s: %s", v.Backend, strings.Join(v.Violations, "; "))
+}
+
+// StatusCode returns the status of the response
+func (ViolationError) StatusCode() int { return http.StatusBadGateway }
+
+// BackendFactory returns a backend factory validating the responses of the backends with a
+// responseschema config
+func BackendFactory(logger logging.Logger, registry gometrics.Registry, bf proxy.BackendFactory) proxy.BackendFactory {
+	if registry == nil {
+		registry = gometrics.NewRegistry()
+	}
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next
+		}
+		var schema *gojsonschema.Schema
+		if err == nil {
+			schema, err = gojsonschema.NewSchema(gojsonschema.NewGoLoader(cfg.Schema))
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] responseschema: %s", remote.URLPattern, err.Error()))
+			return next
+		}
+		counter := gometrics.GetOrRegisterCounter("responseschema."+remote.URLPattern+".violations", registry)
+		return NewProxy(logger, remote.URLPattern, cfg.Action, schema, counter, next)
+	}
+}
+
+// NewProxy returns a proxy validating the responses of the next one with the schema
+func NewProxy(logger logging.Logger, name, action string, schema *gojsonschema.Schema, counter gometrics.Counter, next proxy.Proxy) proxy.Proxy {
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		resp, err := next(ctx, r)
+		if err != nil || resp == nil || resp.Data == nil {
+			return resp, err
+		}
+
+		res, verr := schema.Validate(gojsonschema.NewGoLoader(resp.Data))
+		if verr != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] responseschema: %s", name, verr.Error()))
+			return resp, err
+		}
+		if res.Valid() {
+			return resp, err
+		}
+
+		counter.Inc(1)
+		violations := make([]string, len(res.Errors()))
+		for i, e := range res.Errors() {
+			violations[i] = e.String()
+		}
+		if action == ActionMetric {
+			return resp, err
+		}
+		verror := ViolationError{Backend: name, Violations: violations}
+		logger.Warning(fmt.Sprintf("[BACKEND: %s] %s", name, verror.Error()))
+		if action == ActionFail {
+			return nil, verror
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,75 @@
+package responseschema
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func TestBackendFactory(t *testing.T) {
+	schema := map[string]interface{}{
+		"type":     "object",
+		"required": []interface{}{"id", "name"},
+		"properties": map[string]interface{}{
+			"id":   map[string]interface{}{"type": "integer"},
+			"name": map[string]interface{}{"type": "string"},
+		},
+	}
+	data := map[string]interface{}{"id": 1.0, "name": 42.0}
+
+	registry := gometrics.NewRegistry()
+	bf := BackendFactory(logging.NoOp, registry, func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: data, IsComplete: true}, nil
+		}
+	})
+
+	for _, action := range []string{ActionLog, ActionMetric, ActionFail} {
+		p := bf(&config.Backend{URLPattern: "/" + action, ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"action": action,
+			"schema": schema,
+		}}})
+		resp, err := p(context.Background(), &proxy.Request{})
+		if action == ActionFail {
+			verr, ok := err.(ViolationError)
+			if !ok || resp != nil || verr.StatusCode() != http.StatusBadGateway || len(verr.Violations) != 1 {
+				t.Errorf("%s: unexpected result %v %v", action, resp, err)
+			}
+		} else if err != nil || resp == nil {
+			t.Errorf("%s: unexpected result %v %v", action, resp, err)
+		}
+		if c := gometrics.GetOrRegisterCounter("responseschema./"+action+".violations", registry).Count(); c != 1 {
+			t.Errorf("%s: unexpected counter %d", action, c)
+		}
+	}
+
+	data["name"] = "foo"
+	p := bf(&config.Backend{URLPattern: "/valid", ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"action": ActionFail,
+		"schema": schema,
+	}}})
+	if _, err := p(context.Background(), &proxy.Request{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, extra := range []map[string]interface{}{
+		{"schema": map[string]interface{}{"type": "unknown"}},
+		{"schema": map[string]interface{}{"type": "object"}, "action": "panic"},
+		{},
+	} {
+		cfg := config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/",
+			Backend:  []*config.Backend{{ExtraConfig: config.ExtraConfig{Namespace: extra}}},
+		}}}
+		if err := Validate(cfg); err == nil {
+			t.Errorf("expecting error for %v", extra)
+		}
+	}
+}
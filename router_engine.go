@@ -6,6 +6,11 @@ import (
 	gin_logger "github.com/Unacademy/krakend-gin-logger"
 
 	botdetector "github.com/devopsfaith/krakend-botdetector/gin"
+	"github.com/devopsfaith/krakend-ce/apikey"
+	"github.com/devopsfaith/krakend-ce/canary"
+	"github.com/devopsfaith/krakend-ce/compression"
+	"github.com/devopsfaith/krakend-ce/quota"
+	"github.com/devopsfaith/krakend-ce/redact"
 	httpsecure "github.com/devopsfaith/krakend-httpsecure/gin"
 	lua "github.com/devopsfaith/krakend-lua/router/gin"
 	"github.com/gin-gonic/gin"
@@ -20,7 +25,7 @@ func NewEngine(cfg config.ServiceConfig, logger logging.Logger, w io.Writer) *gi
 	}
 
 	engine := gin.New()
-	engine.Use(gin_logger.NewLogger(cfg.ExtraConfig, logger, gin.LoggerConfig{Output: w}), gin.Recovery())
+	engine.Use(gin_logger.NewLogger(cfg.ExtraConfig, logger, gin.LoggerConfig{Output: redact.NewWriter(cfg.ExtraConfig, logger, w)}), gin.Recovery())
 
 	engine.RedirectTrailingSlash = true
 	engine.RedirectFixedPath = true
@@ -34,6 +39,14 @@ func NewEngine(cfg config.ServiceConfig, logger logging.Logger, w io.Writer) *gi
 
 	botdetector.Register(cfg, logger, engine)
 
+	canary.Register(cfg, logger, engine)
+
+	quota.Register(cfg, logger, engine)
+
+	apikey.Register(cfg, logger, engine)
+
+	compression.Register(cfg, logger, engine)
+
 	return engine
 }
 
@@ -0,0 +1,283 @@
+/*
+Package stub provides a backend returning fixtures without any network call, so endpoints can be
+published and consumed before their upstream services exist.
+
+Sample backend config:
+
+	...
+	"url_pattern": "/",
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/stub": {
+			"status": 200,
+			"headers": { "X-Stub": "true" },
+			"latency": "120ms",
+			"jitter": "40ms",
+			"template": "{\"id\": {{json .Params.Id}}, \"owner\": {{json (default \"anonymous\" (index .Claims \"sub\"))}}}"
+		}
+	},
+	...
+
+The fixture is defined by exactly one of:
+
+  - body: an inline JSON value
+  - file: the path of a JSON file, read when the backend is created
+  - template: a Go template rendering a JSON document with the request data (see the internal tmpl
+    package)
+
+Objects are returned as they are, arrays under the "collection" key and scalars under the "value" key.
+The responses go through the regular backend formatter, so allow, deny, mapping, group and target work
+as with the HTTP backends, and the stubs can be merged with other backends and filtered by the cel and
+lua layers.
+
+Stubs with a status code of 400 or higher return an error with that status and no data. The latency,
+plus a random jitter, is applied before answering and respects the cancellation of the request.
+*/
+package stub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/internal/tmpl"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/stub"
+
+var (
+	// ErrNoConfig is returned when the backend has no stub config
+	ErrNoConfig = errors.New("stub: no config")
+	// ErrNoFixture is returned when the config does not define exactly one fixture source
+	ErrNoFixture = errors.New("stub: exactly one of body, file or template is required")
+)
+
+// Config is the custom config struct of the stub backend
+type Config struct {
+	Status   int               `json:"status"`
+	Headers  map[string]string `json:"headers"`
+	Latency  string            `json:"latency"`
+	Jitter   string            `json:"jitter"`
+	Body     json.RawMessage   `json:"body"`
+	File     string            `json:"file"`
+	Template string            `json:"template"`
+}
+
+// ConfigGetter parses the stub config of the backend
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	sources := 0
+	for _, defined := range []bool{len(cfg.Body) > 0, cfg.File != "", cfg.Template != ""} {
+		if defined {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return cfg, ErrNoFixture
+	}
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusOK
+	}
+	return cfg, nil
+}
+
+// BackendFactory returns a backend factory creating stub backends for the backends with a stub config
+// and delegating the rest to the injected one
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		cfg, err := ConfigGetter(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return bf(remote)
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return bf(remote)
+		}
+		p, err := NewProxy(cfg, proxy.NewEntityFormatter(remote))
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] stub: %s", remote.URLPattern, err.Error()))
+			return bf(remote)
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] stub backend with status %d", remote.URLPattern, cfg.Status))
+		return p
+	}
+}
+
+// Validate checks the stub configs of the backends of the service, so the invalid ones fail at startup
+// instead of falling back to the http backend
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			c, err := ConfigGetter(b.ExtraConfig)
+			if err == ErrNoConfig {
+				continue
+			}
+			if err == nil {
+				_, _, err = parseLatency(c)
+			}
+			if err == nil {
+				_, err = newRenderer(c)
+			}
+			if err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// NewProxy returns a proxy answering every request with the configured fixture
+func NewProxy(cfg Config, ef proxy.EntityFormatter) (proxy.Proxy, error) {
+	latency, jitter, err := parseLatency(cfg)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+
+	render, err := newRenderer(cfg)
+	if err != nil {
+		return proxy.NoopProxy, err
+	}
+
+	headers := make(map[string][]string, len(cfg.Headers)+1)
+	headers["Content-Type"] = []string{"application/json"}
+	for k, v := range cfg.Headers {
+		headers[http.CanonicalHeaderKey(k)] = []string{v}
+	}
+
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		if d := latency + randDuration(jitter); d > 0 {
+			t := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			case <-t.C:
+			}
+		}
+
+		if cfg.Status >= http.StatusBadRequest {
+			return nil, StatusError{Code: cfg.Status}
+		}
+
+		b, err := render(r)
+		if err != nil {
+			return nil, err
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+
+		var data map[string]interface{}
+		switch t := v.(type) {
+		case map[string]interface{}:
+			data = t
+		case []interface{}:
+			data = map[string]interface{}{"collection": t}
+		default:
+			data = map[string]interface{}{"value": t}
+		}
+
+		resHeaders := make(map[string][]string, len(headers))
+		for k, vs := range headers {
+			resHeaders[k] = vs
+		}
+		formatted := ef.Format(proxy.Response{
+			Data:       data,
+			IsComplete: true,
+			Metadata:   proxy.Metadata{StatusCode: cfg.Status, Headers: resHeaders},
+		})
+		if out, err := json.Marshal(formatted.Data); err == nil {
+			formatted.Io = bytes.NewReader(out)
+		}
+		return &formatted, nil
+	}, nil
+}
+
+// StatusError is returned by the stubs configured with an error status code
+type StatusError struct {
+	Code int
+}
+
+// Error implements the error interface
+func (s StatusError) Error() string { return fmt.Sprintf("stub: status %d", s.Code) }
+
+// StatusCode returns the configured status code
+func (s StatusError) StatusCode() int { return s.Code }
+
+func newRenderer(cfg Config) (func(*proxy.Request) ([]byte, error), error) {
+	switch {
+	case cfg.Template != "":
+		t, err := tmpl.Parse("stub", cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		return renderTemplate(t), nil
+	case cfg.File != "":
+		b, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		return renderStatic(b)
+	default:
+		return renderStatic(cfg.Body)
+	}
+}
+
+func renderTemplate(t *template.Template) func(*proxy.Request) ([]byte, error) {
+	return func(r *proxy.Request) ([]byte, error) {
+		s, err := tmpl.Execute(t, tmpl.FromRequest(r))
+		return []byte(s), err
+	}
+}
+
+func renderStatic(b []byte) (func(*proxy.Request) ([]byte, error), error) {
+	if !json.Valid(b) {
+		return nil, errors.New("the fixture is not valid JSON")
+	}
+	return func(_ *proxy.Request) ([]byte, error) { return b, nil }, nil
+}
+
+func parseLatency(cfg Config) (time.Duration, time.Duration, error) {
+	var latency, jitter time.Duration
+	var err error
+	if cfg.Latency != "" {
+		if latency, err = time.ParseDuration(cfg.Latency); err != nil {
+			return 0, 0, err
+		}
+	}
+	if cfg.Jitter != "" {
+		if jitter, err = time.ParseDuration(cfg.Jitter); err != nil {
+			return 0, 0, err
+		}
+	}
+	return latency, jitter, nil
+}
+
+func randDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
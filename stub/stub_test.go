@@ -0,0 +1,131 @@
+package stub
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestBackendFactory(t *testing.T) {
+	f, err := ioutil.TempFile("", "stub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"id":1},{"id":2}]`)
+	f.Close()
+
+	bf := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		t.Error("fallback backend factory called")
+		return proxy.NoopProxy
+	})
+
+	req := &proxy.Request{Params: map[string]string{"Id": "42"}, Query: map[string][]string{"q": {"foo"}}}
+
+	for _, tc := range []struct {
+		name     string
+		backend  *config.Backend
+		expected map[string]interface{}
+		status   int
+	}{
+		{
+			name: "body",
+			backend: &config.Backend{
+				Blacklist: []string{"secret"},
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"status":  201,
+					"headers": map[string]interface{}{"x-stub": "true"},
+					"body":    map[string]interface{}{"name": "foo", "secret": "bar"},
+				}},
+			},
+			expected: map[string]interface{}{"name": "foo"},
+			status:   201,
+		},
+		{
+			name: "file",
+			backend: &config.Backend{
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"file": f.Name()}},
+			},
+			expected: map[string]interface{}{"collection": []interface{}{map[string]interface{}{"id": 1.0}, map[string]interface{}{"id": 2.0}}},
+			status:   200,
+		},
+		{
+			name: "template",
+			backend: &config.Backend{
+				Group: "item",
+				ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+					"template": `{"id": {{.Params.Id}}, "q": {{json .Query.q}}, "owner": {{json (default "anonymous" (index .Claims "sub"))}}}`,
+				}},
+			},
+			expected: map[string]interface{}{"item": map[string]interface{}{"id": 42.0, "q": "foo", "owner": "anonymous"}},
+			status:   200,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := bf(tc.backend)(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !resp.IsComplete || resp.Metadata.StatusCode != tc.status || !reflect.DeepEqual(resp.Data, tc.expected) {
+				t.Errorf("unexpected response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestNewProxy(t *testing.T) {
+	p, err := NewProxy(Config{Status: 503, Body: []byte(`{}`), Latency: "10ms"}, proxy.NewEntityFormatter(&config.Backend{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = p(context.Background(), &proxy.Request{})
+	if se, ok := err.(StatusError); !ok || se.StatusCode() != 503 {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Error("latency not applied")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p(ctx, &proxy.Request{}); err != context.Canceled {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := NewProxy(Config{Body: []byte(`{`)}, nil); err == nil {
+		t.Error("expecting error for an invalid fixture")
+	}
+	if _, err := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{"file": "a", "template": "b"}}); err != ErrNoFixture {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		cfg   map[string]interface{}
+		valid bool
+	}{
+		"valid":            {cfg: map[string]interface{}{"body": map[string]interface{}{"a": 1}, "latency": "10ms"}, valid: true},
+		"no fixture":       {cfg: map[string]interface{}{"status": 200}},
+		"missing file":     {cfg: map[string]interface{}{"file": "./does-not-exist.json"}},
+		"invalid template": {cfg: map[string]interface{}{"template": "{{.Params.Id"}},
+		"invalid latency":  {cfg: map[string]interface{}{"body": map[string]interface{}{}, "latency": "soon"}},
+		"invalid jitter":   {cfg: map[string]interface{}{"body": map[string]interface{}{}, "jitter": "soon"}},
+	} {
+		err := Validate(config.ServiceConfig{Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/foo",
+			Backend:  []*config.Backend{{URLPattern: "/bar", ExtraConfig: config.ExtraConfig{Namespace: tc.cfg}}},
+		}}})
+		if tc.valid != (err == nil) {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+}
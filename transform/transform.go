@@ -0,0 +1,231 @@
+/*
+Package transform reshapes the response data with declarative expressions, as a lighter alternative to
+the lua scripts.
+
+The same config can be added to the extra_config of a backend, to transform its response before the
+merge, or of an endpoint, to transform the merged response. Sample config:
+
+	...
+	"extra_config": {
+		"github.com/devopsfaith/krakend-ce/transform": {
+			"language": "jmespath",
+			"expression": "{id: user.id, emails: contacts[?type=='email'].value}"
+		}
+	},
+	...
+
+The expressions are compiled when the pipes are built, and Validate rejects the configurations with
+invalid ones, so they are reported by the check command. Expressions returning an object replace the
+response data, while the arrays are placed under the "collection" key and the scalars under the "value"
+key. The supported languages are JMESPath (the default) and JSONata. The JSONata expressions without
+results (undefined) return an empty object.
+*/
+package transform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	jsonata "github.com/blues/jsonata-go"
+	"github.com/jmespath/go-jmespath"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github.com/devopsfaith/krakend-ce/transform"
+
+const (
+	// JMESPath is the name of the JMESPath language
+	JMESPath = "jmespath"
+	// JSONata is the name of the JSONata language
+	JSONata = "jsonata"
+)
+
+var (
+	// ErrNoConfig is returned when there is no transform config
+	ErrNoConfig = errors.New("transform: no config")
+	// ErrNoExpression is returned when the config has no expression
+	ErrNoExpression = errors.New("transform: no expression defined")
+)
+
+// Config is the custom config struct of the transformations
+type Config struct {
+	Language   string `json:"language"`
+	Expression string `json:"expression"`
+}
+
+// ConfigGetter parses the transform config
+func ConfigGetter(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	v, ok := e[Namespace]
+	if !ok {
+		return cfg, ErrNoConfig
+	}
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return cfg, err
+	}
+	if err := json.NewDecoder(buf).Decode(&cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.Expression == "" {
+		return cfg, ErrNoExpression
+	}
+	cfg.Language = strings.ToLower(cfg.Language)
+	if cfg.Language == "" {
+		cfg.Language = JMESPath
+	}
+	return cfg, nil
+}
+
+// Transformer applies an expression to the response data
+type Transformer func(map[string]interface{}) (map[string]interface{}, error)
+
+// New compiles the expression of the config
+func New(cfg Config) (Transformer, error) {
+	switch cfg.Language {
+	case JMESPath:
+		jp, err := jmespath.Compile(cfg.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return func(data map[string]interface{}) (map[string]interface{}, error) {
+			res, err := jp.Search(data)
+			if err != nil {
+				return nil, err
+			}
+			return wrap(res), nil
+		}, nil
+	case JSONata:
+		e, err := jsonata.Compile(cfg.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return func(data map[string]interface{}) (map[string]interface{}, error) {
+			res, err := e.Eval(data)
+			if err == jsonata.ErrUndefined {
+				return map[string]interface{}{}, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			return wrap(res), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("transform: unknown language %q", cfg.Language)
+	}
+}
+
+// Validate compiles every expression of the service config, returning the first error
+func Validate(cfg config.ServiceConfig) error {
+	for _, e := range cfg.Endpoints {
+		if err := validate(e.ExtraConfig); err != nil {
+			return fmt.Errorf("endpoint %s %s: %s", e.Method, e.Endpoint, err.Error())
+		}
+		for _, b := range e.Backend {
+			if err := validate(b.ExtraConfig); err != nil {
+				return fmt.Errorf("endpoint %s %s, backend %s: %s", e.Method, e.Endpoint, b.URLPattern, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+func validate(e config.ExtraConfig) error {
+	cfg, err := ConfigGetter(e)
+	if err == ErrNoConfig {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = New(cfg)
+	return err
+}
+
+// BackendFactory returns a backend factory transforming the responses of the backends with a
+// transform config
+func BackendFactory(logger logging.Logger, bf proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		next := bf(remote)
+		t, err := newTransformer(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[BACKEND: %s] %s", remote.URLPattern, err.Error()))
+			return next
+		}
+		logger.Debug(fmt.Sprintf("[BACKEND: %s] transforming the responses", remote.URLPattern))
+		return NewMiddleware(t)(next)
+	}
+}
+
+// ProxyFactory returns a proxy factory transforming the merged responses of the endpoints with a
+// transform config
+func ProxyFactory(logger logging.Logger, pf proxy.Factory) proxy.Factory {
+	return proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(remote)
+		if err != nil {
+			return next, err
+		}
+		t, err := newTransformer(remote.ExtraConfig)
+		if err == ErrNoConfig {
+			return next, nil
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("[ENDPOINT: %s] %s", remote.Endpoint, err.Error()))
+			return next, err
+		}
+		logger.Debug(fmt.Sprintf("[ENDPOINT: %s] transforming the responses", remote.Endpoint))
+		return NewMiddleware(t)(next), nil
+	})
+}
+
+// NewMiddleware returns a middleware applying the transformer to the data of the responses
+func NewMiddleware(t Transformer) proxy.Middleware {
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) != 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+			resp, err := next[0](ctx, r)
+			if resp == nil || resp.Data == nil {
+				return resp, err
+			}
+			data, terr := t(resp.Data)
+			if terr != nil {
+				return nil, terr
+			}
+			resp.Data = data
+			return resp, err
+		}
+	}
+}
+
+func newTransformer(e config.ExtraConfig) (Transformer, error) {
+	cfg, err := ConfigGetter(e)
+	if err != nil {
+		return nil, err
+	}
+	return New(cfg)
+}
+
+func wrap(v interface{}) map[string]interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t
+	case []interface{}:
+		return map[string]interface{}{"collection": t}
+	case nil:
+		return map[string]interface{}{}
+	default:
+		return map[string]interface{}{"value": t}
+	}
+}
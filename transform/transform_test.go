@@ -0,0 +1,97 @@
+package transform
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestBackendFactory(t *testing.T) {
+	data := map[string]interface{}{
+		"user": map[string]interface{}{"id": 1.0, "name": "foo"},
+		"contacts": []interface{}{
+			map[string]interface{}{"type": "email", "value": "foo@example.com"},
+			map[string]interface{}{"type": "phone", "value": "555"},
+		},
+	}
+	bf := BackendFactory(logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{Data: data, IsComplete: true}, nil
+		}
+	})
+
+	for _, tc := range []struct {
+		language   string
+		expression string
+		expected   map[string]interface{}
+	}{
+		{
+			expression: "{id: user.id, emails: contacts[?type=='email'].value}",
+			expected:   map[string]interface{}{"id": 1.0, "emails": []interface{}{"foo@example.com"}},
+		},
+		{
+			expression: "contacts[].type",
+			expected:   map[string]interface{}{"collection": []interface{}{"email", "phone"}},
+		},
+		{
+			expression: "user.name",
+			expected:   map[string]interface{}{"value": "foo"},
+		},
+		{
+			language:   "jsonata",
+			expression: `{"id": user.id, "emails": [contacts[type='email'].value]}`,
+			expected:   map[string]interface{}{"id": 1.0, "emails": []interface{}{"foo@example.com"}},
+		},
+		{
+			language:   "JSONata",
+			expression: "contacts.type",
+			expected:   map[string]interface{}{"collection": []interface{}{"email", "phone"}},
+		},
+		{
+			language:   "jsonata",
+			expression: "unknown.field",
+			expected:   map[string]interface{}{},
+		},
+	} {
+		extra := map[string]interface{}{"expression": tc.expression, "language": tc.language}
+		p := bf(&config.Backend{ExtraConfig: config.ExtraConfig{Namespace: extra}})
+		resp, err := p(context.Background(), &proxy.Request{})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !reflect.DeepEqual(resp.Data, tc.expected) {
+			t.Errorf("%s: unexpected data %v", tc.expression, resp.Data)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := config.ServiceConfig{Endpoints: []*config.EndpointConfig{
+		{
+			Endpoint: "/a",
+			Backend: []*config.Backend{
+				{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"expression": "a.b"}}},
+			},
+		},
+	}}
+	if err := Validate(cfg); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, extra := range []map[string]interface{}{
+		{"expression": "a.["},
+		{"expression": "$.a[", "language": "jsonata"},
+		{"expression": "a", "language": "jq"},
+		{},
+	} {
+		cfg.Endpoints[0].ExtraConfig = config.ExtraConfig{Namespace: extra}
+		if err := Validate(cfg); err == nil {
+			t.Errorf("expecting error for %v", extra)
+		}
+	}
+}